@@ -17,6 +17,7 @@ package v1
 import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -41,12 +42,469 @@ type HBaseSpec struct {
 	// hadoop-env.sh - script to set up the working environment for hadoop, including the location of Java,
 	// Java options, and other environment variables.
 	Config ConfigMap `json:"config,omitempty"`
+
+	// Drain configures how regions are moved off a RegionServer before it's restarted.
+	// +kubebuilder:validation:Optional
+	Drain DrainSpec `json:"drain,omitempty"`
+
+	// Balancer is the policy of the HBase balancer. If not set, the balancer is
+	// left as is, except during rollouts, after which its previous state is restored.
+	// The balancer is always off while RegionServers are restarted.
+	// +kubebuilder:validation:Optional
+	Balancer *SwitchSpec `json:"balancer,omitempty"`
+
+	// Normalizer is the policy of the HBase region normalizer. If not set,
+	// the normalizer is left as is.
+	// +kubebuilder:validation:Optional
+	Normalizer *SwitchSpec `json:"normalizer,omitempty"`
+
+	// MaintenanceWindows are windows when pods are allowed to be restarted to apply
+	// changes. StatefulSets are updated at any time, but their pods are restarted
+	// only within the windows. Without any windows, there is no restriction and pods
+	// are restarted at any time. Windows are ignored while the HBase has
+	// "hbase-controller-maintenance-override" annotation set to "true".
+	// If a window closes while RegionServers are drained, the rollout pauses: the
+	// partly drained RegionServers stay drained and aren't restarted, and the balancer
+	// stays off until the rollout resumes in the next window. Pods of previous
+	// revisions that aren't ready don't serve, so they are replaced outside of
+	// windows as well.
+	// +kubebuilder:validation:Optional
+	MaintenanceWindows []TimeWindow `json:"maintenanceWindows,omitempty"`
+
+	// Canary is the policy of RegionServer rollouts to verify a new revision on a few
+	// RegionServers before the rest are restarted. All RegionServers are restarted
+	// one after another if not set.
+	// +kubebuilder:validation:Optional
+	Canary *CanarySpec `json:"canary,omitempty"`
+
+	// Rollout configures how failed rollouts are handled.
+	// +kubebuilder:validation:Optional
+	Rollout RolloutSpec `json:"rollout,omitempty"`
+
+	// RevisionHistoryLimit is the number of previous config ConfigMaps, and of
+	// StatefulSet revisions including the current one, to keep to allow
+	// rollbacks. The stable StatefulSet revision is always kept and counts
+	// towards the limit. Defaults to 10.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	RevisionHistoryLimit *int32 `json:"revisionHistoryLimit,omitempty"`
+
+	// Security configures authentication of servers.
+	// +kubebuilder:validation:Optional
+	Security *SecuritySpec `json:"security,omitempty"`
 }
 
+// SecuritySpec configures authentication of servers
+type SecuritySpec struct {
+	// Kerberos enables Kerberos authentication of servers.
+	// +kubebuilder:validation:Optional
+	Kerberos *KerberosSpec `json:"kerberos,omitempty"`
+	// TLS enables TLS of RPC and HTTPS of info servers.
+	// +kubebuilder:validation:Optional
+	TLS *TLSSpec `json:"tls,omitempty"`
+	// RestartWithoutDrain opts in to restarting servers the operator can't call
+	// RPCs of, since its client supports neither SASL nor TLS. It's required with
+	// Kerberos, and with TLS unless plaintext is allowed.
+	// Pods are then restarted one at a time once all pods are ready, without
+	// draining RegionServers or waiting for regions in transition. Canary,
+	// Balancer, Normalizer and config Reload require RPCs and are rejected.
+	// +kubebuilder:validation:Optional
+	RestartWithoutDrain bool `json:"restartWithoutDrain,omitempty"`
+}
+
+// TLSSpec configures TLS of servers. Certificates of roles are converted into
+// PKCS12 keystores and truststores in /etc/hbase/tls by an init container.
+// Servers are restarted with a rollout when certificates of a role change.
+type TLSSpec struct {
+	// Master is the certificate of masters.
+	Master TLSCertificate `json:"master"`
+	// RegionServer is the certificate of RegionServers.
+	RegionServer TLSCertificate `json:"regionServer"`
+	// KeystorePassword is the key of a Secret with the password of keystores.
+	// It's passed to servers as HBASE_TLS_PASSWORD environment variable.
+	KeystorePassword corev1.SecretKeySelector `json:"keystorePassword"`
+	// Image of the init container that generates keystores. It needs openssl
+	// and keytool. Defaults to the image of the first container of the role.
+	// +kubebuilder:validation:Optional
+	Image string `json:"image,omitempty"`
+	// AllowPlaintext allows clients to connect to servers without TLS. The
+	// operator doesn't support TLS, since gohbase doesn't, so without it the
+	// operator can't call RPCs of servers and requires RestartWithoutDrain.
+	// +kubebuilder:validation:Optional
+	AllowPlaintext bool `json:"allowPlaintext,omitempty"`
+}
+
+// TLSCertificate is a Secret with a certificate, either existing or issued by
+// cert-manager
+type TLSCertificate struct {
+	// SecretName is the name of a Secret with "tls.crt", "tls.key" and "ca.crt"
+	// as created by cert-manager. Defaults to "<name>-<role>-tls" if Issuer is set.
+	// +kubebuilder:validation:Optional
+	SecretName string `json:"secretName,omitempty"`
+	// Issuer of a cert-manager Certificate the operator creates for the pods of
+	// the role. The Secret isn't managed by the operator if not set.
+	// +kubebuilder:validation:Optional
+	Issuer *IssuerReference `json:"issuer,omitempty"`
+}
+
+// IssuerReference is a reference to a cert-manager issuer
+type IssuerReference struct {
+	// Name of the issuer.
+	Name string `json:"name"`
+	// Kind of the issuer, such as "Issuer" or "ClusterIssuer". Defaults to "Issuer".
+	// +kubebuilder:validation:Optional
+	Kind string `json:"kind,omitempty"`
+	// Group of the issuer. Defaults to "cert-manager.io".
+	// +kubebuilder:validation:Optional
+	Group string `json:"group,omitempty"`
+}
+
+// KerberosSpec configures Kerberos authentication. Keytabs of roles are
+// mounted in /etc/security/keytabs and krb5.conf is mounted as /etc/krb5.conf
+// in containers of servers. Properties of Kerberos are set in the config.
+// A JAAS config that logs in to ZooKeeper with the keytab of the role is
+// mounted as /etc/security/jaas.conf and passed to servers in HBASE_OPTS,
+// which hbase-env.sh has to append to. _HOST of principals in it is replaced
+// with the FQDN of the pod. A rotated keytab restarts servers of its role
+// with a rollout.
+type KerberosSpec struct {
+	// Krb5Config is the key of a ConfigMap with krb5.conf. It's copied into
+	// config ConfigMaps, so that its changes roll out as any config change.
+	Krb5Config corev1.ConfigMapKeySelector `json:"krb5Config"`
+	// Master is the principal and keytab of masters.
+	Master KerberosPrincipal `json:"master"`
+	// RegionServer is the principal and keytab of RegionServers.
+	RegionServer KerberosPrincipal `json:"regionServer"`
+	// AllowSimpleAuthFallback allows clients without Kerberos credentials to
+	// connect to servers. It doesn't let the operator call RPCs of servers,
+	// since authorization denies admin RPCs to unauthenticated users.
+	// +kubebuilder:validation:Optional
+	AllowSimpleAuthFallback bool `json:"allowSimpleAuthFallback,omitempty"`
+}
+
+// KerberosPrincipal is a principal and its keytab
+type KerberosPrincipal struct {
+	// Principal such as "hbase/_HOST@EXAMPLE.COM". Servers replace _HOST with their hostname.
+	// +kubebuilder:validation:MinLength=1
+	Principal string `json:"principal"`
+	// Keytab is the key of a Secret with the keytab of the principal.
+	Keytab corev1.SecretKeySelector `json:"keytab"`
+}
+
+// RolloutSpec configures how failed rollouts are handled
+type RolloutSpec struct {
+	// RollbackOnFailure rolls the StatefulSets back to their last revisions that
+	// became ready if pods of a new revision don't become ready within the progress deadline.
+	// +kubebuilder:validation:Optional
+	RollbackOnFailure bool `json:"rollbackOnFailure,omitempty"`
+	// ProgressDeadlineSeconds is how long a step of the rollout can take before
+	// the rollout is considered stalled, or failed if a restarted pod doesn't
+	// become ready. Defaults to 600.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	ProgressDeadlineSeconds int32 `json:"progressDeadlineSeconds,omitempty"`
+	// StepDeadlines override ProgressDeadlineSeconds for steps of the rollout.
+	// +kubebuilder:validation:Optional
+	StepDeadlines StepDeadlines `json:"stepDeadlines,omitempty"`
+	// Topology makes RegionServer rollouts aware of failure domains, such as zones
+	// or racks. RegionServers are restarted one domain at a time if set, and
+	// their regions are moved to RegionServers outside of the domain.
+	// +kubebuilder:validation:Optional
+	Topology *TopologySpec `json:"topology,omitempty"`
+	// Order is the order RegionServers are restarted in. Defaults to Ordinal.
+	// +kubebuilder:validation:Optional
+	Order RestartOrder `json:"order,omitempty"`
+}
+
+// RestartOrder is the order RegionServers are restarted in during a rollout.
+// The RegionServer that carries hbase:meta is restarted last regardless of the order.
+// +kubebuilder:validation:Enum=Ordinal;FewestRegions;LowestLoad;Priority
+type RestartOrder string
+
+const (
+	// OrdinalRestartOrder restarts RegionServers from the highest ordinal to the lowest.
+	OrdinalRestartOrder RestartOrder = "Ordinal"
+	// FewestRegionsRestartOrder restarts RegionServers with the least regions first.
+	FewestRegionsRestartOrder RestartOrder = "FewestRegions"
+	// LowestLoadRestartOrder restarts RegionServers with the lowest rate of read
+	// and write requests to their regions first. Request rates are sampled across
+	// reconciles, so right after the operator starts RegionServers keep the
+	// ordinal order.
+	LowestLoadRestartOrder RestartOrder = "LowestLoad"
+	// PriorityRestartOrder restarts RegionServers by the integer value of the
+	// "hbase-controller-restart-priority" annotation of their pods, highest first.
+	// Pods without the annotation have priority 0.
+	PriorityRestartOrder RestartOrder = "Priority"
+)
+
+// TopologySpec configures failure domains of RegionServers
+type TopologySpec struct {
+	// Key is the label of nodes whose value is the failure domain of pods
+	// running on them, for example "topology.kubernetes.io/zone".
+	Key string `json:"key"`
+	// ParallelRestart drains and restarts all RegionServers of a domain at once,
+	// instead of one after another. The RegionServer spec MaxUnavailable and the
+	// canary count still limit how many of them are restarted together.
+	// +kubebuilder:validation:Optional
+	ParallelRestart bool `json:"parallelRestart,omitempty"`
+}
+
+// StepDeadlines are progress deadlines of steps of the rollout
+type StepDeadlines struct {
+	// RegionsInTransitionSeconds is how long regions can be in transition.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	RegionsInTransitionSeconds int32 `json:"regionsInTransitionSeconds,omitempty"`
+	// PodReadySeconds is how long a pod can take to terminate or to become ready.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	PodReadySeconds int32 `json:"podReadySeconds,omitempty"`
+	// DrainSeconds is how long a RegionServer can take to be drained, measured
+	// from the start of its drain. See DrainSpec.OnTimeout.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	DrainSeconds int32 `json:"drainSeconds,omitempty"`
+}
+
+// RolloutStep is a step of the rollout that waits for HBase
+type RolloutStep string
+
+const (
+	// StepRegionsInTransition waits for regions in transition to be assigned.
+	StepRegionsInTransition RolloutStep = "RegionsInTransition"
+	// StepPodReady waits for a pod to terminate or to become ready.
+	StepPodReady RolloutStep = "PodReady"
+	// StepDrain waits for a RegionServer to be drained.
+	StepDrain RolloutStep = "Drain"
+)
+
+// CanarySpec is the policy of canary RegionServer rollouts
+type CanarySpec struct {
+	// Count is the number of RegionServers restarted with the new revision first.
+	// +kubebuilder:validation:Minimum=1
+	Count int32 `json:"count"`
+	// SoakDuration is how long the canary RegionServers have to stay healthy
+	// before the rest of RegionServers are restarted.
+	SoakDuration metav1.Duration `json:"soakDuration"`
+	// MaxPodRestarts is the number of container restarts of canary pods
+	// tolerated during the soak.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	MaxPodRestarts int32 `json:"maxPodRestarts,omitempty"`
+	// MaxFailedRequestPercent is the percentage of requests to canary
+	// RegionServers that are allowed to fail during the soak. Failed requests
+	// are exceptions of RPCs reported by the JMX servlet of info servers, except
+	// RegionMovedException and NotServingRegionException that clients retry.
+	// They are checked once a RegionServer served 100 requests. Defaults to 5.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=100
+	MaxFailedRequestPercent *int32 `json:"maxFailedRequestPercent,omitempty"`
+}
+
+// SwitchMode is a mode of an HBase feature that can be switched on and off.
+// +kubebuilder:validation:Enum=Enabled;Disabled;Scheduled
+type SwitchMode string
+
+const (
+	// SwitchEnabled keeps the feature on.
+	SwitchEnabled SwitchMode = "Enabled"
+	// SwitchDisabled keeps the feature off.
+	SwitchDisabled SwitchMode = "Disabled"
+	// SwitchScheduled keeps the feature on only within windows.
+	SwitchScheduled SwitchMode = "Scheduled"
+)
+
+// SwitchSpec is the policy of an HBase feature that can be switched on and off,
+// such as the balancer.
+type SwitchSpec struct {
+	// Mode of the feature.
+	Mode SwitchMode `json:"mode"`
+	// Windows when the feature is on in Scheduled mode.
+	// +kubebuilder:validation:Optional
+	Windows []TimeWindow `json:"windows,omitempty"`
+}
+
+// Weekday is a day of week.
+// +kubebuilder:validation:Enum=Mon;Tue;Wed;Thu;Fri;Sat;Sun
+type Weekday string
+
+// TimeWindow is a recurring window of time. It's either specified as a range of
+// time of day on given days of week, or as a cron schedule of its start with duration.
+type TimeWindow struct {
+	// Days of week the window starts on. Every day if empty.
+	// +kubebuilder:validation:Optional
+	Days []Weekday `json:"days,omitempty"`
+	// Start is the time of day the window starts at in format HH:MM.
+	// +kubebuilder:validation:Pattern=`^([01][0-9]|2[0-3]):[0-5][0-9]$`
+	// +kubebuilder:validation:Optional
+	Start string `json:"start,omitempty"`
+	// End is the time of day the window ends at in format HH:MM. If it's not after
+	// Start, the window ends on the next day.
+	// +kubebuilder:validation:Pattern=`^([01][0-9]|2[0-3]):[0-5][0-9]$`
+	// +kubebuilder:validation:Optional
+	End string `json:"end,omitempty"`
+	// Schedule is a cron expression of the window start in standard
+	// five field format, for example "0 22 * * 1-5". Days, Start and End are
+	// ignored if it's set.
+	// +kubebuilder:validation:Optional
+	Schedule string `json:"schedule,omitempty"`
+	// Duration of the window that starts on Schedule, for example "8h".
+	// +kubebuilder:validation:Optional
+	Duration *metav1.Duration `json:"duration,omitempty"`
+	// TimeZone is a name of the time zone from the IANA Time Zone database,
+	// such as "America/Los_Angeles". Defaults to UTC.
+	// +kubebuilder:validation:Optional
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// DrainSpec configures how regions are moved off a RegionServer
+type DrainSpec struct {
+	// Concurrency is the number of regions moved at the same time. Defaults to 1.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Optional
+	Concurrency int32 `json:"concurrency,omitempty"`
+	// MovesPerSecond limits the rate of region moves. Unlimited if not set.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Optional
+	MovesPerSecond int32 `json:"movesPerSecond,omitempty"`
+	// TargetSelection is the strategy of picking RegionServers to move regions to.
+	// Defaults to RegionCount.
+	// +kubebuilder:validation:Optional
+	TargetSelection TargetSelectionStrategy `json:"targetSelection,omitempty"`
+	// RestoreRegions moves regions back to a RegionServer once it's restarted
+	// in order to keep region placement and data locality stable across rollouts.
+	// +kubebuilder:validation:Optional
+	RestoreRegions bool `json:"restoreRegions,omitempty"`
+	// OnTimeout is what happens to a RegionServer that still carries regions once
+	// its drain exceeds the Drain step deadline. Defaults to Abort.
+	// +kubebuilder:validation:Optional
+	OnTimeout DrainTimeoutAction `json:"onTimeout,omitempty"`
+}
+
+// DrainTimeoutAction is what happens to a RegionServer whose drain timed out.
+// +kubebuilder:validation:Enum=Abort;Force
+type DrainTimeoutAction string
+
+const (
+	// AbortDrainTimeoutAction keeps the RegionServer and retries moving its regions.
+	// The rollout is marked stalled until the drain completes.
+	AbortDrainTimeoutAction DrainTimeoutAction = "Abort"
+	// ForceDrainTimeoutAction restarts the RegionServer with the remaining regions
+	// on it, which HBase reassigns once it's gone.
+	ForceDrainTimeoutAction DrainTimeoutAction = "Force"
+)
+
+// TargetSelectionStrategy is a strategy of picking RegionServers to move regions to.
+// +kubebuilder:validation:Enum=RegionCount;Weighted
+type TargetSelectionStrategy string
+
+const (
+	// RegionCountTargetSelection picks the RegionServer with the least regions.
+	RegionCountTargetSelection TargetSelectionStrategy = "RegionCount"
+	// WeightedTargetSelection picks the RegionServer with the lowest score
+	// that weighs region count, storefile size, request rate and data locality.
+	// Request rates are sampled across reconciles, so they aren't accounted for
+	// right after the operator starts.
+	WeightedTargetSelection TargetSelectionStrategy = "Weighted"
+)
+
 // ConfigMap holds configuration data for HBase
 type ConfigMap struct {
 	// Data where key is name of file, value is data
 	Data map[string]string `json:"data,omitempty"`
+	// Properties are rendered into hbase-site.xml, core-site.xml and hdfs-site.xml.
+	// They replace values of the same properties in files of Data and the rest are
+	// appended. Everything else in the files, such as final, is kept as is.
+	// +kubebuilder:validation:Optional
+	Properties ConfigProperties `json:"properties,omitempty"`
+	// MasterProperties override Properties for masters.
+	// +kubebuilder:validation:Optional
+	MasterProperties ConfigProperties `json:"masterProperties,omitempty"`
+	// RegionServerProperties override Properties for RegionServers.
+	// +kubebuilder:validation:Optional
+	RegionServerProperties ConfigProperties `json:"regionServerProperties,omitempty"`
+	// Revision is the name of a previous config ConfigMap, for example
+	// "config-regionserver-1a2b3c4d", to use for all roles instead of Data.
+	// The ConfigMap has to be kept in the revision history. It's rejected if
+	// configs of masters and RegionServers differ, pin the revision of each
+	// role with Revision of their server config instead.
+	// +kubebuilder:validation:Optional
+	Revision string `json:"revision,omitempty"`
+	// Reload applies changes of reloadable hbase-site.xml properties without
+	// restarting pods. The ConfigMap is updated in place and servers are asked
+	// to reload their configuration. It requires the ConfigMap to be mounted
+	// without subPath, so that the kubelet updates the mounted files. The content
+	// before the update is kept as a ConfigMap of the revision history, which
+	// Revision is able to roll back to. Setting or removing Reload, or changing
+	// ReloadableProperties, restarts all pods once with a rollout, since reloadable
+	// properties are left out of the hash in the ConfigMap name and ConfigMaps
+	// are immutable without Reload.
+	// +kubebuilder:validation:Optional
+	Reload *ConfigReloadSpec `json:"reload,omitempty"`
+	// Sources are files of the config from existing ConfigMaps and Secrets.
+	// Files of ConfigMaps are copied into the config ConfigMap, Data replaces
+	// them. Files of Secrets are mounted along with the config ConfigMap.
+	// Changes of their contents roll out as any change of Data.
+	// +kubebuilder:validation:Optional
+	Sources []ConfigSource `json:"sources,omitempty"`
+	// Template renders files of Data and of Data of servers as Go templates
+	// before they are hashed. Files of Sources aren't rendered. Available variables are .Name and .Namespace of HBase,
+	// .ZooKeeperQuorum and .ZooKeeperRoot the operator connects to,
+	// .ServiceDomain, the domain of the headless service of HBase,
+	// such as "hbase.default.svc.cluster.local", or "hbase.default.svc" if the
+	// cluster domain isn't set, and .ClusterDomain.
+	// +kubebuilder:validation:Optional
+	Template bool `json:"template,omitempty"`
+	// SensitiveProperties are names of properties whose values are masked
+	// in config diffs. Names are matched exactly ignoring case, and lines of
+	// other files that mention them are masked. Values of properties with names
+	// containing "password" or "secret" in any case are always masked.
+	// +kubebuilder:validation:Optional
+	SensitiveProperties []string `json:"sensitiveProperties,omitempty"`
+}
+
+// ConfigSource is a file of the config from a key of a ConfigMap or a Secret.
+// Exactly one of ConfigMapKeyRef and SecretKeyRef has to be set.
+type ConfigSource struct {
+	// File is the name of the file. Defaults to the key.
+	// +kubebuilder:validation:Optional
+	File string `json:"file,omitempty"`
+	// ConfigMapKeyRef selects a key of a ConfigMap in the namespace of HBase.
+	// +kubebuilder:validation:Optional
+	ConfigMapKeyRef *corev1.ConfigMapKeySelector `json:"configMapKeyRef,omitempty"`
+	// SecretKeyRef selects a key of a Secret in the namespace of HBase.
+	// +kubebuilder:validation:Optional
+	SecretKeyRef *corev1.SecretKeySelector `json:"secretKeyRef,omitempty"`
+}
+
+// ConfigProperties are HBase and Hadoop properties per configuration file
+type ConfigProperties struct {
+	// HBaseSite are properties of hbase-site.xml.
+	// +kubebuilder:validation:Optional
+	HBaseSite map[string]string `json:"hbaseSite,omitempty"`
+	// CoreSite are properties of core-site.xml.
+	// +kubebuilder:validation:Optional
+	CoreSite map[string]string `json:"coreSite,omitempty"`
+	// HDFSSite are properties of hdfs-site.xml.
+	// +kubebuilder:validation:Optional
+	HDFSSite map[string]string `json:"hdfsSite,omitempty"`
+}
+
+// ConfigReloadSpec configures dynamic reload of configuration
+type ConfigReloadSpec struct {
+	// ReloadableProperties are hbase-site.xml properties that are updated in
+	// place and reloaded with UpdateConfiguration instead of restarting servers.
+	// Only list properties the HBase version reloads online, which are the ones
+	// read by its ConfigurationObserver implementations, otherwise their changes
+	// don't take effect until servers restart for another reason. Changes of
+	// other properties restart servers.
+	// +kubebuilder:validation:Optional
+	ReloadableProperties []string `json:"reloadableProperties,omitempty"`
+	// PropagationDelay is how long to wait for the kubelet to update the mounted
+	// ConfigMap before servers are asked to reload it. Defaults to 2m.
+	// +kubebuilder:validation:Optional
+	PropagationDelay *metav1.Duration `json:"propagationDelay,omitempty"`
 }
 
 // ServerMetadata allows to specify labels and annotations to resulting statefulsets and pods
@@ -67,6 +525,61 @@ type ServerSpec struct {
 	// Count of replicas to deploy.
 	// +kubebuilder:validation:Optional
 	Count int32 `json:"count,omitempty"`
+	// MaxUnavailable is the maximum number of pods that are drained and restarted
+	// together during a rollout. It's either a count or a percentage of Count,
+	// rounded down and at least 1. Defaults to 1.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:XIntOrString
+	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+	// Config overrides the shared Config for the servers.
+	// +kubebuilder:validation:Optional
+	Config *ServerConfig `json:"config,omitempty"`
+	// Memory sizes the JVM memory of the servers from the memory limit of
+	// the server container.
+	// +kubebuilder:validation:Optional
+	Memory *MemorySpec `json:"memory,omitempty"`
+}
+
+// MemorySpec derives JVM memory settings from the memory limit of the server
+// container. They are appended to hbase-env.sh of the role, so changes of the
+// limit roll out as config changes. Heap and off-heap together can take at most
+// 90% of the limit, the rest is left to the JVM for metaspace, thread stacks
+// and GC.
+type MemorySpec struct {
+	// Container is the name of the server container. Defaults to the first container.
+	// +kubebuilder:validation:Optional
+	Container string `json:"container,omitempty"`
+	// HeapPercent of the memory limit is set as HBASE_HEAPSIZE. Defaults to 50.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=90
+	HeapPercent *int32 `json:"heapPercent,omitempty"`
+	// OffHeapPercent of the memory limit is set as HBASE_OFFHEAPSIZE, the maximum
+	// direct memory including the off-heap bucket cache. It's not set if zero.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=89
+	OffHeapPercent int32 `json:"offHeapPercent,omitempty"`
+	// BucketCachePercent of the memory limit is the size of the off-heap bucket
+	// cache set as hbase.bucketcache.size. It has to be less than OffHeapPercent
+	// to leave direct memory for RPC and HDFS buffers.
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=88
+	BucketCachePercent int32 `json:"bucketCachePercent,omitempty"`
+}
+
+// ServerConfig is configuration of a role merged over the shared configuration.
+// Properties of a role are set with MasterProperties and RegionServerProperties
+// of the shared Config.
+type ServerConfig struct {
+	// Data are files that replace files of the same name in the shared Data.
+	// +kubebuilder:validation:Optional
+	Data map[string]string `json:"data,omitempty"`
+	// Revision is the name of a previous config ConfigMap of the role to use
+	// instead of its config. It overrides the shared Config Revision.
+	// +kubebuilder:validation:Optional
+	Revision string `json:"revision,omitempty"`
 }
 
 // HBasePhase is the phase HBase is in from the controller point of view.
@@ -91,6 +604,8 @@ const (
 	HBaseProgressWaitingRegionTransition HBaseProgress = "WaitingRegionTransition"
 	HBaseProgressWaitingMasters          HBaseProgress = "WaitingMasterPods"
 	HBaseProgressWaitingRS               HBaseProgress = "WaitingRegionServerPods"
+	HBaseProgressWaitingMaintenance      HBaseProgress = "WaitingMaintenanceWindow"
+	HBaseProgressReloadingConfig         HBaseProgress = "ReloadingConfig"
 	HBaseProgressDelUnusedCM             HBaseProgress = "DeletingUnusedConfigMaps"
 	HBaseProgressReady                   HBaseProgress = "Ready"
 )
@@ -105,6 +620,187 @@ type HBaseStatus struct {
 
 	// ReconcileProgress is a reconcilation progress of hbase
 	ReconcileProgress HBaseProgress `json:"reconcileprogress,omitempty"`
+
+	// FailedRegionMoves are encoded names of regions that failed to move
+	// off the drained RegionServers before the drain timed out.
+	FailedRegionMoves []string `json:"failedRegionMoves,omitempty"`
+
+	// DrainedRegionServers are RegionServers that were drained and whose regions
+	// are to be moved back once they are restarted.
+	DrainedRegionServers []DrainedRegionServer `json:"drainedRegionServers,omitempty"`
+
+	// Drain is the RegionServer drain in progress. It allows to resume the
+	// drain after the operator restarts.
+	Drain *DrainStatus `json:"drain,omitempty"`
+
+	// Balancer is the state of the balancer according to its policy.
+	Balancer *SwitchStatus `json:"balancer,omitempty"`
+
+	// Normalizer is the state of the region normalizer according to its policy.
+	Normalizer *SwitchStatus `json:"normalizer,omitempty"`
+
+	// Maintenance is the state of the maintenance windows.
+	Maintenance *MaintenanceStatus `json:"maintenance,omitempty"`
+
+	// Canary is the state of the canary stage of the RegionServer rollout.
+	Canary *CanaryStatus `json:"canary,omitempty"`
+
+	// Conditions are the latest observations of the state of HBase.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// StableRevisions are the last revisions of StatefulSets, keyed by name,
+	// whose pods all became ready.
+	StableRevisions map[string]string `json:"stableRevisions,omitempty"`
+
+	// Rollback is the rollback of the last failed rollout.
+	Rollback *RollbackStatus `json:"rollback,omitempty"`
+
+	// Blocked is the step the rollout is waiting on.
+	Blocked *BlockedStatus `json:"blocked,omitempty"`
+
+	// ConfigUpdates are the last changes of config ConfigMaps and the way they
+	// were applied, one per role.
+	// +listType=map
+	// +listMapKey=role
+	ConfigUpdates []ConfigUpdateStatus `json:"configUpdates,omitempty"`
+}
+
+// ConfigUpdatePath is the way a config change is applied
+type ConfigUpdatePath string
+
+const (
+	// ConfigUpdateRestart applies the change by restarting pods with a new ConfigMap.
+	ConfigUpdateRestart ConfigUpdatePath = "Restart"
+	// ConfigUpdateReload applies the change by updating the ConfigMap in place
+	// and reloading configuration of servers.
+	ConfigUpdateReload ConfigUpdatePath = "Reload"
+)
+
+// ConfigUpdateStatus is a record of a change of the config ConfigMap
+type ConfigUpdateStatus struct {
+	// Role is the role the ConfigMap belongs to.
+	Role string `json:"role"`
+	// ConfigMap is the name of the changed ConfigMap.
+	ConfigMap string `json:"configMap"`
+	// Path is the way the change is applied.
+	Path ConfigUpdatePath `json:"path"`
+	// Properties are names of hbase-site.xml properties changed in place.
+	Properties []string `json:"properties,omitempty"`
+	// Time is the time the ConfigMap was changed.
+	Time metav1.Time `json:"time"`
+	// Reloaded is true once servers reloaded their configuration.
+	Reloaded bool `json:"reloaded,omitempty"`
+	// Previous is the name of the ConfigMap the change is made from. For changes
+	// reloaded in place, it's the ConfigMap that keeps the values before the change.
+	Previous string `json:"previous,omitempty"`
+	// Diff is a summary of the change with values of sensitive properties masked.
+	Diff []string `json:"diff,omitempty"`
+}
+
+const (
+	// ConditionDegraded is true if the rollout is halted because the new revision is unhealthy.
+	ConditionDegraded = "Degraded"
+	// ConditionRolloutFailed is true if the rollout failed and was rolled back.
+	ConditionRolloutFailed = "RolloutFailed"
+	// ConditionStalled is true if a step of the rollout exceeded its progress deadline.
+	ConditionStalled = "Stalled"
+	// ConditionCertificatePending is true while a TLS certificate requested from
+	// an issuer isn't issued yet.
+	ConditionCertificatePending = "CertificatePending"
+)
+
+// BlockedStatus is the step the rollout is waiting on
+type BlockedStatus struct {
+	// Step of the rollout.
+	Step RolloutStep `json:"step"`
+	// Object the step waits for, such as a pod.
+	Object string `json:"object,omitempty"`
+	// Reason the rollout is blocked.
+	Reason string `json:"reason"`
+	// Since is when the rollout started waiting on the step.
+	Since metav1.Time `json:"since"`
+	// Stalled is whether the step exceeded its progress deadline.
+	Stalled bool `json:"stalled,omitempty"`
+}
+
+// RollbackStatus is a record of the rollback of a failed rollout
+type RollbackStatus struct {
+	// Generation of HBase whose rollout failed. The rollback is in effect until the spec changes.
+	Generation int64 `json:"generation"`
+	// StatefulSet whose pods failed to become ready.
+	StatefulSet string `json:"statefulSet"`
+	// FailedRevision is the revision of the StatefulSet that failed.
+	FailedRevision string `json:"failedRevision"`
+	// Reason the rollout failed.
+	Reason string `json:"reason,omitempty"`
+	// Time of the rollback.
+	Time metav1.Time `json:"time"`
+}
+
+// CanaryStatus is the state of the canary stage of the RegionServer rollout
+type CanaryStatus struct {
+	// Revision is the StatefulSet revision being verified.
+	Revision string `json:"revision"`
+	// SoakStartTime is when the canary RegionServers were all up with the revision.
+	SoakStartTime *metav1.Time `json:"soakStartTime,omitempty"`
+	// Passed is whether the canary RegionServers stayed healthy during the soak.
+	Passed bool `json:"passed,omitempty"`
+	// Failure is why the rollout was halted, if it was.
+	Failure string `json:"failure,omitempty"`
+}
+
+// MaintenanceStatus is the state of the maintenance windows
+type MaintenanceStatus struct {
+	// InWindow is whether pods are allowed to be restarted now.
+	InWindow bool `json:"inWindow"`
+	// NextTransitionTime is when the current window ends, or the next one starts.
+	NextTransitionTime *metav1.Time `json:"nextTransitionTime,omitempty"`
+	// ChangesPending is whether there are pods to restart waiting for the next window.
+	ChangesPending bool `json:"changesPending,omitempty"`
+}
+
+// SwitchStatus is the state of an HBase feature that can be switched on and off
+type SwitchStatus struct {
+	// Enabled is whether the feature is on.
+	Enabled bool `json:"enabled"`
+	// NextTransitionTime is when the feature is switched next according to its windows.
+	NextTransitionTime *metav1.Time `json:"nextTransitionTime,omitempty"`
+}
+
+// DrainStatus is a record of the RegionServer drain in progress
+type DrainStatus struct {
+	// RegionServers are RegionServers of the batch being drained together.
+	// It's empty while the rollout waits before the first batch is picked.
+	RegionServers []DrainingRegionServer `json:"regionServers,omitempty"`
+	// BalancerEnabled is the state of the balancer before the rollout started.
+	BalancerEnabled bool `json:"balancerEnabled"`
+	// StartTime is the time the drain of the batch started.
+	StartTime metav1.Time `json:"startTime"`
+}
+
+// DrainingRegionServer is a record of a RegionServer being drained
+type DrainingRegionServer struct {
+	// Pod is the name of the RegionServer pod being drained.
+	Pod string `json:"pod"`
+	// ServerName is the name of the RegionServer being drained
+	// in format <host>,<port>,<startcode>.
+	ServerName string `json:"serverName,omitempty"`
+	// RegionsRemaining are encoded names of regions left to move off the RegionServer.
+	RegionsRemaining []string `json:"regionsRemaining,omitempty"`
+}
+
+// DrainedRegionServer is a record of regions a RegionServer carried before it was drained
+type DrainedRegionServer struct {
+	// Pod is the name of the RegionServer pod.
+	Pod string `json:"pod"`
+	// ServerName is the name of the RegionServer before it was restarted
+	// in format <host>,<port>,<startcode>.
+	ServerName string `json:"serverName"`
+	// Regions are encoded names of regions the RegionServer carried.
+	Regions []string `json:"regions,omitempty"`
 }
 
 //+kubebuilder:object:root=true
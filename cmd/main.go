@@ -17,16 +17,20 @@ package main
 import (
 	"flag"
 	"os"
+	// Embed time zone database for time windows specified in HBase spec
+	_ "time/tzdata"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
@@ -58,6 +62,8 @@ func main() {
 		namespace            string
 		zkQuorum             string
 		zkRoot               string
+		clusterDomain        string
+		hbaseUser            string
 	)
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&pprofAddr, "pprof-addr", ":6060", "The address the pprof endpoint binds to.")
@@ -70,6 +76,10 @@ func main() {
 		"Comma-separated list of zookeeper addresses.")
 	flag.StringVar(&zkRoot, "zkroot", "/hbase",
 		"Zookeeper root znode for hbase.")
+	flag.StringVar(&clusterDomain, "cluster-domain", "cluster.local",
+		"Domain of the Kubernetes cluster, used in config templates.")
+	flag.StringVar(&hbaseUser, "hbase-user", "root",
+		"Effective user of RPCs sent to HBase.")
 
 	opts := zap.Options{
 		Development: true,
@@ -91,6 +101,13 @@ func main() {
 		Cache: cache.Options{
 			DefaultNamespaces: watchNamespaces,
 		},
+		// the controller watches only metadata of ConfigMaps and Secrets, their
+		// contents are read from the API server instead of being cached
+		Client: client.Options{
+			Cache: &client.CacheOptions{
+				DisableFor: []client.Object{&corev1.ConfigMap{}, &corev1.Secret{}},
+			},
+		},
 		Metrics: metricsserver.Options{
 			BindAddress: metricsAddr,
 		},
@@ -115,11 +132,25 @@ func main() {
 		os.Exit(1)
 	}
 
+	// the gohbase client sends RPCs the admin client doesn't provide
+	ghAdmin, ok := gohbase.NewAdminClient(zkQuorum,
+		gohbase.ZookeeperRoot(zkRoot), gohbase.EffectiveUser(hbaseUser)).(controller.AdminClient)
+	if !ok {
+		setupLog.Info("gohbase admin client doesn't support sending RPCs")
+		os.Exit(1)
+	}
+
 	if err = (&controller.HBaseReconciler{
-		Client:  mgr.GetClient(),
-		Scheme:  mgr.GetScheme(),
-		Log:     ctrl.Log.WithName("controllers").WithName("HBase"),
-		GhAdmin: gohbase.NewAdminClient(zkQuorum, gohbase.ZookeeperRoot(zkRoot)),
+		Client:    mgr.GetClient(),
+		Scheme:    mgr.GetScheme(),
+		Recorder:  mgr.GetEventRecorderFor("hbase-controller"),
+		Log:       ctrl.Log.WithName("controllers").WithName("HBase"),
+		GhAdmin:   ghAdmin,
+		HBaseUser: hbaseUser,
+
+		ZkQuorum:      zkQuorum,
+		ZkRoot:        zkRoot,
+		ClusterDomain: clusterDomain,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "HBase")
 		os.Exit(1)
@@ -24,23 +24,47 @@ import (
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/metrics"
 
 	"github.com/go-logr/logr"
 	"github.com/prometheus/client_golang/prometheus"
 	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
 	"github.com/tsuna/gohbase"
+	"github.com/tsuna/gohbase/hrpc"
+	"google.golang.org/protobuf/proto"
 )
 
+// AdminClient is the gohbase admin client along with SendRPC of the gohbase
+// client, which sends master RPCs that the admin client doesn't provide
+type AdminClient interface {
+	gohbase.AdminClient
+	SendRPC(hrpc.Call) (proto.Message, error)
+}
+
 // HBaseReconciler reconciles a HBase object
 type HBaseReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
 
 	Log     logr.Logger
-	GhAdmin gohbase.AdminClient
+	GhAdmin AdminClient
+	// HBaseUser is the effective user of RPCs sent to servers, which has to
+	// be the user of GhAdmin. Defaults to root, the user of gohbase.
+	HBaseUser string
+
+	// ZkQuorum, ZkRoot and ClusterDomain are available to config templates
+	ZkQuorum      string
+	ZkRoot        string
+	ClusterDomain string
+
+	// rates are request rates of regions per cluster
+	rates requestRates
 }
 
 const (
@@ -58,6 +82,34 @@ var (
 		},
 		[]string{"namespace", "name", "phase", "progress"},
 	)
+	hbaseRegionMoveDurationMetric = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:      "region_move_duration_seconds",
+			Help:      "Duration of moving a region off a RegionServer",
+			Namespace: promNamespace,
+			Subsystem: promSubsystem,
+			Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+		},
+		[]string{"namespace", "name"},
+	)
+	hbaseRegionMoveFailuresMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      "region_move_failures_total",
+			Help:      "Number of failed region moves",
+			Namespace: promNamespace,
+			Subsystem: promSubsystem,
+		},
+		[]string{"namespace", "name"},
+	)
+	hbaseRolloutStalledMetric = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      "rollout_stalled_total",
+			Help:      "Number of times a step of the rollout exceeded its progress deadline",
+			Namespace: promNamespace,
+			Subsystem: promSubsystem,
+		},
+		[]string{"namespace", "name", "step"},
+	)
 )
 
 //+kubebuilder:rbac:groups=hbase.elenskiy.co,resources=hbases,verbs=get;list;watch;create;update;patch;delete
@@ -65,8 +117,13 @@ var (
 //+kubebuilder:rbac:groups=hbase.elenskiy.co,resources=hbases/finalizers,verbs=update
 //+kubebuilder:rbac:groups="",resources=configmaps,verbs=*
 //+kubebuilder:rbac:groups="",resources=services,verbs=*
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch
 //+kubebuilder:rbac:groups="apps",resources=statefulsets,verbs=*
+//+kubebuilder:rbac:groups="apps",resources=controllerrevisions,verbs=get;list;watch;create;delete
 //+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;delete
+//+kubebuilder:rbac:groups="",resources=nodes,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups="cert-manager.io",resources=certificates,verbs=get;list;watch;create
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -87,6 +144,7 @@ func (r *HBaseReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 	if err != nil {
 		if errors.IsNotFound(err) {
 			r.Log.Error(err, "HBase CRD is not found")
+			r.rates.forget(req.NamespacedName)
 			return ctrl.Result{}, nil
 		}
 		r.Log.Error(err, "Failed getting HBase CRD")
@@ -101,6 +159,13 @@ func (r *HBaseReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 	// Update the state when this function exits
 	defer r.updateStatus(ctx, app)
 
+	clearRollback(app)
+
+	if err := validateSecurity(app); err != nil {
+		app.Status.Phase = hbasev1.HBaseResourceInvalidPhase
+		return ctrl.Result{}, err
+	}
+
 	serviceOk, err := r.ensureService(app)
 	if err != nil {
 		app.Status.Phase = hbasev1.HBaseResourceInvalidPhase
@@ -114,13 +179,63 @@ func (r *HBaseReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 	}
 	log.Info("HBase headless service is in sync")
 
-	// deploy configmap if it doesn't exist
-	configMapName := getConfigMapName(app)
-	cmOk, err := r.ensureConfigMap(app, configMapName)
+	masterName := types.NamespacedName{Name: masterRole, Namespace: app.Namespace}
+	rsName := types.NamespacedName{Name: regionServerRole, Namespace: app.Namespace}
+
+	// deploy configmaps of roles if they don't exist
+	sharedConfig, secrets, err := r.sharedConfigData(ctx, app)
+	if err != nil {
+		app.Status.Phase = hbasev1.HBaseResourceInvalidPhase
+		return ctrl.Result{}, err
+	}
+	masterConfig, err := r.roleConfigData(app, masterName.Name, sharedConfig, app.Spec.MasterSpec,
+		app.Spec.Config.MasterProperties)
+	if err != nil {
+		app.Status.Phase = hbasev1.HBaseResourceInvalidPhase
+		return ctrl.Result{}, err
+	}
+	rsConfig, err := r.roleConfigData(app, rsName.Name, sharedConfig, app.Spec.RegionServerSpec,
+		app.Spec.Config.RegionServerProperties)
+	if err != nil {
+		app.Status.Phase = hbasev1.HBaseResourceInvalidPhase
+		return ctrl.Result{}, err
+	}
+	if err := validateConfigRevision(app, masterConfig, rsConfig); err != nil {
+		app.Status.Phase = hbasev1.HBaseResourceInvalidPhase
+		return ctrl.Result{}, err
+	}
+	masterSecrets, issued, err := r.roleSecretDigests(ctx, app, masterName.Name, secrets)
 	if err != nil {
 		app.Status.Phase = hbasev1.HBaseResourceInvalidPhase
 		return ctrl.Result{}, err
 	}
+	var rsSecrets map[string]string
+	if issued {
+		if rsSecrets, issued, err = r.roleSecretDigests(ctx, app, rsName.Name, secrets); err != nil {
+			app.Status.Phase = hbasev1.HBaseResourceInvalidPhase
+			return ctrl.Result{}, err
+		}
+	}
+	if !issued {
+		log.Info("TLS certificate isn't issued yet, wait and restart reconciling")
+		app.Status.Phase = hbasev1.HBaseApplyingChangesPhase
+		app.Status.ReconcileProgress = hbasev1.HBaseProgressUpdatingCM
+		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+	}
+	clearCertificatePending(app)
+	masterConfigMapName := getConfigMapName(app, masterName.Name, masterConfig, masterSecrets)
+	rsConfigMapName := getConfigMapName(app, rsName.Name, rsConfig, rsSecrets)
+	cmOk, err := r.ensureConfigMap(app, masterConfigMapName, masterName.Name, masterConfig)
+	if err != nil {
+		app.Status.Phase = hbasev1.HBaseResourceInvalidPhase
+		return ctrl.Result{}, err
+	}
+	if cmOk {
+		if cmOk, err = r.ensureConfigMap(app, rsConfigMapName, rsName.Name, rsConfig); err != nil {
+			app.Status.Phase = hbasev1.HBaseResourceInvalidPhase
+			return ctrl.Result{}, err
+		}
+	}
 	if !cmOk {
 		log.Info("HBase ConfigMap reconfigured, reconciling again")
 		app.Status.Phase = hbasev1.HBaseApplyingChangesPhase
@@ -130,8 +245,7 @@ func (r *HBaseReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 	log.Info("HBase ConfigMap is in sync")
 
 	// update hbasemaster statefulset
-	masterName := types.NamespacedName{Name: "hbasemaster", Namespace: app.Namespace}
-	masterSts, masterUpdated, err := r.ensureStatefulSet(app, masterName, configMapName, app.Spec.MasterSpec)
+	masterSts, masterUpdated, err := r.ensureStatefulSet(app, masterName, masterConfigMapName, app.Spec.MasterSpec)
 	if err != nil {
 		r.Log.Error(err, "Failed reconciling HBase Master StatefulSet")
 		app.Status.Phase = hbasev1.HBaseResourceInvalidPhase
@@ -146,8 +260,7 @@ func (r *HBaseReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 	log.Info("HBase Master StatefulSet is in sync")
 
 	// update regionserver statefulset
-	rsName := types.NamespacedName{Name: "regionserver", Namespace: app.Namespace}
-	rsSts, rsUpdated, err := r.ensureStatefulSet(app, rsName, configMapName, app.Spec.RegionServerSpec)
+	rsSts, rsUpdated, err := r.ensureStatefulSet(app, rsName, rsConfigMapName, app.Spec.RegionServerSpec)
 	if err != nil {
 		r.Log.Error(err, "Failed reconciling HBase RegionServer StatefulSet")
 		app.Status.Phase = hbasev1.HBaseResourceInvalidPhase
@@ -161,24 +274,45 @@ func (r *HBaseReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 	}
 	log.Info("RegionServer StatefulSet is in sync")
 
-	// make sure there are no regions in transition.
-	// we want this to happen after we've deployed all manifests in order to
-	// be able to fix incorrect config and not fight with operator
-	rit, err := r.regionsInTransition()
-	if err != nil {
-		app.Status.Phase = hbasev1.HBaseResourceInvalidPhase
-		return ctrl.Result{}, fmt.Errorf("failed to get regions in transition: %v", err)
+	pickMaster := r.pickMasterToDelete
+	pickRegionServer := r.withCanary(r.inMaintenanceWindow(r.pickRegionServerToDelete))
+	if reason := unsupportedRPCReason(app); reason != "" {
+		// pods are restarted one at a time once all are ready
+		log.Info("Can't call RPCs of servers, restarting them without draining", "reason", reason)
+		pickMaster = pickWithoutDrain
+		pickRegionServer = r.inMaintenanceWindow(pickWithoutDrain)
+	} else {
+		if err := r.ensureSwitches(ctx, app); err != nil {
+			app.Status.Phase = hbasev1.HBaseResourceInvalidPhase
+			return ctrl.Result{}, err
+		}
+
+		// make sure there are no regions in transition.
+		// we want this to happen after we've deployed all manifests in order to
+		// be able to fix incorrect config and not fight with operator
+		rit, err := r.regionsInTransition()
+		if err != nil {
+			app.Status.Phase = hbasev1.HBaseResourceInvalidPhase
+			return ctrl.Result{}, fmt.Errorf("failed to get regions in transition: %v", err)
+		}
+		if rit != 0 {
+			log.Info("There are regions in transition, wait and restart reconciling", "regions", rit)
+			r.canaryRegionsInTransition(app, rit)
+			r.blocked(app, hbasev1.StepRegionsInTransition, "", fmt.Sprintf("%d regions are in transition", rit))
+			app.Status.Phase = hbasev1.HBaseApplyingChangesPhase
+			app.Status.ReconcileProgress = hbasev1.HBaseProgressWaitingRegionTransition
+			return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+		}
+		log.Info("There are no regions in transition")
+		r.unblocked(app, hbasev1.StepRegionsInTransition)
 	}
-	if rit != 0 {
-		log.Info("There are regions in transition, wait and restart reconciling", "regions", rit)
-		app.Status.Phase = hbasev1.HBaseApplyingChangesPhase
-		app.Status.ReconcileProgress = hbasev1.HBaseProgressWaitingRegionTransition
-		return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+
+	if app.Status.Maintenance != nil {
+		app.Status.Maintenance.ChangesPending = false
 	}
-	log.Info("There are no regions in transition")
 
 	r.Log.Info("Reconciling Master pods")
-	mastersOk, err := r.ensureStatefulSetPods(ctx, masterSts, r.pickMasterToDelete)
+	mastersOk, err := r.ensureStatefulSetPods(ctx, app, masterSts, r.inMaintenanceWindow(pickMaster))
 	if err != nil {
 		r.Log.Error(err, "Failed reconciling HBase Master pods")
 		app.Status.Phase = hbasev1.HBaseResourceInvalidPhase
@@ -187,11 +321,11 @@ func (r *HBaseReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 	if !mastersOk {
 		app.Status.Phase = hbasev1.HBaseApplyingChangesPhase
 		app.Status.ReconcileProgress = hbasev1.HBaseProgressWaitingMasters
-		return ctrl.Result{RequeueAfter: 15 * time.Second}, nil
+		return maintenanceResult(app), nil
 	}
 
 	r.Log.Info("Reconciling RegionServer Pods")
-	rsOk, err := r.ensureStatefulSetPods(ctx, rsSts, r.pickRegionServerToDelete)
+	rsOk, err := r.ensureStatefulSetPods(ctx, app, rsSts, pickRegionServer)
 	if err != nil {
 		r.Log.Error(err, "Failed reconciling HBase RegionServer pods")
 		app.Status.Phase = hbasev1.HBaseResourceInvalidPhase
@@ -200,19 +334,36 @@ func (r *HBaseReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl
 	if !rsOk {
 		app.Status.Phase = hbasev1.HBaseApplyingChangesPhase
 		app.Status.ReconcileProgress = hbasev1.HBaseProgressWaitingRS
+		return maintenanceResult(app), nil
+	}
+
+	reloaded, err := r.reloadConfig(ctx, app)
+	if err != nil {
+		r.Log.Error(err, "Failed reloading configuration")
+		return ctrl.Result{}, err
+	}
+	if !reloaded {
+		app.Status.Phase = hbasev1.HBaseApplyingChangesPhase
+		app.Status.ReconcileProgress = hbasev1.HBaseProgressReloadingConfig
 		return ctrl.Result{RequeueAfter: 15 * time.Second}, nil
 	}
 
 	r.Log.Info("Deleting unused config maps")
 	app.Status.ReconcileProgress = hbasev1.HBaseProgressDelUnusedCM
-	if err := r.deleteUnusedConfigMaps(ctx, app, configMapName); err != nil {
+	if err := r.deleteUnusedConfigMaps(ctx, app, masterConfigMapName, rsConfigMapName); err != nil {
 		app.Status.Phase = hbasev1.HBaseResourceInvalidPhase
 		return ctrl.Result{}, err
 	}
 
 	r.Log.Info("Everything is up to date!")
+	r.progressed(app)
 	app.Status.Phase = hbasev1.HBaseReadyPhase
 	app.Status.ReconcileProgress = hbasev1.HBaseProgressReady
+
+	// reconcile again to switch balancer or normalizer at the edge of their windows
+	if next := nextSwitchTransition(app, time.Now()); !next.IsZero() {
+		return ctrl.Result{RequeueAfter: time.Until(next)}, nil
+	}
 	return ctrl.Result{}, nil
 }
 
@@ -221,11 +372,23 @@ func (r *HBaseReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&hbasev1.HBase{}).
 		Owns(&corev1.Service{}).
-		Owns(&corev1.ConfigMap{}).
+		// only metadata of ConfigMaps and Secrets is cached, so that contents of
+		// ones that aren't related to HBase aren't kept in memory
+		Owns(&corev1.ConfigMap{}, builder.OnlyMetadata).
 		Owns(&appsv1.StatefulSet{}).
+		// config sources, keytabs and certificates
+		Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.hbasesForConfigMap),
+			builder.OnlyMetadata).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.hbasesForSecret),
+			builder.OnlyMetadata).
 		Complete(r)
 }
 
 func init() {
-	metrics.Registry.MustRegister(hbaseReconciliationPhaseMetric)
+	metrics.Registry.MustRegister(
+		hbaseReconciliationPhaseMetric,
+		hbaseRegionMoveDurationMetric,
+		hbaseRegionMoveFailuresMetric,
+		hbaseRolloutStalledMetric,
+	)
 }
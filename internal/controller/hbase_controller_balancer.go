@@ -0,0 +1,122 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	"github.com/tsuna/gohbase/hrpc"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// desiredSwitchState returns the state according to the policy at time t and
+// the time it changes next, if it's scheduled. It returns false for ok if there
+// is no policy.
+func desiredSwitchState(spec *hbasev1.SwitchSpec, t time.Time) (enabled, ok bool, next time.Time, err error) {
+	if spec == nil {
+		return false, false, time.Time{}, nil
+	}
+	switch spec.Mode {
+	case hbasev1.SwitchEnabled:
+		return true, true, time.Time{}, nil
+	case hbasev1.SwitchDisabled:
+		return false, true, time.Time{}, nil
+	case hbasev1.SwitchScheduled:
+		enabled, next, err := inWindows(spec.Windows, t)
+		if err != nil {
+			return false, false, time.Time{}, fmt.Errorf("invalid windows: %w", err)
+		}
+		return enabled, true, next, nil
+	default:
+		return false, false, time.Time{}, fmt.Errorf("unknown mode %q", spec.Mode)
+	}
+}
+
+// switchStatus returns the status of the feature that is set to enabled
+// and changes next at time next
+func switchStatus(enabled bool, next time.Time) *hbasev1.SwitchStatus {
+	st := &hbasev1.SwitchStatus{Enabled: enabled}
+	if !next.IsZero() {
+		st.NextTransitionTime = &metav1.Time{Time: next}
+	}
+	return st
+}
+
+// nextSwitchTransition returns the earliest time the balancer or the normalizer
+// is switched according to their policies. It's zero if neither is scheduled.
+func nextSwitchTransition(hb *hbasev1.HBase, t time.Time) time.Time {
+	var result time.Time
+	for _, spec := range []*hbasev1.SwitchSpec{hb.Spec.Balancer, hb.Spec.Normalizer} {
+		_, _, next, err := desiredSwitchState(spec, t)
+		if err != nil || next.IsZero() {
+			continue
+		}
+		if result.IsZero() || next.Before(result) {
+			result = next
+		}
+	}
+	return result
+}
+
+// ensureSwitches sets the balancer and the normalizer according to their policies
+// on every reconcile, so that their windows open and close while a rollout waits
+// as well. The balancer is left off while RegionServers are drained.
+func (r *HBaseReconciler) ensureSwitches(ctx context.Context, hb *hbasev1.HBase) error {
+	if hb.Status.Drain == nil {
+		if err := r.ensureBalancer(ctx, hb); err != nil {
+			return fmt.Errorf("failed to set balancer: %w", err)
+		}
+	}
+	if err := r.ensureNormalizer(ctx, hb); err != nil {
+		return fmt.Errorf("failed to set normalizer: %w", err)
+	}
+	return nil
+}
+
+// ensureBalancer sets the balancer according to the balancer policy once RegionServers
+// are up-to-date. Without the policy, the balancer state from before the rollout is
+// restored, if there was a rollout.
+func (r *HBaseReconciler) ensureBalancer(ctx context.Context, hb *hbasev1.HBase) error {
+	enabled, ok, next, err := desiredSwitchState(hb.Spec.Balancer, time.Now())
+	if err != nil {
+		return fmt.Errorf("invalid balancer policy: %w", err)
+	}
+	if !ok {
+		hb.Status.Balancer = nil
+		if hb.Status.Drain == nil {
+			// respect whatever state the balancer was put in
+			return nil
+		}
+		enabled = hb.Status.Drain.BalancerEnabled
+	}
+	sb, err := hrpc.NewSetBalancer(ctx, enabled)
+	if err != nil {
+		return err
+	}
+	prev, err := r.GhAdmin.SetBalancer(sb)
+	if err != nil {
+		return err
+	}
+	if prev != enabled {
+		r.Log.Info("switched balancer", "enabled", enabled)
+	}
+	if ok {
+		hb.Status.Balancer = switchStatus(enabled, next)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	"github.com/tsuna/gohbase/hrpc"
+	"github.com/tsuna/gohbase/pb"
+	"github.com/tsuna/gohbase/test/mock"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/protobuf/proto"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEnsureBalancer(t *testing.T) {
+	tests := []struct {
+		name   string
+		spec   *hbasev1.SwitchSpec
+		drain  *hbasev1.DrainStatus
+		expect []bool
+	}{
+		{
+			name: "no policy and no rollout",
+		},
+		{
+			name:   "no policy restores state from before rollout",
+			drain:  &hbasev1.DrainStatus{BalancerEnabled: false},
+			expect: []bool{false},
+		},
+		{
+			name:   "enabled",
+			spec:   &hbasev1.SwitchSpec{Mode: hbasev1.SwitchEnabled},
+			drain:  &hbasev1.DrainStatus{BalancerEnabled: false},
+			expect: []bool{true},
+		},
+		{
+			name:   "disabled",
+			spec:   &hbasev1.SwitchSpec{Mode: hbasev1.SwitchDisabled},
+			expect: []bool{false},
+		},
+		{
+			name:   "scheduled without windows",
+			spec:   &hbasev1.SwitchSpec{Mode: hbasev1.SwitchScheduled},
+			expect: []bool{false},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ghAdmin := mock.NewMockAdminClient(gomock.NewController(t))
+			var got []bool
+			ghAdmin.EXPECT().SetBalancer(gomock.Any()).AnyTimes().DoAndReturn(
+				func(sb *hrpc.SetBalancer) (bool, error) {
+					got = append(got, sb.ToProto().(*pb.SetBalancerRunningRequest).GetOn())
+					return true, nil
+				})
+			r := &HBaseReconciler{Log: logr.Discard(), GhAdmin: &sendRPCAdminClient{MockAdminClient: ghAdmin}}
+			hb := &hbasev1.HBase{
+				Spec:   hbasev1.HBaseSpec{Balancer: test.spec},
+				Status: hbasev1.HBaseStatus{Drain: test.drain},
+			}
+			if err := r.ensureBalancer(context.Background(), hb); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(test.expect) || (len(got) > 0 && got[0] != test.expect[0]) {
+				t.Errorf("expected balancer to be set to %v, got %v", test.expect, got)
+			}
+		})
+	}
+}
+
+// sendRPCAdminClient is the mock admin client that sends RPCs with sendRPC
+type sendRPCAdminClient struct {
+	*mock.MockAdminClient
+	sendRPC func(hrpc.Call) (proto.Message, error)
+}
+
+func (c *sendRPCAdminClient) SendRPC(call hrpc.Call) (proto.Message, error) {
+	if c.sendRPC == nil {
+		return nil, fmt.Errorf("unexpected RPC %s", call.Name())
+	}
+	return c.sendRPC(call)
+}
+
+func TestEnsureNormalizer(t *testing.T) {
+	var got []bool
+	ghAdmin := &sendRPCAdminClient{
+		MockAdminClient: mock.NewMockAdminClient(gomock.NewController(t)),
+		sendRPC: func(call hrpc.Call) (proto.Message, error) {
+			if call.Name() != "SetNormalizerRunning" {
+				t.Fatalf("unexpected call %q", call.Name())
+			}
+			if _, ok := call.NewResponse().(*pb.SetNormalizerRunningResponse); !ok {
+				t.Fatalf("unexpected response type %T", call.NewResponse())
+			}
+			got = append(got, call.ToProto().(*pb.SetNormalizerRunningRequest).GetOn())
+			return &pb.SetNormalizerRunningResponse{PrevNormalizerValue: proto.Bool(true)}, nil
+		},
+	}
+	r := &HBaseReconciler{Log: logr.Discard(), GhAdmin: ghAdmin}
+
+	hb := &hbasev1.HBase{}
+	if err := r.ensureNormalizer(context.Background(), hb); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 || hb.Status.Normalizer != nil {
+		t.Errorf("expected normalizer to be left as is, got %v", got)
+	}
+
+	hb.Spec.Normalizer = &hbasev1.SwitchSpec{Mode: hbasev1.SwitchDisabled}
+	if err := r.ensureNormalizer(context.Background(), hb); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] {
+		t.Errorf("expected normalizer to be switched off, got %v", got)
+	}
+	if hb.Status.Normalizer == nil || hb.Status.Normalizer.Enabled {
+		t.Errorf("expected disabled normalizer status, got %v", hb.Status.Normalizer)
+	}
+
+	ghAdmin.sendRPC = func(hrpc.Call) (proto.Message, error) {
+		return nil, fmt.Errorf("master is not running")
+	}
+	hb.Spec.Normalizer.Mode = hbasev1.SwitchEnabled
+	if err := r.ensureNormalizer(context.Background(), hb); err == nil {
+		t.Error("expected error of the RPC")
+	}
+	if hb.Status.Normalizer.Enabled {
+		t.Error("expected normalizer status to be kept on error")
+	}
+}
+
+func TestEnsureSwitchesDuringBlockedRollout(t *testing.T) {
+	ghAdmin := mock.NewMockAdminClient(gomock.NewController(t))
+	var balancer []bool
+	ghAdmin.EXPECT().SetBalancer(gomock.Any()).AnyTimes().DoAndReturn(
+		func(sb *hrpc.SetBalancer) (bool, error) {
+			balancer = append(balancer, sb.ToProto().(*pb.SetBalancerRunningRequest).GetOn())
+			return false, nil
+		})
+	var normalizer []bool
+	r := &HBaseReconciler{Log: logr.Discard(), GhAdmin: &sendRPCAdminClient{
+		MockAdminClient: ghAdmin,
+		sendRPC: func(call hrpc.Call) (proto.Message, error) {
+			normalizer = append(normalizer, call.ToProto().(*pb.SetNormalizerRunningRequest).GetOn())
+			return &pb.SetNormalizerRunningResponse{}, nil
+		},
+	}}
+
+	// pods wait for a maintenance window that never comes
+	always := hbasev1.TimeWindow{Start: "00:00", End: "00:00"}
+	never := hbasev1.TimeWindow{Schedule: "0 0 31 2 *", Duration: &metav1.Duration{Duration: time.Hour}}
+	hb := &hbasev1.HBase{
+		Spec: hbasev1.HBaseSpec{
+			MaintenanceWindows: []hbasev1.TimeWindow{never},
+			Balancer:           &hbasev1.SwitchSpec{Mode: hbasev1.SwitchScheduled, Windows: []hbasev1.TimeWindow{always}},
+			Normalizer:         &hbasev1.SwitchSpec{Mode: hbasev1.SwitchScheduled, Windows: []hbasev1.TimeWindow{always}},
+		},
+		Status: hbasev1.HBaseStatus{Maintenance: &hbasev1.MaintenanceStatus{ChangesPending: true}},
+	}
+	if err := r.ensureSwitches(context.Background(), hb); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(balancer, []bool{true}) || !slices.Equal(normalizer, []bool{true}) {
+		t.Fatalf("expected balancer and normalizer to be on within their windows, got %v, %v", balancer, normalizer)
+	}
+
+	// windows close while the rollout is still blocked
+	hb.Spec.Balancer.Windows = []hbasev1.TimeWindow{never}
+	hb.Spec.Normalizer.Windows = []hbasev1.TimeWindow{never}
+	if err := r.ensureSwitches(context.Background(), hb); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(balancer, []bool{true, false}) || !slices.Equal(normalizer, []bool{true, false}) {
+		t.Fatalf("expected balancer and normalizer to be switched off, got %v, %v", balancer, normalizer)
+	}
+	if hb.Status.Balancer == nil || hb.Status.Balancer.Enabled {
+		t.Errorf("unexpected balancer status: %+v", hb.Status.Balancer)
+	}
+
+	// the balancer is kept off while RegionServers are drained
+	hb.Spec.Balancer.Windows = []hbasev1.TimeWindow{always}
+	hb.Status.Drain = &hbasev1.DrainStatus{BalancerEnabled: true}
+	if err := r.ensureSwitches(context.Background(), hb); err != nil {
+		t.Fatal(err)
+	}
+	if len(balancer) != 2 {
+		t.Errorf("expected balancer to be left off during drain, got %v", balancer)
+	}
+
+	// the blocked rollout reconciles again when the next window opens
+	start := time.Now().UTC().Add(30 * time.Minute)
+	hb.Spec.Normalizer.Windows = []hbasev1.TimeWindow{{
+		Start: start.Format("15:04"),
+		End:   start.Add(time.Hour).Format("15:04"),
+	}}
+	if res := maintenanceResult(hb); res.RequeueAfter <= 0 || res.RequeueAfter > 30*time.Minute {
+		t.Errorf("expected reconcile at the start of the normalizer window, got %v", res.RequeueAfter)
+	}
+}
@@ -0,0 +1,312 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	"github.com/tsuna/gohbase/pb"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// canaryHealth returns why the canary pods are unhealthy according to the
+// cluster status, or empty string if they are healthy. The canary RegionServers
+// are verified to be live and not to fail to open or close regions.
+// ClusterStatus doesn't report request errors of RegionServers, they are
+// checked by canaryFailedRequests.
+func canaryHealth(spec *hbasev1.CanarySpec, cs *pb.ClusterStatus, canaries []*corev1.Pod) string {
+	for _, p := range canaries {
+		var restarts int32
+		for _, s := range p.Status.ContainerStatuses {
+			restarts += s.RestartCount
+		}
+		if restarts > spec.MaxPodRestarts {
+			return fmt.Sprintf("pod %s restarted %d times", p.Name, restarts)
+		}
+
+		live := false
+		for _, s := range cs.GetLiveServers() {
+			if isPodServer(p, serverName(s.GetServer())) {
+				live = true
+				break
+			}
+		}
+		if !live {
+			return fmt.Sprintf("RegionServer of pod %s is not live", p.Name)
+		}
+		for _, s := range cs.GetDeadServers() {
+			if sn := serverName(s); isPodServer(p, sn) {
+				return fmt.Sprintf("RegionServer %s of pod %s is dead", sn, p.Name)
+			}
+		}
+	}
+	for _, rit := range cs.GetRegionsInTransition() {
+		switch st := rit.GetRegionState().GetState(); st {
+		case pb.RegionState_FAILED_OPEN, pb.RegionState_FAILED_CLOSE:
+			return fmt.Sprintf("region %q is in state %s", rit.GetSpec().GetValue(), st)
+		}
+	}
+	return ""
+}
+
+const (
+	// defaultCanaryMaxFailedRequestPercent is the percentage of failed requests
+	// the canary RegionServers tolerate if the spec doesn't set it
+	defaultCanaryMaxFailedRequestPercent = 5
+	// minCanaryRequests is the number of requests a canary RegionServer has to
+	// serve before its failed requests are taken into account
+	minCanaryRequests = 100
+	// regionServerMetricsQuery selects JMX beans of RegionServer metrics
+	regionServerMetricsQuery = "Hadoop:service=HBase,name=RegionServer,*"
+)
+
+// expectedExceptions are exceptions of RegionServer RPCs that clients retry
+// while regions move, so they don't count as failed requests
+var expectedExceptions = []string{
+	"exceptions.RegionMovedException",
+	"exceptions.NotServingRegionException",
+}
+
+// serverMetrics are counters of requests of a RegionServer since it started
+type serverMetrics struct {
+	requests uint64
+	failed   uint64
+}
+
+// fetchServerMetrics gets counters of requests of a RegionServer from the JMX
+// servlet of its info server. Requests are totalRequestCount of the Server
+// bean, failed requests are exceptions of the IPC bean except expected ones.
+var fetchServerMetrics = func(ctx context.Context, client *http.Client, url string) (serverMetrics, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return serverMetrics{}, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return serverMetrics{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return serverMetrics{}, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var jmx struct {
+		Beans []map[string]interface{} `json:"beans"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jmx); err != nil {
+		return serverMetrics{}, err
+	}
+	count := func(bean map[string]interface{}, key string) uint64 {
+		v, _ := bean[key].(float64)
+		return uint64(v)
+	}
+	var m serverMetrics
+	for _, bean := range jmx.Beans {
+		name, _ := bean["name"].(string)
+		switch {
+		case strings.HasSuffix(name, ",sub=Server"):
+			m.requests = count(bean, "totalRequestCount")
+		case strings.HasSuffix(name, ",sub=IPC"):
+			failed := count(bean, "exceptions")
+			for _, e := range expectedExceptions {
+				failed -= min(count(bean, e), failed)
+			}
+			m.failed = failed
+		}
+	}
+	return m, nil
+}
+
+// infoServerClient returns the HTTP client and scheme of info servers of
+// RegionServers. With TLS, info servers serve HTTPS with the certificate of
+// RegionServers, which is verified with its CA.
+func (r *HBaseReconciler) infoServerClient(ctx context.Context, hb *hbasev1.HBase) (*http.Client, string, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	if tlsSpec(hb) == nil {
+		return client, "http", nil
+	}
+	secret := &corev1.Secret{}
+	name := types.NamespacedName{Name: tlsSecretName(hb, regionServerRole), Namespace: hb.Namespace}
+	if err := r.Get(ctx, name, secret); err != nil {
+		return nil, "", err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(secret.Data["ca.crt"]) {
+		return nil, "", fmt.Errorf("no CA certificate in Secret %s", name.Name)
+	}
+	client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	return client, "https", nil
+}
+
+// canaryFailedRequests returns why the canary RegionServers fail too many
+// requests, or empty string if they don't. Counters accumulate since
+// RegionServers started, which is the start of the canary.
+func (r *HBaseReconciler) canaryFailedRequests(ctx context.Context, hb *hbasev1.HBase,
+	cs *pb.ClusterStatus, canaries []*corev1.Pod) (string, error) {
+	maxPercent := uint64(defaultCanaryMaxFailedRequestPercent)
+	if p := hb.Spec.Canary.MaxFailedRequestPercent; p != nil {
+		maxPercent = uint64(*p)
+	}
+	client, scheme, err := r.infoServerClient(ctx, hb)
+	if err != nil {
+		return "", fmt.Errorf("failed to get client of info servers: %w", err)
+	}
+	for _, p := range canaries {
+		for _, s := range cs.GetLiveServers() {
+			port := s.GetServerLoad().GetInfoServerPort()
+			if !isPodServer(p, serverName(s.GetServer())) || port == 0 {
+				continue
+			}
+			addr := net.JoinHostPort(s.GetServer().GetHostName(), strconv.Itoa(int(port)))
+			u := fmt.Sprintf("%s://%s/jmx?qry=%s", scheme, addr, url.QueryEscape(regionServerMetricsQuery))
+			m, err := fetchServerMetrics(ctx, client, u)
+			if err != nil {
+				return "", fmt.Errorf("failed to get metrics of RegionServer of pod %s: %w", p.Name, err)
+			}
+			if m.requests >= minCanaryRequests && m.failed*100 > maxPercent*m.requests {
+				return fmt.Sprintf("%d of %d requests to RegionServer of pod %s failed",
+					m.failed, m.requests, p.Name), nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// failCanary halts the rollout and marks HBase degraded
+func (r *HBaseReconciler) failCanary(hb *hbasev1.HBase, reason string) {
+	r.Log.Info("canary failed, halting rollout", "revision", hb.Status.Canary.Revision, "reason", reason)
+	hb.Status.Canary.Failure = reason
+	meta.SetStatusCondition(&hb.Status.Conditions, metav1.Condition{
+		Type:    hbasev1.ConditionDegraded,
+		Status:  metav1.ConditionTrue,
+		Reason:  "CanaryFailed",
+		Message: fmt.Sprintf("revision %s: %s", hb.Status.Canary.Revision, reason),
+	})
+	r.Recorder.Eventf(hb, corev1.EventTypeWarning, "CanaryFailed",
+		"Halted rollout of revision %s: %s", hb.Status.Canary.Revision, reason)
+}
+
+// canaryRegionsInTransition halts the rollout if regions stay in transition
+// past the canary soak
+func (r *HBaseReconciler) canaryRegionsInTransition(hb *hbasev1.HBase, rit int) {
+	c := hb.Status.Canary
+	if hb.Spec.Canary == nil || c == nil || c.SoakStartTime == nil || c.Passed || c.Failure != "" {
+		return
+	}
+	if time.Since(c.SoakStartTime.Time) > hb.Spec.Canary.SoakDuration.Duration {
+		r.failCanary(hb, fmt.Sprintf("%d regions are in transition after soak", rit))
+	}
+}
+
+// canaryLimit returns the number of RegionServers that are allowed to be restarted
+// next without exceeding the canary count, until the canary passes
+func canaryLimit(hb *hbasev1.HBase, utd []*corev1.Pod) int {
+	spec, c := hb.Spec.Canary, hb.Status.Canary
+	if spec == nil {
+		return math.MaxInt
+	}
+	if len(utd) > 0 && c != nil && c.Passed && c.Revision == utd[0].Labels[appsv1.StatefulSetRevisionLabel] {
+		return math.MaxInt
+	}
+	return max(int(spec.Count)-len(utd), 1)
+}
+
+// withCanary wraps pick so that only the canary RegionServers are restarted with
+// the new revision until they stay healthy for the soak duration. While soaking,
+// pick isn't called, so that the balancer stays off and drain records are kept
+// for the rest of the rollout. Once the canary fails, pick is given no pods to
+// delete, so that it's able to clean up after the halted rollout.
+func (r *HBaseReconciler) withCanary(pick pickPodToDeleteFunc) pickPodToDeleteFunc {
+	return func(ctx context.Context, hb *hbasev1.HBase,
+		td, utd []*corev1.Pod) ([]*corev1.Pod, bool, error) {
+		spec := hb.Spec.Canary
+		if spec == nil || len(td) == 0 {
+			hb.Status.Canary = nil
+			return pick(ctx, hb, td, utd)
+		}
+		if len(utd) == 0 {
+			// rollout hasn't started yet
+			return pick(ctx, hb, td, utd)
+		}
+
+		rev := utd[0].Labels[appsv1.StatefulSetRevisionLabel]
+		if hb.Status.Canary == nil || hb.Status.Canary.Revision != rev {
+			hb.Status.Canary = &hbasev1.CanaryStatus{Revision: rev}
+			meta.RemoveStatusCondition(&hb.Status.Conditions, hbasev1.ConditionDegraded)
+		}
+		c := hb.Status.Canary
+		if c.Passed || len(utd) < int(spec.Count) {
+			return pick(ctx, hb, td, utd)
+		}
+		if c.Failure != "" {
+			r.Log.Info("rollout is halted by failed canary", "revision", rev, "reason", c.Failure)
+			return r.settle(ctx, hb, pick, utd)
+		}
+
+		if c.SoakStartTime == nil {
+			c.SoakStartTime = &metav1.Time{Time: time.Now()}
+		}
+		cs, err := r.GhAdmin.ClusterStatus()
+		if err != nil {
+			return nil, false, err
+		}
+		reason := canaryHealth(spec, cs, utd)
+		if reason == "" {
+			if reason, err = r.canaryFailedRequests(ctx, hb, cs, utd); err != nil {
+				return nil, false, err
+			}
+		}
+		if reason != "" {
+			r.failCanary(hb, reason)
+			return r.settle(ctx, hb, pick, utd)
+		}
+		if time.Since(c.SoakStartTime.Time) < spec.SoakDuration.Duration {
+			r.Log.Info("canary is soaking", "revision", rev, "pods", sprintPodList(utd),
+				"since", c.SoakStartTime.Time)
+			return nil, false, nil
+		}
+
+		r.Log.Info("canary passed, continuing rollout", "revision", rev)
+		c.Passed = true
+		r.Recorder.Eventf(hb, corev1.EventTypeNormal, "CanaryPassed",
+			"Revision %s is healthy on %s", rev, sprintPodList(utd))
+		return pick(ctx, hb, td, utd)
+	}
+}
+
+// settle calls pick with no pods to delete to clean up after a rollout that is
+// halted, and waits.
+func (r *HBaseReconciler) settle(ctx context.Context, hb *hbasev1.HBase,
+	pick pickPodToDeleteFunc, utd []*corev1.Pod) ([]*corev1.Pod, bool, error) {
+	if _, _, err := pick(ctx, hb, nil, utd); err != nil {
+		return nil, false, err
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,173 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	"github.com/tsuna/gohbase/pb"
+	"google.golang.org/protobuf/proto"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWithCanary(t *testing.T) {
+	ctx := context.Background()
+	c := &fakeCluster{servers: map[string][]string{
+		"regionserver-0": {},
+		"regionserver-1": {},
+		"regionserver-2": {},
+	}}
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{Canary: &hbasev1.CanarySpec{
+		Count:        1,
+		SoakDuration: metav1.Duration{Duration: time.Hour},
+	}}}
+	r := newTestReconciler(t, c, hb)
+	metrics := serverMetrics{requests: 1000, failed: 10}
+	defer func(f func(context.Context, *http.Client, string) (serverMetrics, error)) {
+		fetchServerMetrics = f
+	}(fetchServerMetrics)
+	fetchServerMetrics = func(_ context.Context, _ *http.Client, url string) (serverMetrics, error) {
+		if url != "http://regionserver-0.hbase:16030/jmx?qry=Hadoop%3Aservice%3DHBase%2Cname%3DRegionServer%2C%2A" {
+			t.Errorf("unexpected url %s", url)
+		}
+		return metrics, nil
+	}
+
+	var picked [][]*corev1.Pod
+	pick := r.withCanary(func(_ context.Context, _ *hbasev1.HBase,
+		td, _ []*corev1.Pod) ([]*corev1.Pod, bool, error) {
+		picked = append(picked, td)
+		if len(td) == 0 {
+			return nil, true, nil
+		}
+		return td[:1], false, nil
+	})
+	pods := makePods("regionserver-0", "regionserver-1", "regionserver-2")
+	for _, p := range pods {
+		p.Labels = map[string]string{appsv1.StatefulSetRevisionLabel: "new"}
+	}
+
+	// the first regionserver is restarted as a canary
+	if ps, _, err := pick(ctx, hb, pods, nil); err != nil || len(ps) != 1 || ps[0] != pods[0] {
+		t.Fatalf("expected canary %s to be picked, got %v, %v", pods[0].Name, sprintPodList(ps), err)
+	}
+
+	// the rest wait for the soak
+	if ps, _, err := pick(ctx, hb, pods[1:], pods[:1]); err != nil || len(ps) != 0 {
+		t.Fatalf("expected no pod to be picked during soak, got %v, %v", sprintPodList(ps), err)
+	}
+	if len(picked) != 1 {
+		t.Errorf("expected no pick during soak, got %v", picked)
+	}
+	if hb.Status.Canary == nil || hb.Status.Canary.SoakStartTime == nil {
+		t.Fatalf("expected soak to start, got %v", hb.Status.Canary)
+	}
+
+	// the rollout continues after the soak
+	hb.Status.Canary.SoakStartTime.Time = time.Now().Add(-2 * time.Hour)
+	if ps, _, err := pick(ctx, hb, pods[1:], pods[:1]); err != nil || len(ps) != 1 || ps[0] != pods[1] {
+		t.Fatalf("expected %s to be picked after soak, got %v, %v", pods[1].Name, sprintPodList(ps), err)
+	}
+	if !hb.Status.Canary.Passed {
+		t.Error("expected canary to pass")
+	}
+
+	// a new revision restarts the canary, which fails because its pod restarts
+	for _, p := range pods {
+		p.Labels[appsv1.StatefulSetRevisionLabel] = "newer"
+	}
+	pods[0].Status.ContainerStatuses = []corev1.ContainerStatus{{RestartCount: 1}}
+	if ps, _, err := pick(ctx, hb, pods[1:], pods[:1]); err != nil || len(ps) != 0 {
+		t.Fatalf("expected no pod to be picked for failed canary, got %v, %v", sprintPodList(ps), err)
+	}
+	if hb.Status.Canary.Revision != "newer" || hb.Status.Canary.Failure == "" {
+		t.Errorf("expected canary of revision newer to fail, got %v", hb.Status.Canary)
+	}
+	if !meta.IsStatusConditionTrue(hb.Status.Conditions, hbasev1.ConditionDegraded) {
+		t.Errorf("expected degraded condition, got %v", hb.Status.Conditions)
+	}
+
+	// the rollout stays halted
+	pods[0].Status.ContainerStatuses = nil
+	hb.Status.Canary.SoakStartTime.Time = time.Now().Add(-2 * time.Hour)
+	if ps, _, err := pick(ctx, hb, pods[1:], pods[:1]); err != nil || len(ps) != 0 {
+		t.Fatalf("expected rollout to stay halted, got %v, %v", sprintPodList(ps), err)
+	}
+
+	// a canary that fails too many requests fails
+	for _, p := range pods {
+		p.Labels[appsv1.StatefulSetRevisionLabel] = "newest"
+	}
+	metrics.failed = 60
+	if ps, _, err := pick(ctx, hb, pods[1:], pods[:1]); err != nil || len(ps) != 0 {
+		t.Fatalf("expected no pod to be picked for failed canary, got %v, %v", sprintPodList(ps), err)
+	}
+	if f := hb.Status.Canary.Failure; f != "60 of 1000 requests to RegionServer of pod regionserver-0 failed" {
+		t.Errorf("expected canary to fail requests, got %q", f)
+	}
+}
+
+func TestCanaryHealth(t *testing.T) {
+	cs := &pb.ClusterStatus{RegionsInTransition: []*pb.RegionInTransition{{
+		Spec: &pb.RegionSpecifier{
+			Type:  pb.RegionSpecifier_REGION_NAME.Enum(),
+			Value: []byte(regionName(1)),
+		},
+		RegionState: &pb.RegionState{
+			RegionInfo: &pb.RegionInfo{RegionId: proto.Uint64(1)},
+			State:      pb.RegionState_FAILED_OPEN.Enum(),
+		},
+	}}}
+	expected := fmt.Sprintf("region %q is in state FAILED_OPEN", regionName(1))
+	if reason := canaryHealth(&hbasev1.CanarySpec{}, cs, nil); reason != expected {
+		t.Errorf("expected %q, got %q", expected, reason)
+	}
+}
+
+func TestFetchServerMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/jmx" {
+			http.NotFound(w, req)
+			return
+		}
+		fmt.Fprint(w, `{"beans": [
+			{"name": "Hadoop:service=HBase,name=RegionServer,sub=Server", "totalRequestCount": 500},
+			{"name": "Hadoop:service=HBase,name=RegionServer,sub=IPC", "exceptions": 12,
+			 "exceptions.RegionMovedException": 3, "exceptions.NotServingRegionException": 4,
+			 "exceptions.RegionTooBusyException": 5}
+		]}`)
+	}))
+	defer srv.Close()
+
+	m, err := fetchServerMetrics(context.Background(), srv.Client(), srv.URL+"/jmx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.requests != 500 || m.failed != 5 {
+		t.Errorf("unexpected metrics: %+v", m)
+	}
+	if _, err := fetchServerMetrics(context.Background(), srv.Client(), srv.URL+"/other"); err == nil {
+		t.Error("expected error for missing servlet")
+	}
+}
@@ -0,0 +1,541 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	"github.com/tsuna/gohbase/hrpc"
+	"github.com/tsuna/gohbase/pb"
+	"github.com/tsuna/gohbase/region"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	hbaseSiteFile = "hbase-site.xml"
+	coreSiteFile  = "core-site.xml"
+	hdfsSiteFile  = "hdfs-site.xml"
+
+	// defaultPropagationDelay is how long it takes the kubelet to update mounted
+	// ConfigMaps with the default sync period and cache TTL
+	defaultPropagationDelay = 2 * time.Minute
+)
+
+// siteConfiguration is a Hadoop style configuration file, such as hbase-site.xml
+type siteConfiguration struct {
+	XMLName    xml.Name       `xml:"configuration"`
+	Properties []siteProperty `xml:"property"`
+}
+
+type siteProperty struct {
+	Name  string `xml:"name"`
+	Value string `xml:"value"`
+}
+
+// parseSiteXML returns properties of a Hadoop style configuration file
+func parseSiteXML(data string) (map[string]string, error) {
+	var conf siteConfiguration
+	if err := xml.Unmarshal([]byte(data), &conf); err != nil {
+		return nil, err
+	}
+	props := make(map[string]string, len(conf.Properties))
+	for _, p := range conf.Properties {
+		// like Hadoop, names are trimmed and values are taken as they are
+		props[strings.TrimSpace(p.Name)] = p.Value
+	}
+	return props, nil
+}
+
+// renderSiteXML returns a Hadoop style configuration file with the properties
+// ordered by name
+func renderSiteXML(props map[string]string) (string, error) {
+	var conf siteConfiguration
+	for _, name := range slices.Sorted(maps.Keys(props)) {
+		conf.Properties = append(conf.Properties, siteProperty{Name: name, Value: props[name]})
+	}
+	out, err := xml.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return xml.Header + string(out) + "\n", nil
+}
+
+// siteXMLEdit replaces bytes of a site XML file between start and end with text
+type siteXMLEdit struct {
+	start, end int64
+	text       string
+}
+
+// setSiteXMLProperties returns the Hadoop style configuration file with values of
+// the properties replaced and the missing ones appended ordered by name. The rest
+// of the file, such as final, description, comments and includes, is kept as is.
+func setSiteXMLProperties(raw string, props map[string]string) (string, error) {
+	dec := xml.NewDecoder(strings.NewReader(raw))
+	var (
+		edits      []siteXMLEdit
+		seen       = map[string]bool{}
+		depth      int
+		inName     bool
+		name       string
+		nameEnd    int64
+		valueStart int64
+		values     []siteXMLEdit
+		confEnd    int64 = -1
+	)
+	for {
+		offset := dec.InputOffset()
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			switch {
+			case depth == 1 && t.Name.Local != "configuration":
+				return "", fmt.Errorf("unexpected root element %q", t.Name.Local)
+			case depth == 2 && t.Name.Local == "property":
+				name, nameEnd, values = "", -1, nil
+			case depth == 3 && t.Name.Local == "name":
+				inName = true
+			case depth == 3 && t.Name.Local == "value":
+				valueStart = offset
+			}
+		case xml.CharData:
+			if inName {
+				name += string(t)
+			}
+		case xml.EndElement:
+			switch {
+			case depth == 1:
+				confEnd = offset
+			case depth == 2 && t.Name.Local == "property":
+				name = strings.TrimSpace(name)
+				value, ok := props[name]
+				if !ok {
+					break
+				}
+				seen[name] = true
+				text, err := siteXMLElement("value", value)
+				if err != nil {
+					return "", err
+				}
+				if len(values) == 0 && nameEnd >= 0 {
+					edits = append(edits, siteXMLEdit{start: nameEnd, end: nameEnd, text: text})
+				}
+				for _, v := range values {
+					edits = append(edits, siteXMLEdit{start: v.start, end: v.end, text: text})
+				}
+			case depth == 3 && t.Name.Local == "name":
+				inName = false
+				nameEnd = dec.InputOffset()
+			case depth == 3 && t.Name.Local == "value":
+				values = append(values, siteXMLEdit{start: valueStart, end: dec.InputOffset()})
+			}
+			depth--
+		}
+	}
+	if confEnd < 0 {
+		return "", fmt.Errorf("missing configuration element")
+	}
+
+	var appended strings.Builder
+	if confEnd > 0 && raw[confEnd-1] != '\n' {
+		appended.WriteString("\n")
+	}
+	for _, name := range slices.Sorted(maps.Keys(props)) {
+		if seen[name] {
+			continue
+		}
+		n, err := siteXMLElement("name", name)
+		if err != nil {
+			return "", err
+		}
+		v, err := siteXMLElement("value", props[name])
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&appended, "  <property>\n    %s\n    %s\n  </property>\n", n, v)
+	}
+	if len(seen) < len(props) {
+		edits = append(edits, siteXMLEdit{start: confEnd, end: confEnd, text: appended.String()})
+	}
+
+	var out strings.Builder
+	var pos int64
+	for _, e := range edits {
+		out.WriteString(raw[pos:e.start])
+		out.WriteString(e.text)
+		pos = e.end
+	}
+	out.WriteString(raw[pos:])
+	return out.String(), nil
+}
+
+// siteXMLElement returns the element with the escaped text
+func siteXMLElement(name, text string) (string, error) {
+	var b strings.Builder
+	if err := xml.EscapeText(&b, []byte(text)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("<%s>%s</%s>", name, b.String(), name), nil
+}
+
+// setSiteProperties returns the config data with the properties set in the
+// site XML file, which is created if missing
+func setSiteProperties(data map[string]string, file string, props map[string]string) (map[string]string, error) {
+	raw, ok := data[file]
+	if !ok {
+		rendered, err := renderSiteXML(props)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render %s: %w", file, err)
+		}
+		return cloneMap(map[string]string{file: rendered}, data), nil
+	}
+	rendered, err := setSiteXMLProperties(raw, props)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	return cloneMap(map[string]string{file: rendered}, data), nil
+}
+
+// configData returns files of the config ConfigMap of a role given the shared
+// files, its server spec and MasterProperties or RegionServerProperties as the
+// overrides. Files of the server config replace shared files. Structured
+// properties replace values of the same properties in the files and the rest
+// are appended, everything else in files is kept as is.
+func configData(hb *hbasev1.HBase, data map[string]string, ss hbasev1.ServerSpec,
+	overrides hbasev1.ConfigProperties) (map[string]string, error) {
+	layers := []hbasev1.ConfigProperties{hb.Spec.Config.Properties, overrides}
+	if ss.Config != nil && len(ss.Config.Data) > 0 {
+		data = cloneMap(ss.Config.Data, data)
+	}
+	files := []struct {
+		name  string
+		props []map[string]string
+	}{
+		{name: hbaseSiteFile},
+		{name: coreSiteFile},
+		{name: hdfsSiteFile},
+	}
+	for _, l := range layers {
+		files[0].props = append(files[0].props, l.HBaseSite)
+		files[1].props = append(files[1].props, l.CoreSite)
+		files[2].props = append(files[2].props, l.HDFSSite)
+	}
+
+	for _, f := range files {
+		if !slices.ContainsFunc(f.props, func(props map[string]string) bool { return len(props) > 0 }) {
+			continue
+		}
+		merged := map[string]string{}
+		for _, props := range f.props {
+			maps.Copy(merged, props)
+		}
+		var err error
+		if data, err = setSiteProperties(data, f.name, merged); err != nil {
+			return nil, fmt.Errorf("invalid config data: %w", err)
+		}
+	}
+	return data, nil
+}
+
+// configRevision returns the name of the config ConfigMap the role is pinned to,
+// or empty string if its config is generated
+func configRevision(hb *hbasev1.HBase, role string) string {
+	ss := hb.Spec.RegionServerSpec
+	if role == masterRole {
+		ss = hb.Spec.MasterSpec
+	}
+	if ss.Config != nil && ss.Config.Revision != "" {
+		return ss.Config.Revision
+	}
+	return hb.Spec.Config.Revision
+}
+
+// validateConfigRevision rejects the shared config revision if both roles are
+// pinned to it while their configs differ, since one of them would run with
+// the config of the other
+func validateConfigRevision(hb *hbasev1.HBase, masterData, rsData map[string]string) error {
+	rev := hb.Spec.Config.Revision
+	if rev == "" || configRevision(hb, masterRole) != rev || configRevision(hb, regionServerRole) != rev {
+		return nil
+	}
+	if !maps.Equal(masterData, rsData) {
+		return fmt.Errorf("config revision %q is shared by roles whose configs differ, "+
+			"set revision of the master and RegionServer config instead", rev)
+	}
+	return nil
+}
+
+// reloadableProperties returns hbase-site.xml properties that are reloaded
+// without restart. Only properties listed in the spec are reloaded, since
+// whether HBase reloads a property depends on its version.
+func reloadableProperties(spec *hbasev1.ConfigReloadSpec) map[string]bool {
+	props := map[string]bool{}
+	for _, p := range spec.ReloadableProperties {
+		props[p] = true
+	}
+	return props
+}
+
+// configHashData returns the part of config data that requires pods to be
+// restarted once it changes. With reload, these are all files except
+// reloadable properties of hbase-site.xml.
+func configHashData(hb *hbasev1.HBase, data map[string]string) interface{} {
+	if hb.Spec.Config.Reload == nil {
+		return data
+	}
+	site, ok := data[hbaseSiteFile]
+	if !ok {
+		return data
+	}
+	props, err := parseSiteXML(site)
+	if err != nil {
+		// changes of invalid file can't be reloaded, restart
+		return data
+	}
+	for p := range reloadableProperties(hb.Spec.Config.Reload) {
+		delete(props, p)
+	}
+	rest := maps.Clone(data)
+	delete(rest, hbaseSiteFile)
+	return struct {
+		Data           map[string]string
+		SiteProperties map[string]string
+	}{rest, props}
+}
+
+// changedProperties returns names of properties that differ between two
+// Hadoop style configuration files
+func changedProperties(old, new string) ([]string, error) {
+	oldProps, err := parseSiteXML(old)
+	if err != nil {
+		return nil, err
+	}
+	newProps, err := parseSiteXML(new)
+	if err != nil {
+		return nil, err
+	}
+	return changedPropertyNames(oldProps, newProps), nil
+}
+
+// reloadConfigMap updates the config ConfigMap in place with changes of
+// reloadable properties. It returns true if the ConfigMap is up to date.
+func (r *HBaseReconciler) reloadConfigMap(ctx context.Context, hb *hbasev1.HBase,
+	cm *corev1.ConfigMap, data map[string]string) (bool, error) {
+	if maps.Equal(cm.Data, data) {
+		return true, nil
+	}
+	if cm.Immutable != nil && *cm.Immutable {
+		r.Log.Info("ConfigMap is immutable, not reloading changes", "configmap", cm.Name)
+		return true, nil
+	}
+	props, err := changedProperties(cm.Data[hbaseSiteFile], data[hbaseSiteFile])
+	if err != nil {
+		return false, fmt.Errorf("failed to diff %s: %w", hbaseSiteFile, err)
+	}
+	diff := configDiff(hb, cm.Data, data)
+	prev, err := r.snapshotConfigMap(ctx, hb, cm)
+	if err != nil {
+		return false, fmt.Errorf("failed to keep previous config: %w", err)
+	}
+	// record the pending reload before updating the ConfigMap, otherwise servers
+	// aren't asked to reload it if the ConfigMap is updated but the status isn't
+	setConfigUpdate(hb, hbasev1.ConfigUpdateStatus{
+		Role:       cm.Labels[HBaseControllerNameKey],
+		ConfigMap:  cm.Name,
+		Path:       hbasev1.ConfigUpdateReload,
+		Properties: props,
+		Time:       metav1.Now(),
+		Previous:   prev,
+		Diff:       diff,
+	})
+	if err := r.Status().Update(ctx, hb); err != nil {
+		return false, fmt.Errorf("failed to record config reload: %w", err)
+	}
+	cm.Data = data
+	if err := r.Update(ctx, cm); err != nil {
+		return false, err
+	}
+	r.Log.Info("updated HBase ConfigMap in place", "configmap", cm.Name, "properties", props)
+	r.Recorder.Eventf(hb, corev1.EventTypeNormal, "ConfigUpdated",
+		"Updated ConfigMap %s in place, reloading %s: %s", cm.Name, strings.Join(props, ", "),
+		diffSummary(diff))
+	return false, nil
+}
+
+// snapshotConfigMap keeps the content of the ConfigMap before it's updated in place
+// as a ConfigMap of the revision history, so that Config.Revision is able to roll
+// reloaded values back. It returns the name of the snapshot.
+func (r *HBaseReconciler) snapshotConfigMap(ctx context.Context, hb *hbasev1.HBase,
+	cm *corev1.ConfigMap) (string, error) {
+	h := sha256.New()
+	DeepHashObject(h, cm.Data)
+	checksum := fmt.Sprintf("%x", h.Sum(nil))[:8]
+	name := types.NamespacedName{
+		Name:      cm.Name + "-" + checksum,
+		Namespace: cm.Namespace,
+	}
+	snapshot, err := r.configMap(hb, name, cm.Labels[HBaseControllerNameKey], cm.Data)
+	if err != nil {
+		return "", err
+	}
+	// the values were produced by the generation of the ConfigMap
+	snapshot.Annotations[HBaseControllerGenerationKey] = cm.Annotations[HBaseControllerGenerationKey]
+	snapshot.Immutable = ptr.To(true)
+	if err := r.Create(ctx, snapshot); err != nil && !errors.IsAlreadyExists(err) {
+		return "", err
+	}
+	r.Log.Info("kept previous config", "configmap", cm.Name, "snapshot", name.Name)
+	return name.Name, nil
+}
+
+// updateConfiguration is the admin RPC that makes a server reload its configuration.
+// gohbase doesn't provide it. Its request and response are empty messages,
+// so they are encoded the same as Empty.
+type updateConfiguration struct {
+	ctx      context.Context
+	region   hrpc.RegionInfo
+	resultch chan hrpc.RPCResult
+}
+
+func newUpdateConfiguration(ctx context.Context) *updateConfiguration {
+	return &updateConfiguration{
+		ctx:      ctx,
+		resultch: make(chan hrpc.RPCResult, 1),
+	}
+}
+
+func (c *updateConfiguration) Table() []byte                    { return nil }
+func (c *updateConfiguration) Name() string                     { return "UpdateConfiguration" }
+func (c *updateConfiguration) Key() []byte                      { return nil }
+func (c *updateConfiguration) Region() hrpc.RegionInfo          { return c.region }
+func (c *updateConfiguration) SetRegion(region hrpc.RegionInfo) { c.region = region }
+func (c *updateConfiguration) ToProto() proto.Message           { return &emptypb.Empty{} }
+func (c *updateConfiguration) NewResponse() proto.Message       { return &emptypb.Empty{} }
+func (c *updateConfiguration) ResultChan() chan hrpc.RPCResult  { return c.resultch }
+func (c *updateConfiguration) Description() string              { return c.Name() }
+func (c *updateConfiguration) Context() context.Context         { return c.ctx }
+
+// adminService is the service of servers that UpdateConfiguration belongs to
+const adminService = region.ClientType("AdminService")
+
+// defaultHBaseUser is the effective user of gohbase clients
+const defaultHBaseUser = "root"
+
+// hbaseUser returns the effective user of RPCs sent to servers
+func (r *HBaseReconciler) hbaseUser() string {
+	if r.HBaseUser == "" {
+		return defaultHBaseUser
+	}
+	return r.HBaseUser
+}
+
+// sendAdminRPC sends the RPC to the admin service of the server at addr as
+// the user. The gohbase admin client only talks to the active master, so the
+// server is dialed with a gohbase region client, which encodes the RPC.
+// It's a variable to be replaced in tests.
+var sendAdminRPC = func(ctx context.Context, addr, user string, c hrpc.Call) (proto.Message, error) {
+	rc := region.NewClient(addr, adminService, 1, 0, user,
+		region.DefaultReadTimeout, nil, nil, slog.Default())
+	defer rc.Close()
+	if err := rc.Dial(ctx); err != nil {
+		return nil, err
+	}
+	rc.QueueRPC(c)
+	select {
+	case res := <-c.ResultChan():
+		return res.Msg, res.Error
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// reloadConfig asks masters and RegionServers to reload their configuration
+// once ConfigMaps updated in place are propagated to pods. It returns true
+// if there is nothing to reload.
+func (r *HBaseReconciler) reloadConfig(ctx context.Context, hb *hbasev1.HBase) (bool, error) {
+	if hb.Spec.Config.Reload == nil {
+		return true, nil
+	}
+	var pending []*hbasev1.ConfigUpdateStatus
+	for i := range hb.Status.ConfigUpdates {
+		if u := &hb.Status.ConfigUpdates[i]; u.Path == hbasev1.ConfigUpdateReload && !u.Reloaded {
+			pending = append(pending, u)
+		}
+	}
+	if len(pending) == 0 {
+		return true, nil
+	}
+	delay := defaultPropagationDelay
+	if d := hb.Spec.Config.Reload.PropagationDelay; d != nil {
+		delay = d.Duration
+	}
+	var configMaps []string
+	for _, u := range pending {
+		if time.Since(u.Time.Time) < delay {
+			r.Log.Info("waiting for ConfigMap to propagate to pods", "configmap", u.ConfigMap)
+			return false, nil
+		}
+		configMaps = append(configMaps, u.ConfigMap)
+	}
+
+	cs, err := r.GhAdmin.ClusterStatus()
+	if err != nil {
+		return false, err
+	}
+	servers := append([]*pb.ServerName{cs.GetMaster()}, cs.GetBackupMasters()...)
+	for _, s := range cs.GetLiveServers() {
+		servers = append(servers, s.GetServer())
+	}
+	for _, s := range servers {
+		addr := net.JoinHostPort(s.GetHostName(), strconv.Itoa(int(s.GetPort())))
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		_, err := sendAdminRPC(ctx, addr, r.hbaseUser(), newUpdateConfiguration(ctx))
+		cancel()
+		if err != nil {
+			return false, fmt.Errorf("failed to reload configuration of %s: %w", addr, err)
+		}
+	}
+	r.Log.Info("reloaded configuration", "configmaps", configMaps, "servers", len(servers))
+	for _, u := range pending {
+		u.Reloaded = true
+	}
+	r.Recorder.Eventf(hb, corev1.EventTypeNormal, "ConfigReloaded",
+		"Reloaded configuration of %d servers from ConfigMaps %s", len(servers), strings.Join(configMaps, ", "))
+	return true, nil
+}
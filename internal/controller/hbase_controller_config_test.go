@@ -0,0 +1,675 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	"github.com/tsuna/gohbase/hrpc"
+	"github.com/tsuna/gohbase/pb"
+	"github.com/tsuna/gohbase/test/mock"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/emptypb"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+func siteXML(props ...string) string {
+	s := "<configuration>\n"
+	for i := 0; i+1 < len(props); i += 2 {
+		s += fmt.Sprintf("  <property>\n    <name>%s</name>\n    <value>%s</value>\n  </property>\n",
+			props[i], props[i+1])
+	}
+	return s + "</configuration>\n"
+}
+
+func TestReloadConfig(t *testing.T) {
+	ctx := context.Background()
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{Config: hbasev1.ConfigMap{
+		Data: map[string]string{
+			hbaseSiteFile: siteXML("hbase.zookeeper.quorum", "zk",
+				"hbase.regionserver.thread.compaction.large", "1"),
+		},
+		Reload: &hbasev1.ConfigReloadSpec{
+			ReloadableProperties: []string{"hbase.custom.reloadable", "hbase.regionserver.thread.compaction.large"},
+			PropagationDelay:     &metav1.Duration{},
+		},
+	}}}
+	r := newHistoryTestReconciler(t, hb)
+	ctrl := gomock.NewController(t)
+	ghAdmin := mock.NewMockAdminClient(ctrl)
+	ghAdmin.EXPECT().ClusterStatus().AnyTimes().Return(&pb.ClusterStatus{
+		Master:        &pb.ServerName{HostName: proto.String("hbasemaster-0.hbase"), Port: proto.Uint32(16000)},
+		BackupMasters: []*pb.ServerName{{HostName: proto.String("hbasemaster-1.hbase"), Port: proto.Uint32(16000)}},
+		LiveServers: []*pb.LiveServerInfo{{
+			Server: &pb.ServerName{HostName: proto.String("regionserver-0.hbase"), Port: proto.Uint32(16020)},
+		}},
+	}, nil)
+	r.GhAdmin = &sendRPCAdminClient{MockAdminClient: ghAdmin}
+
+	var reloaded []string
+	defer func(f func(context.Context, string, string, hrpc.Call) (proto.Message, error)) {
+		sendAdminRPC = f
+	}(sendAdminRPC)
+	sendAdminRPC = func(_ context.Context, addr, user string, c hrpc.Call) (proto.Message, error) {
+		if c.Name() != "UpdateConfiguration" || user != "root" {
+			t.Errorf("unexpected RPC %s as %s", c.Name(), user)
+		}
+		reloaded = append(reloaded, addr)
+		return c.NewResponse(), nil
+	}
+
+	name := getConfigMapName(hb, "regionserver", hb.Spec.Config.Data, nil)
+	if ok, err := r.ensureConfigMap(hb, name, "regionserver", hb.Spec.Config.Data); err != nil || ok {
+		t.Fatalf("expected ConfigMap to be created: %v", err)
+	}
+	if u := configUpdate(hb, "regionserver"); u == nil || u.Path != hbasev1.ConfigUpdateRestart || u.ConfigMap != name.Name {
+		t.Fatalf("unexpected config update: %+v", u)
+	}
+	if ok, err := r.reloadConfig(ctx, hb); err != nil || !ok || len(reloaded) != 0 {
+		t.Fatalf("expected nothing to reload: %v, %v", err, reloaded)
+	}
+
+	// reloadable properties are updated in place
+	hb.Spec.Config.Data = map[string]string{
+		hbaseSiteFile: siteXML("hbase.zookeeper.quorum", "zk",
+			"hbase.regionserver.thread.compaction.large", "4",
+			"hbase.custom.reloadable", "true"),
+	}
+	if n := getConfigMapName(hb, "regionserver", hb.Spec.Config.Data, nil); n != name {
+		t.Fatalf("expected ConfigMap %s to be kept, got %s", name, n)
+	}
+	if err := r.Update(ctx, hb); err != nil {
+		t.Fatal(err)
+	}
+
+	// the ConfigMap isn't updated unless the pending reload is recorded
+	stale := hb.DeepCopy()
+	stale.ResourceVersion = "1"
+	if _, err := r.ensureConfigMap(stale, name, "regionserver", stale.Spec.Config.Data); err == nil {
+		t.Fatal("expected failure to record config reload")
+	}
+	cm := &corev1.ConfigMap{}
+	if err := r.Get(ctx, name, cm); err != nil {
+		t.Fatal(err)
+	}
+	if cm.Data[hbaseSiteFile] == hb.Spec.Config.Data[hbaseSiteFile] {
+		t.Fatal("expected ConfigMap to be kept until the reload is recorded")
+	}
+
+	if ok, err := r.ensureConfigMap(hb, name, "regionserver", hb.Spec.Config.Data); err != nil || ok {
+		t.Fatalf("expected ConfigMap to be updated: %v", err)
+	}
+	if err := r.Get(ctx, name, cm); err != nil {
+		t.Fatal(err)
+	}
+	if cm.Data[hbaseSiteFile] != hb.Spec.Config.Data[hbaseSiteFile] {
+		t.Fatalf("expected ConfigMap to be updated in place: %v", cm.Data)
+	}
+	u := configUpdate(hb, "regionserver")
+	if u == nil || u.Path != hbasev1.ConfigUpdateReload || !slices.Equal(u.Properties,
+		[]string{"hbase.custom.reloadable", "hbase.regionserver.thread.compaction.large"}) {
+		t.Fatalf("unexpected config update: %+v", u)
+	}
+	stored := &hbasev1.HBase{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(hb), stored); err != nil {
+		t.Fatal(err)
+	}
+	if u := configUpdate(stored, "regionserver"); u == nil || u.Path != hbasev1.ConfigUpdateReload || u.Reloaded {
+		t.Fatalf("expected pending reload to be persisted: %+v", u)
+	}
+	if ok, err := r.ensureConfigMap(hb, name, "regionserver", hb.Spec.Config.Data); err != nil || !ok {
+		t.Fatalf("expected ConfigMap to be up to date: %v", err)
+	}
+
+	// previous values are kept to be able to roll them back
+	prev := &corev1.ConfigMap{}
+	if err := r.Get(ctx, types.NamespacedName{Name: u.Previous, Namespace: name.Namespace}, prev); err != nil {
+		t.Fatalf("expected previous config to be kept: %v", err)
+	}
+	if prev.Name == name.Name || !*prev.Immutable || prev.Labels[HBaseControllerNameKey] != "regionserver" ||
+		prev.Data[hbaseSiteFile] != siteXML("hbase.zookeeper.quorum", "zk",
+			"hbase.regionserver.thread.compaction.large", "1") {
+		t.Fatalf("unexpected previous config: %+v", prev)
+	}
+
+	// a change of masters doesn't replace the pending reload of RegionServers
+	masterName := getConfigMapName(hb, masterRole, hb.Spec.Config.Data, nil)
+	if ok, err := r.ensureConfigMap(hb, masterName, masterRole, hb.Spec.Config.Data); err != nil || ok {
+		t.Fatalf("expected ConfigMap to be created: %v", err)
+	}
+	if len(hb.Status.ConfigUpdates) != 2 {
+		t.Fatalf("expected a config update per role: %+v", hb.Status.ConfigUpdates)
+	}
+	if u := configUpdate(hb, masterRole); u == nil || u.Path != hbasev1.ConfigUpdateRestart || u.ConfigMap != masterName.Name {
+		t.Fatalf("unexpected config update of masters: %+v", u)
+	}
+	if u := configUpdate(hb, "regionserver"); u == nil || u.Path != hbasev1.ConfigUpdateReload || u.Reloaded {
+		t.Fatalf("expected reload of RegionServers to be pending: %+v", u)
+	}
+
+	// every server reloads configuration once
+	if ok, err := r.reloadConfig(ctx, hb); err != nil || !ok {
+		t.Fatalf("expected configuration to be reloaded: %v", err)
+	}
+	if !slices.Equal(reloaded, []string{"hbasemaster-0.hbase:16000", "hbasemaster-1.hbase:16000",
+		"regionserver-0.hbase:16020"}) || !configUpdate(hb, "regionserver").Reloaded {
+		t.Fatalf("unexpected reloaded servers: %v", reloaded)
+	}
+	if _, err := r.reloadConfig(ctx, hb); err != nil || len(reloaded) != 3 {
+		t.Fatalf("expected configuration to be reloaded once: %v, %v", err, reloaded)
+	}
+
+	// other properties restart pods with a new ConfigMap
+	hb.Spec.Config.Data = map[string]string{
+		hbaseSiteFile: siteXML("hbase.zookeeper.quorum", "zk2",
+			"hbase.regionserver.thread.compaction.large", "4",
+			"hbase.custom.reloadable", "true"),
+	}
+	if n := getConfigMapName(hb, "regionserver", hb.Spec.Config.Data, nil); n == name {
+		t.Fatalf("expected new ConfigMap, got %s", n)
+	}
+
+	// properties that aren't listed as reloadable restart pods
+	hb.Spec.Config.Data = map[string]string{
+		hbaseSiteFile: siteXML("hbase.zookeeper.quorum", "zk",
+			"hbase.regionserver.thread.compaction.large", "4",
+			"hbase.custom.reloadable", "true",
+			"hbase.hstore.compaction.max", "20"),
+	}
+	if n := getConfigMapName(hb, "regionserver", hb.Spec.Config.Data, nil); n == name {
+		t.Fatalf("expected new ConfigMap, got %s", n)
+	}
+}
+
+func TestConfigMapReloadToggle(t *testing.T) {
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{Config: hbasev1.ConfigMap{
+		Data: map[string]string{
+			hbaseSiteFile: siteXML("hbase.regionserver.thread.compaction.large", "1"),
+		},
+	}}}
+	r := newHistoryTestReconciler(t, hb)
+	immutable := func(name types.NamespacedName) bool {
+		cm, err := r.configMap(hb, name, "regionserver", hb.Spec.Config.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *cm.Immutable
+	}
+	name := getConfigMapName(hb, "regionserver", hb.Spec.Config.Data, nil)
+	if !immutable(name) {
+		t.Error("expected immutable ConfigMap without reload")
+	}
+
+	// enabling reload renames the ConfigMap, which restarts pods once
+	hb.Spec.Config.Reload = &hbasev1.ConfigReloadSpec{
+		ReloadableProperties: []string{"hbase.regionserver.thread.compaction.large"},
+	}
+	reloadName := getConfigMapName(hb, "regionserver", hb.Spec.Config.Data, nil)
+	if reloadName == name || immutable(reloadName) {
+		t.Errorf("expected mutable ConfigMap with a new name, got %s", reloadName)
+	}
+
+	// changes of reloadable properties keep the name from then on
+	hb.Spec.Config.Data = map[string]string{
+		hbaseSiteFile: siteXML("hbase.regionserver.thread.compaction.large", "2"),
+	}
+	if got := getConfigMapName(hb, "regionserver", hb.Spec.Config.Data, nil); got != reloadName {
+		t.Errorf("expected ConfigMap name to be kept, got %s", got)
+	}
+
+	// changing the list of reloadable properties renames it again
+	hb.Spec.Config.Reload.ReloadableProperties = nil
+	if got := getConfigMapName(hb, "regionserver", hb.Spec.Config.Data, nil); got == reloadName {
+		t.Error("expected ConfigMap name to change with reloadable properties")
+	}
+
+	// so does disabling reload
+	hb.Spec.Config.Reload = nil
+	if got := getConfigMapName(hb, "regionserver", hb.Spec.Config.Data, nil); got == reloadName || !immutable(got) {
+		t.Errorf("expected immutable ConfigMap with a new name, got %s", got)
+	}
+}
+
+func TestSendAdminRPC(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the server side of the HBase RPC protocol
+	errc := make(chan error, 1)
+	go func() {
+		errc <- func() error {
+			conn, err := l.Accept()
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+			preamble := make([]byte, 6)
+			if _, err := io.ReadFull(conn, preamble); err != nil {
+				return err
+			}
+			if string(preamble) != "HBas\x00\x50" {
+				return fmt.Errorf("unexpected preamble %q", preamble)
+			}
+			b, err := readFrame(conn)
+			if err != nil {
+				return err
+			}
+			ch := &pb.ConnectionHeader{}
+			if err := proto.Unmarshal(b, ch); err != nil {
+				return err
+			}
+			if ch.GetServiceName() != "AdminService" || ch.GetUserInfo().GetEffectiveUser() != "hbase" {
+				return fmt.Errorf("unexpected connection header %v", ch)
+			}
+			if b, err = readFrame(conn); err != nil {
+				return err
+			}
+			hb, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			rh := &pb.RequestHeader{}
+			if err := proto.Unmarshal(hb, rh); err != nil {
+				return err
+			}
+			if rh.GetMethodName() != "UpdateConfiguration" || !rh.GetRequestParam() {
+				return fmt.Errorf("unexpected request header %v", rh)
+			}
+			// UpdateConfigurationRequest is an empty message
+			if req, m := protowire.ConsumeBytes(b[n:]); m < 0 || len(req) != 0 || n+m != len(b) {
+				return fmt.Errorf("unexpected request %q", b[n:])
+			}
+			resp, err := proto.Marshal(&pb.ResponseHeader{CallId: rh.CallId})
+			if err != nil {
+				return err
+			}
+			frame := protowire.AppendBytes(nil, resp)
+			frame = protowire.AppendBytes(frame, nil)
+			_, err = conn.Write(binary.BigEndian.AppendUint32(nil, uint32(len(frame))))
+			if err == nil {
+				_, err = conn.Write(frame)
+			}
+			return err
+		}()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	msg, err := sendAdminRPC(ctx, l.Addr().String(), "hbase", newUpdateConfiguration(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := msg.(*emptypb.Empty); !ok {
+		t.Errorf("unexpected response %T", msg)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readFrame reads a message prefixed with its 4 byte length
+func readFrame(r io.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(size[:]))
+	_, err := io.ReadFull(r, b)
+	return b, err
+}
+
+func TestConfigData(t *testing.T) {
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{Config: hbasev1.ConfigMap{
+		Data: map[string]string{
+			hbaseSiteFile:  siteXML("hbase.rootdir", "hdfs://old", "hbase.cluster.distributed", "true"),
+			"hbase-env.sh": "export HBASE_HEAPSIZE=1G",
+		},
+	}}}
+
+	// without properties, data is used as is
+	data, err := configData(hb, hb.Spec.Config.Data, hbasev1.ServerSpec{}, hbasev1.ConfigProperties{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(data, hb.Spec.Config.Data) {
+		t.Fatalf("expected data to be kept: %v", data)
+	}
+	name := getConfigMapName(hb, "regionserver", data, nil)
+
+	hb.Spec.Config.Properties = hbasev1.ConfigProperties{
+		HBaseSite: map[string]string{"hbase.rootdir": "hdfs://new", "hbase.zookeeper.quorum": "zk"},
+		CoreSite:  map[string]string{"fs.defaultFS": "hdfs://nn"},
+	}
+	hb.Spec.Config.RegionServerProperties = hbasev1.ConfigProperties{
+		HBaseSite: map[string]string{"hbase.zookeeper.quorum": "rs-zk"},
+	}
+	master, err := configData(hb, hb.Spec.Config.Data, hbasev1.ServerSpec{}, hb.Spec.Config.MasterProperties)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := configData(hb, hb.Spec.Config.Data, hbasev1.ServerSpec{}, hb.Spec.Config.RegionServerProperties)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<configuration>
+  <property>
+    <name>hbase.rootdir</name>
+    <value>hdfs://new</value>
+  </property>
+  <property>
+    <name>hbase.cluster.distributed</name>
+    <value>true</value>
+  </property>
+  <property>
+    <name>hbase.zookeeper.quorum</name>
+    <value>zk</value>
+  </property>
+</configuration>
+`
+	if master[hbaseSiteFile] != expected {
+		t.Errorf("unexpected %s:\n%s", hbaseSiteFile, master[hbaseSiteFile])
+	}
+	if props, err := parseSiteXML(master[coreSiteFile]); err != nil || props["fs.defaultFS"] != "hdfs://nn" {
+		t.Errorf("unexpected %s: %v, %v", coreSiteFile, props, err)
+	}
+	if _, ok := master[hdfsSiteFile]; ok {
+		t.Errorf("unexpected %s without properties", hdfsSiteFile)
+	}
+	if master["hbase-env.sh"] != "export HBASE_HEAPSIZE=1G" {
+		t.Errorf("expected other files to be kept: %v", master)
+	}
+	if props, err := parseSiteXML(rs[hbaseSiteFile]); err != nil || props["hbase.zookeeper.quorum"] != "rs-zk" {
+		t.Errorf("expected role override: %v, %v", props, err)
+	}
+
+	masterName := getConfigMapName(hb, "hbasemaster", master, nil)
+	rsName := getConfigMapName(hb, "regionserver", rs, nil)
+	if rsName == name || masterName.Name[:len(masterName.Name)-8] != "config-hbasemaster-" {
+		t.Errorf("expected different ConfigMaps for rendered data, got %s and %s", masterName, rsName)
+	}
+
+	hb.Spec.Config.Data[hbaseSiteFile] = "<configuration"
+	if _, err := configData(hb, hb.Spec.Config.Data, hbasev1.ServerSpec{}, hbasev1.ConfigProperties{}); err == nil {
+		t.Error("expected error for invalid hbase-site.xml")
+	}
+}
+
+func TestSetSiteXMLProperties(t *testing.T) {
+	raw := `<?xml version="1.0"?>
+<?xml-stylesheet type="text/xsl" href="configuration.xsl"?>
+<!-- managed by ops -->
+<configuration xmlns:xi="http://www.w3.org/2001/XInclude">
+  <xi:include href="common-site.xml"/>
+  <property>
+    <name>hbase.rootdir</name>
+    <value>hdfs://old</value>
+    <final>true</final>
+    <description>Root of HBase &amp; its tables</description>
+    <source>hbase-site.xml</source>
+  </property>
+  <property>
+    <name> hbase.tmp.dir </name>
+    <value> /tmp/hbase </value>
+  </property>
+  <property>
+    <name>hbase.zookeeper.quorum</name>
+    <value/>
+  </property>
+</configuration>
+`
+	got, err := setSiteXMLProperties(raw, map[string]string{
+		"hbase.rootdir":          "hdfs://new",
+		"hbase.zookeeper.quorum": "zk-0,zk-1",
+		"hbase.master.port":      "<16000>",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `<?xml version="1.0"?>
+<?xml-stylesheet type="text/xsl" href="configuration.xsl"?>
+<!-- managed by ops -->
+<configuration xmlns:xi="http://www.w3.org/2001/XInclude">
+  <xi:include href="common-site.xml"/>
+  <property>
+    <name>hbase.rootdir</name>
+    <value>hdfs://new</value>
+    <final>true</final>
+    <description>Root of HBase &amp; its tables</description>
+    <source>hbase-site.xml</source>
+  </property>
+  <property>
+    <name> hbase.tmp.dir </name>
+    <value> /tmp/hbase </value>
+  </property>
+  <property>
+    <name>hbase.zookeeper.quorum</name>
+    <value>zk-0,zk-1</value>
+  </property>
+  <property>
+    <name>hbase.master.port</name>
+    <value>&lt;16000&gt;</value>
+  </property>
+</configuration>
+`
+	if got != expected {
+		t.Errorf("unexpected %s:\n%s", hbaseSiteFile, got)
+	}
+	props, err := parseSiteXML(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if props["hbase.tmp.dir"] != " /tmp/hbase " || props["hbase.master.port"] != "<16000>" {
+		t.Errorf("unexpected properties: %q", props)
+	}
+
+	// a property without value gets one
+	got, err = setSiteXMLProperties("<configuration><property><name>a</name></property></configuration>",
+		map[string]string{"a": "1"})
+	if err != nil || got != "<configuration><property><name>a</name><value>1</value></property></configuration>" {
+		t.Errorf("unexpected %s: %s, %v", hbaseSiteFile, got, err)
+	}
+
+	for _, raw := range []string{"<configuration>", "<conf></conf>", ""} {
+		if _, err := setSiteXMLProperties(raw, map[string]string{"a": "1"}); err == nil {
+			t.Errorf("expected error for %q", raw)
+		}
+	}
+}
+
+func TestServerConfig(t *testing.T) {
+	ctx := context.Background()
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{
+		Config: hbasev1.ConfigMap{
+			Data: map[string]string{
+				hbaseSiteFile:  siteXML("hbase.rootdir", "hdfs://nn"),
+				"hbase-env.sh": "export HBASE_HEAPSIZE=1G",
+			},
+			Properties: hbasev1.ConfigProperties{
+				HBaseSite: map[string]string{"hbase.regionserver.handler.count": "30"},
+			},
+			RegionServerProperties: hbasev1.ConfigProperties{
+				HBaseSite: map[string]string{"hbase.regionserver.handler.count": "100"},
+			},
+		},
+		MasterSpec: hbasev1.ServerSpec{Config: &hbasev1.ServerConfig{
+			Data: map[string]string{"hbase-env.sh": "export HBASE_HEAPSIZE=4G"},
+		}},
+		RevisionHistoryLimit: ptr.To(int32(0)),
+	}}
+	r := newHistoryTestReconciler(t, hb)
+
+	master, err := configData(hb, hb.Spec.Config.Data, hb.Spec.MasterSpec, hb.Spec.Config.MasterProperties)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if master["hbase-env.sh"] != "export HBASE_HEAPSIZE=4G" {
+		t.Errorf("expected master files to replace shared ones: %v", master)
+	}
+	if props, err := parseSiteXML(master[hbaseSiteFile]); err != nil ||
+		props["hbase.regionserver.handler.count"] != "30" || props["hbase.rootdir"] != "hdfs://nn" {
+		t.Errorf("expected shared properties for masters: %v, %v", props, err)
+	}
+	rs, err := configData(hb, hb.Spec.Config.Data, hb.Spec.RegionServerSpec, hb.Spec.Config.RegionServerProperties)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if props, err := parseSiteXML(rs[hbaseSiteFile]); err != nil ||
+		props["hbase.regionserver.handler.count"] != "100" || props["hbase.rootdir"] != "hdfs://nn" {
+		t.Errorf("expected RegionServer properties to override shared ones: %v, %v", props, err)
+	}
+	if rs["hbase-env.sh"] != "export HBASE_HEAPSIZE=1G" {
+		t.Errorf("expected shared files for RegionServers: %v", rs)
+	}
+
+	// a master-only change doesn't change the RegionServer ConfigMap
+	rsName := getConfigMapName(hb, "regionserver", rs, nil)
+	hb.Spec.MasterSpec.Config.Data["hbase-env.sh"] = "export HBASE_HEAPSIZE=8G"
+	master2, err := configData(hb, hb.Spec.Config.Data, hb.Spec.MasterSpec, hb.Spec.Config.MasterProperties)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs2, err := configData(hb, hb.Spec.Config.Data, hb.Spec.RegionServerSpec, hb.Spec.Config.RegionServerProperties)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getConfigMapName(hb, "regionserver", rs2, nil) != rsName {
+		t.Error("expected RegionServer ConfigMap to be kept")
+	}
+
+	// unused ConfigMaps are deleted per role
+	roles := []string{"hbasemaster", "hbasemaster", "regionserver"}
+	datas := []map[string]string{master, master2, rs}
+	var names []types.NamespacedName
+	for i, role := range roles {
+		name := getConfigMapName(hb, role, datas[i], nil)
+		if ok, err := r.ensureConfigMap(hb, name, role, datas[i]); err != nil || ok {
+			t.Fatalf("expected ConfigMap %s to be created: %v", name, err)
+		}
+		names = append(names, name)
+	}
+	if err := r.deleteUnusedConfigMaps(ctx, hb, names[1], names[2]); err != nil {
+		t.Fatal(err)
+	}
+	l := &corev1.ConfigMapList{}
+	if err := r.List(ctx, l); err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, cm := range l.Items {
+		kept = append(kept, cm.Name)
+	}
+	slices.Sort(kept)
+	if !slices.Equal(kept, []string{names[1].Name, names[2].Name}) {
+		t.Errorf("expected current ConfigMaps of roles to be kept, got %v", kept)
+	}
+}
+
+func TestConfigTemplates(t *testing.T) {
+	hb := &hbasev1.HBase{
+		ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "prod"},
+		Spec: hbasev1.HBaseSpec{Config: hbasev1.ConfigMap{
+			Data: map[string]string{
+				hbaseSiteFile: siteXML("hbase.zookeeper.quorum", "{{ .ZooKeeperQuorum }}",
+					"hbase.master.hostname", `{{ printf "master.%s" .ServiceDomain }}`),
+			},
+			Properties: hbasev1.ConfigProperties{
+				HBaseSite: map[string]string{"hbase.rootdir": "hdfs://nn/hbase"},
+			},
+		}},
+	}
+	r := &HBaseReconciler{ZkQuorum: "zk-0:2181", ZkRoot: "/hbase", ClusterDomain: "cluster.local"}
+
+	// templates aren't rendered unless enabled
+	data, err := r.roleConfigData(hb, "regionserver", hb.Spec.Config.Data, hbasev1.ServerSpec{},
+		hbasev1.ConfigProperties{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	props, err := parseSiteXML(data[hbaseSiteFile])
+	if err != nil || props["hbase.zookeeper.quorum"] != "{{ .ZooKeeperQuorum }}" {
+		t.Errorf("expected template to be kept: %v, %v", props, err)
+	}
+	name := getConfigMapName(hb, "regionserver", data, nil)
+
+	hb.Spec.Config.Template = true
+	rsSpec := hbasev1.ServerSpec{Config: &hbasev1.ServerConfig{
+		Data: map[string]string{"hbase-env.sh": "export NS={{ .Namespace }}"},
+	}}
+	data, err = r.roleConfigData(hb, "regionserver", hb.Spec.Config.Data, rsSpec, hbasev1.ConfigProperties{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	props, err = parseSiteXML(data[hbaseSiteFile])
+	if err != nil || props["hbase.zookeeper.quorum"] != "zk-0:2181" ||
+		props["hbase.master.hostname"] != "master.hbase.prod.svc.cluster.local" ||
+		props["hbase.rootdir"] != "hdfs://nn/hbase" {
+		t.Errorf("unexpected rendered properties: %v, %v", props, err)
+	}
+	if data["hbase-env.sh"] != "export NS=prod" {
+		t.Errorf("expected server files to be rendered: %v", data)
+	}
+	if rsSpec.Config.Data["hbase-env.sh"] != "export NS={{ .Namespace }}" {
+		t.Error("expected spec to be kept")
+	}
+	if getConfigMapName(hb, "regionserver", data, nil) == name {
+		t.Error("expected rendered data to change the ConfigMap name")
+	}
+
+	// files of sources are copied as they are
+	shared := cloneMap(hb.Spec.Config.Data, map[string]string{"log4j2.properties": "x={{ .Unknown }}"})
+	data, err = r.roleConfigData(hb, "regionserver", shared, hbasev1.ServerSpec{}, hbasev1.ConfigProperties{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["log4j2.properties"] != "x={{ .Unknown }}" {
+		t.Errorf("expected files of sources not to be rendered: %v", data)
+	}
+
+	// the service domain is relative without the cluster domain, like hostnames of principals
+	r.ClusterDomain = ""
+	data, err = r.roleConfigData(hb, "regionserver", hb.Spec.Config.Data, hbasev1.ServerSpec{},
+		hbasev1.ConfigProperties{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	props, err = parseSiteXML(data[hbaseSiteFile])
+	if err != nil || props["hbase.master.hostname"] != "master.hbase.prod.svc" {
+		t.Errorf("unexpected service domain without cluster domain: %v, %v", props, err)
+	}
+
+	hb.Spec.Config.Data["hbase-env.sh"] = "export X={{ .Unknown }}"
+	if _, err := r.roleConfigData(hb, "regionserver", hb.Spec.Config.Data, hbasev1.ServerSpec{},
+		hbasev1.ConfigProperties{}); err == nil {
+		t.Error("expected error for unknown variable")
+	}
+}
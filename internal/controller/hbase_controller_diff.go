@@ -0,0 +1,305 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// configDiffLimit is the maximum number of changes in a config diff
+	configDiffLimit = 30
+	// eventDiffLimit is the maximum number of changes of a config diff in events,
+	// the full diff is in the status
+	eventDiffLimit = 3
+	// linesDiffLimit is the maximum number of changed lines of both versions of
+	// a file that are diffed, larger changes are reported as the file changed
+	linesDiffLimit = 1000
+	maskedValue    = "<masked>"
+)
+
+// sensitivePatterns are parts of names of properties that are always masked
+var sensitivePatterns = []string{"password", "secret"}
+
+// sensitiveProperty returns true if values of the property have to be masked.
+// Names are compared case-insensitively, listed properties match exactly.
+func sensitiveProperty(hb *hbasev1.HBase, name string) bool {
+	ln := strings.ToLower(name)
+	for _, p := range sensitivePatterns {
+		if strings.Contains(ln, p) {
+			return true
+		}
+	}
+	for _, p := range hb.Spec.Config.SensitiveProperties {
+		if strings.EqualFold(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// sensitiveLine returns true if the line of a file mentions a sensitive
+// property and has to be masked. Listed properties match whole names only.
+func sensitiveLine(hb *hbasev1.HBase, line string) bool {
+	ll := strings.ToLower(line)
+	for _, p := range sensitivePatterns {
+		if strings.Contains(ll, p) {
+			return true
+		}
+	}
+	for _, p := range hb.Spec.Config.SensitiveProperties {
+		if p != "" && containsName(ll, strings.ToLower(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsName returns true if lowercased s contains the property name not
+// surrounded by other characters of property names, except for the "-D" of
+// Java system properties
+func containsName(s, name string) bool {
+	isNameChar := func(c byte) bool {
+		return c == '.' || c == '_' || c == '-' ||
+			'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+	}
+	for i := 0; ; {
+		j := strings.Index(s[i:], name)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(name)
+		left := start == 0 || !isNameChar(s[start-1]) || strings.HasSuffix(s[:start], "-d")
+		if left && (end == len(s) || !isNameChar(s[end])) {
+			return true
+		}
+		i = start + 1
+	}
+}
+
+// configDiff returns a human readable summary of changes between files of two
+// config ConfigMaps. Properties of site XML files are compared by name, other
+// files line by line.
+func configDiff(hb *hbasev1.HBase, old, new map[string]string) []string {
+	files := make([]string, 0, len(old)+len(new))
+	for f := range old {
+		files = append(files, f)
+	}
+	for f := range new {
+		if _, ok := old[f]; !ok {
+			files = append(files, f)
+		}
+	}
+	sort.Strings(files)
+
+	var diff []string
+	for _, f := range files {
+		o, inOld := old[f]
+		n, inNew := new[f]
+		switch {
+		case !inOld:
+			diff = append(diff, fmt.Sprintf("%s: added", f))
+		case !inNew:
+			diff = append(diff, fmt.Sprintf("%s: removed", f))
+		case o == n:
+		case strings.HasSuffix(f, "-site.xml"):
+			diff = append(diff, propertiesDiff(hb, f, o, n)...)
+		default:
+			diff = append(diff, linesDiff(hb, f, o, n)...)
+		}
+	}
+	if len(diff) > configDiffLimit {
+		more := len(diff) - configDiffLimit
+		diff = append(diff[:configDiffLimit], fmt.Sprintf("... and %d more changes", more))
+	}
+	return diff
+}
+
+// propertiesDiff returns changes of properties of a site XML file
+func propertiesDiff(hb *hbasev1.HBase, file, old, new string) []string {
+	oldProps, err := parseSiteXML(old)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: changed", file)}
+	}
+	newProps, err := parseSiteXML(new)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: changed", file)}
+	}
+	value := func(name, v string) string {
+		if sensitiveProperty(hb, name) {
+			return maskedValue
+		}
+		return fmt.Sprintf("%q", v)
+	}
+	var diff []string
+	for _, name := range changedPropertyNames(oldProps, newProps) {
+		ov, inOld := oldProps[name]
+		nv, inNew := newProps[name]
+		switch {
+		case !inOld:
+			diff = append(diff, fmt.Sprintf("%s: +%s=%s", file, name, value(name, nv)))
+		case !inNew:
+			diff = append(diff, fmt.Sprintf("%s: -%s", file, name))
+		default:
+			diff = append(diff, fmt.Sprintf("%s: %s: %s -> %s", file, name, value(name, ov), value(name, nv)))
+		}
+	}
+	return diff
+}
+
+// changedPropertyNames returns sorted names of properties that differ
+func changedPropertyNames(old, new map[string]string) []string {
+	var changed []string
+	for k, v := range new {
+		if ov, ok := old[k]; !ok || ov != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range old {
+		if _, ok := new[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// linesDiff returns lines removed from and added to a file. Lines are matched
+// by their longest common subsequence after common leading and trailing lines
+// are skipped. If too many lines are left, the file is reported as changed.
+func linesDiff(hb *hbasev1.HBase, file, old, new string) []string {
+	a, b := splitLines(old), splitLines(new)
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+	if len(a)+len(b) > linesDiffLimit {
+		return []string{fmt.Sprintf("%s: changed", file)}
+	}
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	line := func(op, l string) string {
+		if sensitiveLine(hb, l) {
+			l = maskedValue
+		}
+		return fmt.Sprintf("%s: %s%s", file, op, l)
+	}
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			diff = append(diff, line("-", a[i]))
+			i++
+		default:
+			diff = append(diff, line("+", b[j]))
+			j++
+		}
+	}
+	return diff
+}
+
+// diffSummary returns the first changes of the config diff for events
+func diffSummary(diff []string) string {
+	if len(diff) <= eventDiffLimit {
+		return strings.Join(diff, "; ")
+	}
+	return fmt.Sprintf("%s; and %d more changes, see status.configUpdates",
+		strings.Join(diff[:eventDiffLimit], "; "), len(diff)-eventDiffLimit)
+}
+
+// configUpdate returns the last config update of the role
+func configUpdate(hb *hbasev1.HBase, role string) *hbasev1.ConfigUpdateStatus {
+	for i := range hb.Status.ConfigUpdates {
+		if hb.Status.ConfigUpdates[i].Role == role {
+			return &hb.Status.ConfigUpdates[i]
+		}
+	}
+	return nil
+}
+
+// setConfigUpdate replaces the last config update of the role
+func setConfigUpdate(hb *hbasev1.HBase, u hbasev1.ConfigUpdateStatus) {
+	if prev := configUpdate(hb, u.Role); prev != nil {
+		*prev = u
+		return
+	}
+	hb.Status.ConfigUpdates = append(hb.Status.ConfigUpdates, u)
+	sort.Slice(hb.Status.ConfigUpdates, func(i, j int) bool {
+		return hb.Status.ConfigUpdates[i].Role < hb.Status.ConfigUpdates[j].Role
+	})
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// previousConfigMap returns the config ConfigMap the StatefulSet of the role
+// currently uses. It returns nil if there is none.
+func (r *HBaseReconciler) previousConfigMap(ctx context.Context, hb *hbasev1.HBase,
+	role string) (*corev1.ConfigMap, error) {
+	sts := &appsv1.StatefulSet{}
+	if err := r.Get(ctx, types.NamespacedName{Name: role, Namespace: hb.Namespace}, sts); err != nil {
+		if errors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	i := slices.IndexFunc(sts.Spec.Template.Spec.Volumes, func(v corev1.Volume) bool { return v.Name == configVolumeName })
+	if i < 0 {
+		return nil, nil
+	}
+	for _, name := range volumeConfigMaps(sts.Spec.Template.Spec.Volumes[i]) {
+		cm := &corev1.ConfigMap{}
+		if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: hb.Namespace}, cm); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		return cm, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,190 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestConfigDiff(t *testing.T) {
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{Config: hbasev1.ConfigMap{
+		SensitiveProperties: []string{"hbase.custom.token"},
+	}}}
+	old := map[string]string{
+		hbaseSiteFile: siteXML("hbase.rootdir", "hdfs://old", "hbase.regionserver.handler.count", "30",
+			"hbase.ssl.keystore.password", "old", "hbase.custom.token", "old"),
+		"hbase-env.sh":      "export A=1\nexport B=2\nexport DB_PASSWORD=old\n",
+		"log4j.properties":  "log4j.rootLogger=INFO",
+		"hadoop-metrics.sh": "x",
+	}
+	new := map[string]string{
+		hbaseSiteFile: siteXML("hbase.rootdir", "hdfs://new", "hbase.master.port", "16000",
+			"hbase.ssl.keystore.password", "new", "hbase.custom.token", "new"),
+		"hbase-env.sh":     "export A=1\nexport B=3\nexport DB_PASSWORD=new\nexport C=4\n",
+		"log4j.properties": "log4j.rootLogger=INFO",
+		"jaas.conf":        "secret",
+	}
+	expected := []string{
+		"hadoop-metrics.sh: removed",
+		"hbase-env.sh: -export B=2",
+		"hbase-env.sh: -<masked>",
+		"hbase-env.sh: +export B=3",
+		"hbase-env.sh: +<masked>",
+		"hbase-env.sh: +export C=4",
+		`hbase-site.xml: hbase.custom.token: <masked> -> <masked>`,
+		`hbase-site.xml: +hbase.master.port="16000"`,
+		`hbase-site.xml: -hbase.regionserver.handler.count`,
+		`hbase-site.xml: hbase.rootdir: "hdfs://old" -> "hdfs://new"`,
+		`hbase-site.xml: hbase.ssl.keystore.password: <masked> -> <masked>`,
+		"jaas.conf: added",
+	}
+	if diff := configDiff(hb, old, new); !slices.Equal(diff, expected) {
+		t.Errorf("unexpected diff:\n%s", strings.Join(diff, "\n"))
+	}
+
+	var lines []string
+	for i := 0; i < configDiffLimit+5; i++ {
+		lines = append(lines, fmt.Sprintf("export V%d=1", i))
+	}
+	diff := configDiff(hb, nil, nil)
+	if len(diff) != 0 {
+		t.Errorf("expected no diff: %v", diff)
+	}
+	diff = configDiff(hb, map[string]string{"a": ""}, map[string]string{"a": strings.Join(lines, "\n")})
+	if len(diff) != configDiffLimit+1 || diff[configDiffLimit] != "... and 5 more changes" {
+		t.Errorf("expected diff to be limited: %v", diff)
+	}
+
+	// events carry the first changes only, the status has all of them
+	if s := diffSummary(diff[:2]); s != "a: +export V0=1; a: +export V1=1" {
+		t.Errorf("unexpected summary: %s", s)
+	}
+	if s := diffSummary(diff); s != "a: +export V0=1; a: +export V1=1; a: +export V2=1; "+
+		"and 28 more changes, see status.configUpdates" {
+		t.Errorf("expected summary to be limited: %s", s)
+	}
+}
+
+func TestSensitive(t *testing.T) {
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{Config: hbasev1.ConfigMap{
+		SensitiveProperties: []string{"HBase.Custom.Token"},
+	}}}
+	for _, test := range []struct {
+		name     string
+		property bool
+		line     bool
+	}{
+		{name: "hbase.custom.token", property: true, line: true},
+		{name: "HBASE.CUSTOM.TOKEN", property: true, line: true},
+		{name: "hbase.custom.token.ttl", property: false, line: false},
+		{name: "my.hbase.custom.token", property: false, line: false},
+		{name: "hbase.ssl.keystore.Password", property: true, line: true},
+		{name: "HBASE_SECRET", property: true, line: true},
+		{name: "hbase.rootdir", property: false, line: false},
+	} {
+		if got := sensitiveProperty(hb, test.name); got != test.property {
+			t.Errorf("expected property %q to be sensitive %v, got %v", test.name, test.property, got)
+		}
+		if line := "-D" + test.name + "=x"; sensitiveLine(hb, line) != test.line {
+			t.Errorf("expected line %q to be sensitive %v", line, test.line)
+		}
+	}
+	if !sensitiveLine(hb, "hbase.rootdir=x hbase.custom.token=y") {
+		t.Error("expected line mentioning the property later to be sensitive")
+	}
+}
+
+func TestLinesDiffLimit(t *testing.T) {
+	hb := &hbasev1.HBase{}
+	var old, new []string
+	for i := 0; i < 5000; i++ {
+		old = append(old, fmt.Sprintf("line %d", i))
+		new = append(new, fmt.Sprintf("line %d", i))
+	}
+	// common lines around a change aren't diffed
+	new[2500] = "changed"
+	diff := linesDiff(hb, "a", strings.Join(old, "\n"), strings.Join(new, "\n"))
+	if !slices.Equal(diff, []string{"a: -line 2500", "a: +changed"}) {
+		t.Errorf("unexpected diff: %v", diff)
+	}
+
+	// large changes are reported as the file changed
+	for i := range new {
+		new[i] = fmt.Sprintf("new %d", i)
+	}
+	diff = linesDiff(hb, "a", strings.Join(old, "\n"), strings.Join(new, "\n"))
+	if !slices.Equal(diff, []string{"a: changed"}) {
+		t.Errorf("expected file to be reported as changed: %v", diff)
+	}
+}
+
+func TestEnsureConfigMapDiff(t *testing.T) {
+	ctx := context.Background()
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{Config: hbasev1.ConfigMap{
+		Data: map[string]string{hbaseSiteFile: siteXML("hbase.rootdir", "hdfs://old")},
+	}}}
+	r := newHistoryTestReconciler(t, hb)
+	recorder := record.NewFakeRecorder(10)
+	r.Recorder = recorder
+
+	oldName := rsConfigMapName(hb)
+	if _, err := r.ensureConfigMap(hb, oldName, "regionserver", hb.Spec.Config.Data); err != nil {
+		t.Fatal(err)
+	}
+	if u := configUpdate(hb, "regionserver"); u == nil || u.Previous != "" || len(u.Diff) != 0 {
+		t.Fatalf("unexpected config update without StatefulSet: %+v", u)
+	}
+	if len(recorder.Events) != 0 {
+		t.Fatalf("unexpected event: %s", <-recorder.Events)
+	}
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "regionserver", Namespace: hb.Namespace},
+		Spec: appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Volumes: []corev1.Volume{configVolume(hb, oldName)},
+		}}},
+	}
+	if err := r.Create(ctx, sts); err != nil {
+		t.Fatal(err)
+	}
+
+	hb.Spec.Config.Data = map[string]string{hbaseSiteFile: siteXML("hbase.rootdir", "hdfs://new")}
+	name := rsConfigMapName(hb)
+	if _, err := r.ensureConfigMap(hb, name, "regionserver", hb.Spec.Config.Data); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{`hbase-site.xml: hbase.rootdir: "hdfs://old" -> "hdfs://new"`}
+	u := configUpdate(hb, "regionserver")
+	if u == nil || u.ConfigMap != name.Name || u.Previous != oldName.Name || !slices.Equal(u.Diff, expected) {
+		t.Fatalf("unexpected config update: %+v", u)
+	}
+	select {
+	case e := <-recorder.Events:
+		if !strings.Contains(e, "ConfigChanged") || !strings.Contains(e, expected[0]) {
+			t.Errorf("unexpected event: %s", e)
+		}
+	default:
+		t.Error("expected ConfigChanged event")
+	}
+}
@@ -21,19 +21,26 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"hash"
+	"math"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/prometheus/client_golang/prometheus"
 	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
 	"github.com/tsuna/gohbase/hrpc"
+	"github.com/tsuna/gohbase/pb"
+	"golang.org/x/time/rate"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/utils/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
@@ -57,12 +64,21 @@ const (
 	headlessServiceName = "hbase"
 )
 
-func (r *HBaseReconciler) ensureConfigMap(hb *hbasev1.HBase, name types.NamespacedName) (bool, error) {
+func (r *HBaseReconciler) ensureConfigMap(hb *hbasev1.HBase, name types.NamespacedName,
+	role string, data map[string]string) (bool, error) {
 	configMap := &corev1.ConfigMap{}
 	if err := r.Get(context.TODO(), name, configMap); err != nil {
 		if errors.IsNotFound(err) {
+			if configRevision(hb, role) != "" {
+				return false, fmt.Errorf("config revision %q is not found", name.Name)
+			}
+			prev, err := r.previousConfigMap(context.TODO(), hb, role)
+			if err != nil {
+				r.Log.Error(err, "failed getting previous config map")
+				return false, err
+			}
 			// deploy the configmap
-			cm, err := r.configMap(hb, name)
+			cm, err := r.configMap(hb, name, role, data)
 			if err != nil {
 				r.Log.Error(err, "failed generating config map")
 				return false, err
@@ -72,11 +88,28 @@ func (r *HBaseReconciler) ensureConfigMap(hb *hbasev1.HBase, name types.Namespac
 				return false, err
 			}
 			r.Log.Info("created HBase ConfigMap", "configmap", name)
+			update := hbasev1.ConfigUpdateStatus{
+				Role:      role,
+				ConfigMap: name.Name,
+				Path:      hbasev1.ConfigUpdateRestart,
+				Time:      metav1.Now(),
+			}
+			if prev != nil {
+				update.Previous = prev.Name
+				update.Diff = configDiff(hb, prev.Data, data)
+				r.Recorder.Eventf(hb, corev1.EventTypeNormal, "ConfigChanged",
+					"Changed config from ConfigMap %s to %s: %s", prev.Name, name.Name,
+					diffSummary(update.Diff))
+			}
+			setConfigUpdate(hb, update)
 			return false, nil
 		}
 		r.Log.Error(err, "failed getting config map")
 		return false, err
 	}
+	if hb.Spec.Config.Reload != nil && configRevision(hb, role) == "" {
+		return r.reloadConfigMap(context.TODO(), hb, configMap, data)
+	}
 	return true, nil
 }
 
@@ -103,8 +136,16 @@ func (r *HBaseReconciler) ensureService(hb *hbasev1.HBase) (bool, error) {
 	return true, nil
 }
 
+// configMapCreated returns the time the config ConfigMap was created at
+func configMapCreated(cm *corev1.ConfigMap) time.Time {
+	if t, err := time.Parse(time.RFC3339, cm.Annotations[HBaseControllerCreatedKey]); err == nil {
+		return t
+	}
+	return cm.CreationTimestamp.Time
+}
+
 func (r *HBaseReconciler) deleteUnusedConfigMaps(ctx context.Context, hb *hbasev1.HBase,
-	cmName types.NamespacedName) error {
+	cmNames ...types.NamespacedName) error {
 	// clean up unused configmaps
 	configMapList := &corev1.ConfigMapList{}
 	listOpts := []client.ListOption{
@@ -115,42 +156,124 @@ func (r *HBaseReconciler) deleteUnusedConfigMaps(ctx context.Context, hb *hbasev
 		return err
 	}
 
+	// keep configmaps of revisions in history to be able to roll back
+	keep, err := r.historyConfigMaps(ctx, hb)
+	if err != nil {
+		return err
+	}
+	for _, name := range cmNames {
+		keep[name.Name] = true
+	}
+	// and the most recent ones of each role
+	sort.Slice(configMapList.Items, func(i, j int) bool {
+		return configMapCreated(&configMapList.Items[i]).After(configMapCreated(&configMapList.Items[j]))
+	})
+	kept := map[string]int{}
 	for _, cm := range configMapList.Items {
-		if cm.Name != cmName.Name {
-			r.Log.Info("deleting unused ConfigMap", "name", cm.Name)
-			if err := r.Delete(ctx, &cm); err != nil {
-				return err
-			}
+		if keep[cm.Name] {
+			continue
+		}
+		role := cm.Labels[HBaseControllerNameKey]
+		if kept[role] < revisionHistoryLimit(hb) {
+			kept[role]++
+			continue
+		}
+		r.Log.Info("deleting unused ConfigMap", "name", cm.Name)
+		if err := r.Delete(ctx, &cm); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (r *HBaseReconciler) getRegionsPerRegionServer(_ context.Context) (map[string][][]byte, error) {
+const (
+	// metaEncodedRegionName is the encoded name of the hbase:meta region.
+	metaEncodedRegionName = "1588230740"
+)
+
+var metaRegionPrefix = []byte("hbase:meta")
+
+// serverName returns server name in format <host>,<port>,<startcode>
+func serverName(s *pb.ServerName) string {
+	return fmt.Sprintf("%s,%d,%d", s.GetHostName(), s.GetPort(), s.GetStartCode())
+}
+
+// isPodServer returns true if the server name belongs to the pod.
+func isPodServer(p *corev1.Pod, sn string) bool {
+	return strings.HasPrefix(sn, p.Name+".")
+}
+
+// encodedRegionName returns encoded name of the region from its full region name
+// in format <table>,<start key>,<region id>.<encoded name>.
+func encodedRegionName(rl *pb.RegionLoad) []byte {
+	rn := rl.GetRegionSpecifier().GetValue()
+	return rn[len(rn)-33 : len(rn)-1]
+}
+
+func encodedRegionNames(rls []*pb.RegionLoad) []string {
+	var names []string
+	for _, rl := range rls {
+		names = append(names, string(encodedRegionName(rl)))
+	}
+	return names
+}
+
+// getRegionsPerRegionServer returns loads of regions per regionserver
+// and the name of the regionserver that carries hbase:meta. The hbase:meta region
+// is not included in the regions of the regionserver.
+func (r *HBaseReconciler) getRegionsPerRegionServer(_ context.Context) (map[string][]*pb.RegionLoad, string, error) {
 	// get regions via cluster status because this way we can get
 	// regionservers that don't have any regions
 	cs, err := r.GhAdmin.ClusterStatus()
 	if err != nil {
-		return nil, fmt.Errorf("getting cluster status: %w", err)
+		return nil, "", fmt.Errorf("getting cluster status: %w", err)
 	}
 
 	// if some fields are nil, just let it panic as it's not expected
 	// and we won't be able to recover from that anyway
-	result := map[string][][]byte{}
+	var metaServer string
+	result := map[string][]*pb.RegionLoad{}
 	for _, s := range cs.GetLiveServers() {
-		sn := fmt.Sprintf("%s,%d,%d", s.Server.GetHostName(),
-			s.Server.GetPort(), s.Server.GetStartCode())
-		result[sn] = [][]byte{} // add even if there are no regions
+		sn := serverName(s.GetServer())
+		result[sn] = []*pb.RegionLoad{} // add even if there are no regions
 		for _, r := range s.GetServerLoad().GetRegionLoads() {
-			rn := r.GetRegionSpecifier().GetValue()
-			if bytes.HasPrefix(rn, []byte("hbase:meta")) {
+			if bytes.HasPrefix(r.GetRegionSpecifier().GetValue(), metaRegionPrefix) {
+				metaServer = sn
 				continue
 			}
-			rn = rn[len(rn)-33 : len(rn)-1]
-			result[sn] = append(result[sn], rn)
+			result[sn] = append(result[sn], r)
 		}
 	}
-	return result, nil
+	return result, metaServer, nil
+}
+
+// targetSelector picks regionservers to move regions to.
+// Implementations have to be safe for concurrent use.
+type targetSelector interface {
+	// Len returns number of targets
+	Len() int
+	// next returns the regionserver to move the region to and accounts for the
+	// region being moved to it. Returns empty string if there are no targets.
+	next(region *pb.RegionLoad) string
+}
+
+// newTargetSelector returns target selector for the strategy given
+// regions per up-to-date regionserver and request rates of regions.
+func newTargetSelector(strategy hbasev1.TargetSelectionStrategy,
+	targets map[string][]*pb.RegionLoad, rates map[string]float64) targetSelector {
+	switch strategy {
+	case hbasev1.WeightedTargetSelection:
+		return newWeightedTargets(targets, rates)
+	default:
+		var rst regionServerTargets
+		for rs, regions := range targets {
+			rst = append(rst, &rsCount{
+				serverName:  rs,
+				regionCount: len(regions),
+			})
+		}
+		return newRegionMoveTargets(rst)
+	}
 }
 
 type rsCount struct {
@@ -184,112 +307,716 @@ func (rst *regionServerTargets) Pop() interface{} {
 	return item
 }
 
-// TODO: make parallel
-func (r *HBaseReconciler) moveRegions(ctx context.Context, regions [][]byte, targets regionServerTargets) error {
+// regionMoveTargets picks regionserver with least regions as a target.
+type regionMoveTargets struct {
+	mu      sync.Mutex
+	targets regionServerTargets
+}
+
+func newRegionMoveTargets(targets regionServerTargets) *regionMoveTargets {
+	heap.Init(&targets)
+	return &regionMoveTargets{targets: targets}
+}
+
+// Len returns number of targets
+func (t *regionMoveTargets) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.targets.Len()
+}
+
+// next returns the regionserver with least regions
+func (t *regionMoveTargets) next(_ *pb.RegionLoad) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.targets.Len() == 0 {
+		return ""
+	}
+	rc := heap.Pop(&t.targets).(*rsCount)
+	// update the count and add it back to priority heap
+	rc.regionCount++
+	heap.Push(&t.targets, rc)
+	return rc.serverName
+}
+
+// rsLoad is the load of a regionserver as seen by weightedTargets
+type rsLoad struct {
+	serverName  string
+	regionCount float64
+	storefileMB float64
+	// requestRate is requests per second
+	requestRate float64
+	// localMB is the size of storefiles local to the regionserver
+	localMB float64
+}
+
+func (l *rsLoad) add(rl *pb.RegionLoad, locality, requestRate float64) {
+	size := float64(rl.GetStorefileSize_MB())
+	l.regionCount++
+	l.storefileMB += size
+	l.requestRate += requestRate
+	l.localMB += size * locality
+}
+
+func (l *rsLoad) locality() float64 {
+	if l.storefileMB == 0 {
+		return 1
+	}
+	return l.localMB / l.storefileMB
+}
+
+// weightedTargets picks regionserver with the lowest score that weighs region count,
+// size of storefiles, request rate and data locality. Each of the first three is
+// relative to the average across the targets, so they contribute equally.
+// Moved regions are not local on their new regionserver, so spreading them
+// keeps data locality of the regionservers even until major compactions
+// restore it.
+type weightedTargets struct {
+	mu      sync.Mutex
+	targets []*rsLoad
+	// rates are request rates per encoded region name
+	rates map[string]float64
+	// averages per target
+	avgCount, avgMB, avgRate float64
+}
+
+func newWeightedTargets(targets map[string][]*pb.RegionLoad, rates map[string]float64) *weightedTargets {
+	wt := &weightedTargets{rates: rates}
+	for rs, regions := range targets {
+		l := &rsLoad{serverName: rs}
+		for _, rl := range regions {
+			l.add(rl, float64(rl.GetDataLocality()), wt.rate(rl))
+		}
+		wt.targets = append(wt.targets, l)
+		wt.avgCount += l.regionCount
+		wt.avgMB += l.storefileMB
+		wt.avgRate += l.requestRate
+	}
+	// make selection deterministic for equal scores
+	sort.Slice(wt.targets, func(i, j int) bool {
+		return wt.targets[i].serverName < wt.targets[j].serverName
+	})
+	if n := float64(len(wt.targets)); n > 0 {
+		wt.avgCount = math.Max(wt.avgCount/n, 1)
+		wt.avgMB = math.Max(wt.avgMB/n, 1)
+		wt.avgRate = math.Max(wt.avgRate/n, 1)
+	}
+	return wt
+}
+
+// rate returns the request rate of the region, hbase:meta that's moved
+// explicitly doesn't come with its region name
+func (wt *weightedTargets) rate(rl *pb.RegionLoad) float64 {
+	if rl.GetRegionSpecifier() == nil {
+		return 0
+	}
+	return wt.rates[string(encodedRegionName(rl))]
+}
+
+// Len returns number of targets
+func (wt *weightedTargets) Len() int {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	return len(wt.targets)
+}
+
+func (wt *weightedTargets) score(l *rsLoad) float64 {
+	return l.regionCount/wt.avgCount +
+		l.storefileMB/wt.avgMB +
+		l.requestRate/wt.avgRate +
+		(1 - l.locality())
+}
+
+// next returns the regionserver with the lowest score
+func (wt *weightedTargets) next(region *pb.RegionLoad) string {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	var best *rsLoad
+	var bestScore float64
+	for _, l := range wt.targets {
+		if s := wt.score(l); best == nil || s < bestScore {
+			best, bestScore = l, s
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	best.add(region, 0, wt.rate(region))
+	return best.serverName
+}
+
+// moveRegions moves regions concurrently to targets with concurrency and rate
+// limited by drain spec of the cluster.
+func (r *HBaseReconciler) moveRegions(ctx context.Context, hb *hbasev1.HBase, regions []*pb.RegionLoad,
+	targets targetSelector) error {
+	concurrency := int(hb.Spec.Drain.Concurrency)
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	limiter := rate.NewLimiter(rate.Inf, 0)
+	if hb.Spec.Drain.MovesPerSecond > 0 {
+		limiter = rate.NewLimiter(rate.Limit(hb.Spec.Drain.MovesPerSecond), 1)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	ch := make(chan *pb.RegionLoad)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for region := range ch {
+				err := limiter.Wait(ctx)
+				if err == nil {
+					err = r.moveRegion(ctx, hb, region, targets)
+				}
+				if err != nil {
+					errOnce.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+feed:
+	for _, region := range regions {
+		select {
+		case ch <- region:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(ch)
+	wg.Wait()
+	return firstErr
+}
+
+func (r *HBaseReconciler) moveRegion(ctx context.Context, hb *hbasev1.HBase, rl *pb.RegionLoad,
+	targets targetSelector) error {
 	// important to understand that this heuristic to decide which regionserver to move
 	// to does not account for the most recent state of the cluster. For example, if some
 	// regionserver were to be restarted during region moving, the region counts will not be updated.
+	region := encodedRegionName(rl)
+	var mr *hrpc.MoveRegion
 	var err error
-	for _, region := range regions {
-		var mr *hrpc.MoveRegion
-		if targets.Len() > 0 {
-			// get the regionserver with least regions
-			rc := heap.Pop(&targets).(*rsCount)
-			r.Log.Info("moving regions to regionserver with least regions", "region", string(region),
-				"target", rc.serverName,
-				"current_count", rc.regionCount)
-			mr, err = hrpc.NewMoveRegion(ctx, region, hrpc.WithDestinationRegionServer(rc.serverName))
-
-			// update the count and add it back to priority heap
-			rc.regionCount++
-			heap.Push(&targets, rc)
-		} else {
-			// moving regions without a particular target - this is not an error case and guaranteed
-			// to hit when draining the first regionserver in the cluster
-			r.Log.Info(
-				"regionservers are balanced; moving regions without particular regionserver target",
-				"region", string(region),
-			)
-			mr, err = hrpc.NewMoveRegion(ctx, region)
-		}
-		if err != nil {
-			return fmt.Errorf("creating request to move region %q: %w", region, err)
-		}
-		if err := r.GhAdmin.MoveRegion(mr); err != nil {
-			if strings.Contains(err.Error(), "DoNotRetryIOException") {
-				// means the region is not open
-				continue
-			}
-			return fmt.Errorf("moving region %q: %w", region, err)
+	if target := targets.next(rl); target != "" {
+		r.Log.Info("moving region to regionserver", "region", string(region),
+			"target", target)
+		mr, err = hrpc.NewMoveRegion(ctx, region, hrpc.WithDestinationRegionServer(target))
+	} else {
+		// moving regions without a particular target - this is not an error case and guaranteed
+		// to hit when draining the first regionserver in the cluster
+		r.Log.Info(
+			"regionservers are balanced; moving regions without particular regionserver target",
+			"region", string(region),
+		)
+		mr, err = hrpc.NewMoveRegion(ctx, region)
+	}
+	if err != nil {
+		return fmt.Errorf("creating request to move region %q: %w", region, err)
+	}
+	start := time.Now()
+	err = r.GhAdmin.MoveRegion(mr)
+	hbaseRegionMoveDurationMetric.WithLabelValues(hb.Namespace, hb.Name).Observe(time.Since(start).Seconds())
+	if err != nil {
+		if strings.Contains(err.Error(), "DoNotRetryIOException") {
+			// means the region is not open
+			return nil
 		}
+		hbaseRegionMoveFailuresMetric.WithLabelValues(hb.Namespace, hb.Name).Inc()
+		return fmt.Errorf("moving region %q: %w", region, err)
 	}
 	return nil
 }
 
-func (r *HBaseReconciler) pickRegionServerToDelete(ctx context.Context, td, utd []*corev1.Pod) (*corev1.Pod, error) {
-	if len(td) == 0 {
-		// make sure the balancer is on
-		sb, err := hrpc.NewSetBalancer(ctx, true)
+func (r *HBaseReconciler) pickRegionServerToDelete(ctx context.Context, hb *hbasev1.HBase,
+	td, utd []*corev1.Pod) ([]*corev1.Pod, bool, error) {
+	if len(hb.Status.DrainedRegionServers) > 0 {
+		rrs, _, err := r.getRegionsPerRegionServer(ctx)
 		if err != nil {
-			return nil, err
+			return nil, false, fmt.Errorf("failed to get regions per regionservers: %w", err)
 		}
-		_, err = r.GhAdmin.SetBalancer(sb)
+		waiting, err := r.restoreRegions(ctx, hb, rrs, td, utd)
 		if err != nil {
-			return nil, err
+			return nil, false, err
+		}
+		if waiting {
+			r.blocked(hb, hbasev1.StepDrain, "", "waiting to move regions back to restarted RegionServers")
+			return nil, false, nil
+		}
+		r.unblocked(hb, hbasev1.StepDrain, "")
+	}
+
+	if len(td) == 0 {
+		if err := r.ensureBalancer(ctx, hb); err != nil {
+			return nil, false, fmt.Errorf("failed to set balancer: %w", err)
+		}
+		if err := r.ensureNormalizer(ctx, hb); err != nil {
+			return nil, false, fmt.Errorf("failed to set normalizer: %w", err)
 		}
-		return nil, nil
+		hb.Status.Drain = nil
+		return nil, true, nil
 	}
 
 	// make sure that balancer is off
 	sb, err := hrpc.NewSetBalancer(ctx, false)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
-	_, err = r.GhAdmin.SetBalancer(sb)
+	balancerEnabled, err := r.GhAdmin.SetBalancer(sb)
 	if err != nil {
-		return nil, err
+		return nil, false, err
+	}
+	if hb.Status.Drain != nil {
+		// the balancer was turned off by us, keep the state from before the rollout
+		balancerEnabled = hb.Status.Drain.BalancerEnabled
+	} else if err := r.recordBalancerState(ctx, hb, balancerEnabled); err != nil {
+		return nil, false, err
 	}
 
-	rrs, err := r.getRegionsPerRegionServer(ctx)
+	rrs, metaServer, err := r.getRegionsPerRegionServer(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get regions per regionservers: %w", err)
+		return nil, false, fmt.Errorf("failed to get regions per regionservers: %w", err)
+	}
+	rates := r.rates.update(client.ObjectKeyFromObject(hb), rrs, time.Now())
+	if metaServer == "" {
+		waiting, err := r.waitForMeta(hb)
+		if err != nil {
+			return nil, false, err
+		}
+		if waiting {
+			return nil, false, nil
+		}
+	} else {
+		r.unblocked(hb, hbasev1.StepRegionsInTransition, "hbase:meta")
+	}
+
+	var domains map[string]string
+	if t := hb.Spec.Rollout.Topology; t != nil {
+		if domains, err = r.podDomains(ctx, t.Key, td, utd); err != nil {
+			return nil, false, fmt.Errorf("failed to get failure domains of pods: %w", err)
+		}
+	}
+	limit, err := maxUnavailable(hb.Spec.RegionServerSpec)
+	if err != nil {
+		return nil, false, err
 	}
+	if t := hb.Spec.Rollout.Topology; t != nil && t.ParallelRestart && hb.Spec.RegionServerSpec.MaxUnavailable == nil {
+		// the whole domain is restarted at once unless limited explicitly
+		limit = math.MaxInt
+	}
+	td = orderRegionServers(hb, td, rrs, rates)
+	batch := pickRegionServerBatch(hb, td, utd, metaServer, domains, min(limit, canaryLimit(hb, utd)))
+	targets := drainTargets(hb, rrs, rates, batch, td, utd, domains)
 
-	// pick the first regionserver
-	p := td[0]
+	for _, p := range batch {
+		if !isPodServer(p, metaServer) {
+			continue
+		}
+		if targets.Len() == 0 {
+			// there is no regionserver to move hbase:meta to in advance, for example
+			// in a cluster of a single regionserver, so the master reassigns it
+			// once the regionserver is deleted
+			if !isDrainOf(hb.Status.Drain, batch) {
+				r.Log.Info("no target for hbase:meta, it's reassigned once RegionServer is deleted",
+					"regionserver", metaServer, "pod", p.Name)
+				r.Recorder.Eventf(hb, corev1.EventTypeWarning, "MetaMoveSkipped",
+					"No target to move hbase:meta off RegionServer %s to in advance", metaServer)
+			}
+			break
+		}
+		// move hbase:meta explicitly to an up-to-date regionserver before
+		// anything else and wait for it to be online at its new location
+		// in order to not stall the cluster on its reassignment
+		if err := r.recordDrain(ctx, hb, batch, rrs, balancerEnabled); err != nil {
+			return nil, false, err
+		}
+		if err := r.moveMeta(ctx, metaServer, targets); err != nil {
+			return nil, false, err
+		}
+		r.blocked(hb, hbasev1.StepDrain, sprintPodList(batch), "moving hbase:meta off RegionServer "+p.Name)
+		return nil, false, nil
+	}
 
-	// get regions to move and region count per up-to-date regionserver
-	// TODO: this is n^2 for the case all other regionservers are up-to-date
-	var toMove [][]byte
-	var source string
-	var targets regionServerTargets
+	// RegionServers of the batch are drained together and deleted together
+	drained, err := r.drainRegionServers(ctx, hb, batch, rrs, targets, balancerEnabled)
+	if err != nil || !drained {
+		return nil, false, err
+	}
+	return batch, false, nil
+}
+
+// maxUnavailable returns the number of pods of the server spec that are allowed
+// to be restarted together
+func maxUnavailable(ss hbasev1.ServerSpec) (int, error) {
+	if ss.MaxUnavailable == nil {
+		return 1, nil
+	}
+	n, err := intstr.GetScaledValueFromIntOrPercent(ss.MaxUnavailable, int(ss.Count), false)
+	if err != nil {
+		return 0, fmt.Errorf("invalid maxUnavailable: %w", err)
+	}
+	return max(n, 1), nil
+}
+
+// pickRegionServerBatch picks up to limit RegionServers to drain and restart together.
+// The RegionServer that carries hbase:meta is restarted last. With failure domains,
+// RegionServers are picked from a single domain.
+func pickRegionServerBatch(hb *hbasev1.HBase, td, utd []*corev1.Pod, metaServer string,
+	domains map[string]string, limit int) []*corev1.Pod {
+	candidates := td
+	if domains != nil {
+		domain := currentDomain(hb, td, utd, metaServer, domains)
+		candidates = podsInDomain(td, domain, domains)
+	}
+
+	batch := make([]*corev1.Pod, 0, len(candidates))
+	if d := hb.Status.Drain; d != nil {
+		// resume the drain that was in progress, for example
+		// before the operator was restarted
+		for _, rs := range d.RegionServers {
+			if pod := findPod(candidates, rs.Pod); pod != nil {
+				batch = append(batch, pod)
+			}
+		}
+	}
+	var meta *corev1.Pod
+	for _, pod := range candidates {
+		if slices.Contains(batch, pod) {
+			continue
+		}
+		if isPodServer(pod, metaServer) {
+			meta = pod
+			continue
+		}
+		batch = append(batch, pod)
+	}
+	if meta != nil {
+		batch = append(batch, meta)
+	}
+	return batch[:min(limit, len(batch))]
+}
+
+// podServer returns the name and regions of the RegionServer of the pod
+func podServer(p *corev1.Pod, rrs map[string][]*pb.RegionLoad) (string, []*pb.RegionLoad) {
 	for rs, regions := range rrs {
-		if strings.HasPrefix(rs, p.Name+".") {
-			// move regions
-			toMove = regions
-			source = rs
-		}
-		// check if this is one of the up-to-date regionservers
-		for _, up := range utd {
-			if strings.HasPrefix(rs, up.Name+".") {
-				targets = append(targets, &rsCount{
-					serverName:  rs,
-					regionCount: len(regions),
-				})
+		if isPodServer(p, rs) {
+			return rs, regions
+		}
+	}
+	return "", nil
+}
+
+// isDrainOf returns true if the drain is of the batch of RegionServers
+func isDrainOf(d *hbasev1.DrainStatus, batch []*corev1.Pod) bool {
+	if d == nil || len(d.RegionServers) != len(batch) {
+		return false
+	}
+	for _, rs := range d.RegionServers {
+		if findPod(batch, rs.Pod) == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// recordBalancerState records the state of the balancer from before the rollout
+// as soon as it's turned off, since the rollout may wait before anything is drained
+// and the balancer is already off on the next reconcile. If it can't be recorded,
+// the balancer is switched back.
+func (r *HBaseReconciler) recordBalancerState(ctx context.Context, hb *hbasev1.HBase, balancerEnabled bool) error {
+	hb.Status.Drain = &hbasev1.DrainStatus{
+		BalancerEnabled: balancerEnabled,
+		StartTime:       metav1.Now(),
+	}
+	err := r.Status().Update(ctx, hb)
+	if err == nil {
+		return nil
+	}
+	hb.Status.Drain = nil
+	if sb, serr := hrpc.NewSetBalancer(ctx, balancerEnabled); serr == nil {
+		if _, serr := r.GhAdmin.SetBalancer(sb); serr != nil {
+			r.Log.Error(serr, "failed to switch balancer back", "enabled", balancerEnabled)
+		}
+	}
+	return fmt.Errorf("failed to record balancer state: %w", err)
+}
+
+// recordDrain records the drain of the batch of RegionServers before moving
+// any regions in order to be able to resume it
+func (r *HBaseReconciler) recordDrain(ctx context.Context, hb *hbasev1.HBase, batch []*corev1.Pod,
+	rrs map[string][]*pb.RegionLoad, balancerEnabled bool) error {
+	d := hb.Status.Drain
+	if !isDrainOf(d, batch) {
+		d = &hbasev1.DrainStatus{
+			BalancerEnabled: balancerEnabled,
+			StartTime:       metav1.Now(),
+		}
+		hb.Status.Drain = d
+		hb.Status.FailedRegionMoves = nil
+		for _, p := range batch {
+			d.RegionServers = append(d.RegionServers, hbasev1.DrainingRegionServer{Pod: p.Name})
+			source, regions := podServer(p, rrs)
+			if !hb.Spec.Drain.RestoreRegions || source == "" {
+				continue
+			}
+			// remember regions in order to move them back once the regionserver is restarted
+			drained := hbasev1.DrainedRegionServer{
+				Pod:        p.Name,
+				ServerName: source,
+				Regions:    encodedRegionNames(regions),
+			}
+			hb.Status.DrainedRegionServers = append(
+				slices.DeleteFunc(hb.Status.DrainedRegionServers, func(d hbasev1.DrainedRegionServer) bool {
+					return d.Pod == p.Name
+				}), drained)
+		}
+	} else {
+		r.Log.Info("resuming drain of RegionServers", "pods", sprintPodList(batch), "started", d.StartTime)
+	}
+	updateDrainStatus(d, batch, rrs)
+	if err := r.Status().Update(ctx, hb); err != nil {
+		return fmt.Errorf("failed to record drain of RegionServers: %w", err)
+	}
+	return nil
+}
+
+// updateDrainStatus records regions left on RegionServers of the drain and
+// returns the number of them
+func updateDrainStatus(d *hbasev1.DrainStatus, batch []*corev1.Pod, rrs map[string][]*pb.RegionLoad) int {
+	var remaining int
+	for i := range d.RegionServers {
+		rs := &d.RegionServers[i]
+		source, regions := podServer(findPod(batch, rs.Pod), rrs)
+		if source != "" {
+			rs.ServerName = source
+		}
+		rs.RegionsRemaining = encodedRegionNames(regions)
+		remaining += len(regions)
+	}
+	return remaining
+}
+
+// drainRegionServers moves regions off RegionServers of the batch to targets. Regions
+// of all of them are moved together. It doesn't wait for regions to settle at their new
+// location, the drain is checked again on the next reconcile. It returns true once
+// the RegionServers can be deleted.
+func (r *HBaseReconciler) drainRegionServers(ctx context.Context, hb *hbasev1.HBase, batch []*corev1.Pod,
+	rrs map[string][]*pb.RegionLoad, targets targetSelector, balancerEnabled bool) (bool, error) {
+	if err := r.recordDrain(ctx, hb, batch, rrs, balancerEnabled); err != nil {
+		return false, err
+	}
+	object := sprintPodList(batch)
+	var toMove []*pb.RegionLoad
+	for _, p := range batch {
+		_, regions := podServer(p, rrs)
+		toMove = append(toMove, regions...)
+	}
+	if len(toMove) == 0 {
+		r.unblocked(hb, hbasev1.StepDrain, object)
+		return true, nil
+	}
+
+	d := hb.Status.Drain
+	if time.Since(d.StartTime.Time) >= stepDeadline(hb, hbasev1.StepDrain) {
+		if hb.Status.FailedRegionMoves == nil {
+			// report regions that are stuck once the deadline is crossed
+			for _, rs := range d.RegionServers {
+				if len(rs.RegionsRemaining) == 0 {
+					continue
+				}
+				r.Log.Info("drain of RegionServer timed out",
+					"regionserver", rs.ServerName, "pod", rs.Pod, "regions", rs.RegionsRemaining)
+				r.Recorder.Eventf(hb, corev1.EventTypeWarning, "RegionMoveFailed",
+					"Failed to move %d regions off RegionServer %s: %s", len(rs.RegionsRemaining),
+					rs.ServerName, strings.Join(rs.RegionsRemaining, ", "))
+			}
+		}
+		hb.Status.FailedRegionMoves = encodedRegionNames(toMove)
+		if hb.Spec.Drain.OnTimeout == hbasev1.ForceDrainTimeoutAction {
+			// delete the regionservers anyway, remaining regions
+			// will be reassigned by hbase once the regionservers are gone
+			r.Log.Info("drain of RegionServers timed out, deleting them anyway", "pods", object)
+			return true, nil
+		}
+	}
+
+	r.Log.Info("moving regions from RegionServers",
+		"pods", object, "count", len(toMove), "target_count", targets.Len())
+	if err := r.moveRegions(ctx, hb, toMove, targets); err != nil {
+		return false, err
+	}
+
+	// regions usually move quickly, so check right away instead of
+	// waiting for the next reconcile
+	rrs, _, err := r.getRegionsPerRegionServer(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get regions per regionservers: %w", err)
+	}
+	if remaining := updateDrainStatus(d, batch, rrs); remaining > 0 {
+		r.Log.Info("RegionServers still have regions", "pods", object, "count", remaining)
+		r.blockedSince(hb, hbasev1.StepDrain, object,
+			fmt.Sprintf("RegionServers have %d regions left", remaining), d.StartTime)
+		return false, nil
+	}
+	hb.Status.FailedRegionMoves = nil
+	r.unblocked(hb, hbasev1.StepDrain, object)
+	return true, nil
+}
+
+// restoreRegions moves regions back to the drained regionservers once they are
+// restarted and registered with the master. It returns true if it has to wait for
+// regionservers to come back or for moved regions to settle.
+func (r *HBaseReconciler) restoreRegions(ctx context.Context, hb *hbasev1.HBase,
+	rrs map[string][]*pb.RegionLoad, td, utd []*corev1.Pod) (bool, error) {
+	online := map[string]*pb.RegionLoad{}
+	for _, regions := range rrs {
+		for _, rl := range regions {
+			online[string(encodedRegionName(rl))] = rl
+		}
+	}
+
+	var pending []hbasev1.DrainedRegionServer
+	var waiting bool
+	for _, d := range hb.Status.DrainedRegionServers {
+		if findPod(utd, d.Pod) == nil {
+			if findPod(td, d.Pod) != nil {
+				// the pod hasn't been restarted yet
+				pending = append(pending, d)
+				continue
+			}
+			if ordinal, ok := podOrdinal(d.Pod); ok && ordinal < int(hb.Spec.RegionServerSpec.Count) {
+				// the pod is deleted and not recreated by the statefulset yet
+				r.Log.Info("waiting for RegionServer pod to be recreated to move regions back", "pod", d.Pod)
+				pending = append(pending, d)
+				waiting = true
+				continue
+			}
+			// the pod is gone due to scale down
+			r.Log.Info("RegionServer pod doesn't exist, not moving regions back", "pod", d.Pod)
+			continue
+		}
+		var target string
+		for sn := range rrs {
+			// restarted regionserver has a different startcode
+			if strings.HasPrefix(sn, d.Pod+".") && sn != d.ServerName {
+				target = sn
 				break
 			}
 		}
+		if target == "" {
+			r.Log.Info("waiting for restarted RegionServer to register to move regions back", "pod", d.Pod)
+			pending = append(pending, d)
+			waiting = true
+			continue
+		}
+
+		onTarget := map[string]struct{}{}
+		for _, rl := range rrs[target] {
+			onTarget[string(encodedRegionName(rl))] = struct{}{}
+		}
+		// regions could have been split or merged in the meantime, so
+		// move only those that are still online
+		var toMove []*pb.RegionLoad
+		for _, rn := range d.Regions {
+			if _, ok := onTarget[rn]; ok {
+				continue
+			}
+			if rl, ok := online[rn]; ok {
+				toMove = append(toMove, rl)
+			}
+		}
+		r.Log.Info("moving regions back to RegionServer",
+			"regionserver", target, "pod", d.Pod, "count", len(toMove))
+		if err := r.moveRegions(ctx, hb, toMove, fixedTarget(target)); err != nil {
+			return false, err
+		}
+		// wait for moved regions to settle before draining next regionserver
+		waiting = waiting || len(toMove) > 0
 	}
-	heap.Init(&targets)
+	hb.Status.DrainedRegionServers = pending
+	return waiting, nil
+}
 
-	r.Log.Info("moving regions from RegionServer",
-		"regionserver", source, "pod", p.Name, "count", len(toMove),
-		"target_count", targets.Len())
-	if err := r.moveRegions(ctx, toMove, targets); err != nil {
-		return nil, err
+// podOrdinal returns the ordinal of the statefulset pod, pods are named <sts name>-N
+func podOrdinal(name string) (int, bool) {
+	ordinal, err := strconv.Atoi(name[strings.LastIndex(name, "-")+1:])
+	return ordinal, err == nil
+}
+
+func findPod(pods []*corev1.Pod, name string) *corev1.Pod {
+	for _, p := range pods {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// fixedTarget is a target selector that always picks the same regionserver
+type fixedTarget string
+
+// Len returns number of targets
+func (t fixedTarget) Len() int { return 1 }
+
+func (t fixedTarget) next(_ *pb.RegionLoad) string { return string(t) }
+
+// moveMeta moves hbase:meta region to the up-to-date regionserver picked by targets
+func (r *HBaseReconciler) moveMeta(ctx context.Context, source string, targets targetSelector) error {
+	target := targets.next(&pb.RegionLoad{})
+	r.Log.Info("moving hbase:meta", "source", source, "target", target)
+	mr, err := hrpc.NewMoveRegion(ctx, []byte(metaEncodedRegionName),
+		hrpc.WithDestinationRegionServer(target))
+	if err != nil {
+		return fmt.Errorf("creating request to move hbase:meta: %w", err)
+	}
+	if err := r.GhAdmin.MoveRegion(mr); err != nil {
+		return fmt.Errorf("moving hbase:meta: %w", err)
 	}
+	return nil
+}
 
-	return p, nil
+// waitForMeta returns true if RegionServers can't be restarted because hbase:meta
+// isn't online on any of them. hbase:meta that isn't in transition is hosted
+// elsewhere, for example on the master, and doesn't hold up the rollout. Once
+// hbase:meta is in transition for longer than the RegionsInTransition deadline,
+// the rollout is marked stalled and proceeds anyway. Reconcile doesn't get here
+// while any region is in transition, so this only covers hbase:meta going into
+// transition between that check and listing regions of regionservers.
+func (r *HBaseReconciler) waitForMeta(hb *hbasev1.HBase) (bool, error) {
+	cs, err := r.GhAdmin.ClusterStatus()
+	if err != nil {
+		return false, err
+	}
+	if !slices.ContainsFunc(cs.GetRegionsInTransition(), isMetaInTransition) {
+		r.Log.Info("hbase:meta is not on any RegionServer, not waiting for it")
+		r.unblocked(hb, hbasev1.StepRegionsInTransition, "hbase:meta")
+		return false, nil
+	}
+	// hbase:meta is being reassigned, deleting any regionserver now
+	// would only prolong the time the cluster is unavailable
+	r.blocked(hb, hbasev1.StepRegionsInTransition, "hbase:meta", "hbase:meta is not online")
+	if hb.Status.Blocked.Stalled {
+		r.Log.Info("hbase:meta is still not online, proceeding with rollout")
+		return false, nil
+	}
+	r.Log.Info("hbase:meta is not online, waiting")
+	return true, nil
+}
+
+func isMetaInTransition(rit *pb.RegionInTransition) bool {
+	if bytes.HasPrefix(rit.GetSpec().GetValue(), metaRegionPrefix) {
+		return true
+	}
+	tn := rit.GetRegionState().GetRegionInfo().GetTableName()
+	return string(tn.GetNamespace()) == "hbase" && string(tn.GetQualifier()) == "meta"
 }
 
 // regionsInTransition returns the number of regions in transition
@@ -301,41 +1028,61 @@ func (r *HBaseReconciler) regionsInTransition() (int, error) {
 	return len(cs.GetRegionsInTransition()), nil
 }
 
-func (r *HBaseReconciler) pickMasterToDelete(ctx context.Context, td, utd []*corev1.Pod) (*corev1.Pod, error) {
+func (r *HBaseReconciler) pickMasterToDelete(ctx context.Context, hb *hbasev1.HBase,
+	td, utd []*corev1.Pod) ([]*corev1.Pod, bool, error) {
 	if len(td) == 0 {
-		return nil, nil
+		return nil, true, nil
+	}
+	limit, err := maxUnavailable(hb.Spec.MasterSpec)
+	if err != nil {
+		return nil, false, err
 	}
 
 	cs, err := r.GhAdmin.ClusterStatus()
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	// check if any of the pods to delete are backup masters
+	// check if any of the pods to delete are backup masters,
+	// up to maxUnavailable of them are deleted together
 	r.Log.Info("got backup masters", "masters", cs.GetBackupMasters())
+	var backups []*corev1.Pod
 	for _, p := range td {
 		for _, bm := range cs.GetBackupMasters() {
-			if strings.HasPrefix(bm.GetHostName(), p.Name+".") {
+			if strings.HasPrefix(bm.GetHostName(), p.Name+".") && len(backups) < limit {
 				// match, delete it
-				return p, nil
+				backups = append(backups, p)
 			}
 		}
 	}
+	if len(backups) > 0 {
+		return backups, false, nil
+	}
 	r.Log.Info("got active master", "master", cs.GetMaster())
 
 	// otherwise find the pod of the active master
 	for _, p := range td {
 		if strings.HasPrefix(cs.GetMaster().GetHostName(), p.Name+".") {
 			// match, delete it
-			return p, nil
+			return []*corev1.Pod{p}, false, nil
 		}
 	}
 	// the pods aren't active or backup master, return error
-	return nil, fmt.Errorf(
+	return nil, false, fmt.Errorf(
 		"no active or backup masters in the list of pods to delete: active %v, backup %v",
 		cs.GetMaster(), cs.GetBackupMasters())
 }
 
+// isPodReady returns true if the pod has the Ready condition
+func isPodReady(p *corev1.Pod) bool {
+	for _, c := range p.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
 func sprintPodList(l []*corev1.Pod) string {
 	podNames := make([]string, 0, len(l))
 	for _, p := range l {
@@ -356,8 +1103,14 @@ func orderPodListByName(pl *corev1.PodList) {
 	})
 }
 
-func (r *HBaseReconciler) ensureStatefulSetPods(ctx context.Context, sts *appsv1.StatefulSet,
-	pickToDelete func(ctx context.Context, td, utd []*corev1.Pod) (*corev1.Pod, error)) (bool, error) {
+// pickPodToDeleteFunc picks pods to delete together out of pods that are not up-to-date (td)
+// given pods that are up-to-date (utd). If no pods are returned, done tells whether
+// all pods are in the desired state or it has to wait.
+type pickPodToDeleteFunc func(ctx context.Context, hb *hbasev1.HBase,
+	td, utd []*corev1.Pod) (ps []*corev1.Pod, done bool, err error)
+
+func (r *HBaseReconciler) ensureStatefulSetPods(ctx context.Context, hb *hbasev1.HBase, sts *appsv1.StatefulSet,
+	pickToDelete pickPodToDeleteFunc) (bool, error) {
 	podList := &corev1.PodList{}
 	listOpts := []client.ListOption{
 		client.InNamespace(sts.Namespace),
@@ -371,7 +1124,7 @@ func (r *HBaseReconciler) ensureStatefulSetPods(ctx context.Context, sts *appsv1
 
 	orderPodListByName(podList)
 
-	// make sure that all pods are up by checking that all containers are ready.
+	// make sure that all pods are up by checking that they are ready.
 	// the loop exists if any pod is not ready.
 	var toDelete, upToDate []*corev1.Pod
 	for _, p := range podList.Items {
@@ -380,6 +1133,7 @@ func (r *HBaseReconciler) ensureStatefulSetPods(ctx context.Context, sts *appsv1
 			// if pod is already terminating, skip it
 			// wait for it to terminate
 			r.Log.Info("pod is terminating", "pod", p.Name)
+			r.blocked(hb, hbasev1.StepPodReady, p.Name, "pod is terminating")
 			return false, nil
 		}
 
@@ -390,21 +1144,24 @@ func (r *HBaseReconciler) ensureStatefulSetPods(ctx context.Context, sts *appsv1
 		}
 		isRecent := ssr == sts.Status.UpdateRevision
 
-		// check if all containers are ready.
-		for _, s := range p.Status.ContainerStatuses {
-			if s.Ready {
-				continue
-			}
+		// check if the pod is ready, a pod that is pending, for example
+		// unschedulable or with an image that can't be pulled, isn't.
+		if !isPodReady(&p) {
 			if isRecent {
 				// if revision matches, wait for pod to become ready.
 				// in case there's a misconfig, it will halt here and
 				// won't proceed restarting any other pods
 				r.Log.Info("pod is not ready", "name", p.Name)
+				r.blocked(hb, hbasev1.StepPodReady, p.Name, "pod is not ready")
+				r.rollbackIfFailed(hb, sts, &p)
 				return false, nil
 			}
 			// otherwise, the pod isn't ready and has old revision,
-			// we can remove it without hesitation
+			// we can remove it without hesitation. It doesn't serve,
+			// so it's replaced even outside of maintenance windows
+			// instead of staying down until the next window.
 			r.Log.Info("deleting pod", "name", p.Name)
+			r.progressed(hb)
 			return false, r.Delete(ctx, &p)
 		}
 
@@ -417,20 +1174,40 @@ func (r *HBaseReconciler) ensureStatefulSetPods(ctx context.Context, sts *appsv1
 		}
 	}
 
+	r.unblocked(hb, hbasev1.StepPodReady)
+
 	r.Log.Info("pick pod to delete", "StatefulSet", sts.Name, "pods", sprintPodList(toDelete))
 
-	// delete one pod at a time
-	p, err := pickToDelete(ctx, toDelete, upToDate)
+	// delete one pod, or a batch of pods, at a time
+	ps, done, err := pickToDelete(ctx, hb, toDelete, upToDate)
 	if err != nil {
 		r.Log.Error(err, "failed to pick pod to delete")
 		return false, fmt.Errorf("failed to pick pod to delete: %w", err)
 	}
-	if p != nil {
-		r.Log.Info("deleting pod", "name", p.Name)
-		return false, r.Delete(ctx, p)
+	if len(ps) > 0 {
+		r.progressed(hb)
+		for _, p := range ps {
+			r.Log.Info("deleting pod", "name", p.Name)
+			if err := r.Delete(ctx, p); err != nil {
+				return false, err
+			}
+		}
+		return false, nil
+	}
+	if !done {
+		r.Log.Info("waiting to delete pods", "StatefulSet", sts.Name)
+		// picks record what they wait on HBase for themselves
+		if waitingOnPolicy(hb) {
+			r.progressed(hb)
+		}
+		return false, nil
 	}
 
 	r.Log.Info("pods are up to date", "StatefulSet", sts.Name)
+	if hb.Status.StableRevisions == nil {
+		hb.Status.StableRevisions = map[string]string{}
+	}
+	hb.Status.StableRevisions[sts.Name] = sts.Annotations[HBaseControllerRevisionKey]
 	// all is perfect, ensured
 	return true, nil
 
@@ -440,6 +1217,16 @@ func (r *HBaseReconciler) ensureStatefulSet(hb *hbasev1.HBase,
 	stsName, cmName types.NamespacedName, ss hbasev1.ServerSpec) (*appsv1.StatefulSet, bool, error) {
 	actual := &appsv1.StatefulSet{}
 	expected, expectedRevision := r.statefulSet(hb, stsName, cmName, ss)
+	rolledBack, rolledBackRevision, err := r.rolledBackStatefulSet(context.TODO(), hb, stsName, ss)
+	if err != nil {
+		return nil, false, err
+	}
+	if rolledBack != nil {
+		expected, expectedRevision = rolledBack, rolledBackRevision
+	}
+	if err := r.recordRevision(context.TODO(), hb, expected, expectedRevision); err != nil {
+		return nil, false, fmt.Errorf("failed to record revision: %w", err)
+	}
 	if err := r.Get(context.TODO(), stsName, actual); err != nil {
 		if errors.IsNotFound(err) {
 
@@ -479,9 +1266,12 @@ func (r *HBaseReconciler) ensureStatefulSet(hb *hbasev1.HBase,
 	return actual, false, nil
 }
 
+// configVolumeName is the name of the config volume in pods
+const configVolumeName = "config"
+
 func configMapVolume(cmName types.NamespacedName) corev1.Volume {
 	return corev1.Volume{
-		Name: "config",
+		Name: configVolumeName,
 		VolumeSource: corev1.VolumeSource{
 			ConfigMap: &corev1.ConfigMapVolumeSource{
 				DefaultMode: ptr.To(int32(420)),
@@ -515,13 +1305,16 @@ const (
 var (
 	ignoreTemplateMetadataAnnotations = map[string]struct{}{
 		"kubectl.kubernetes.io/last-applied-configuration": {},
+		HBaseControllerMaintenanceOverrideKey:              {},
 	}
 )
 
 func (r *HBaseReconciler) statefulSet(hb *hbasev1.HBase,
 	stsName, cmName types.NamespacedName, ss hbasev1.ServerSpec) (*appsv1.StatefulSet, string) {
 	spec := (&ss.PodSpec).DeepCopy()
-	spec.Volumes = append(spec.Volumes, configMapVolume(cmName))
+	spec.Volumes = append(spec.Volumes, configVolume(hb, cmName))
+	r.kerberosPodSpec(hb, stsName.Name, spec)
+	tlsPodSpec(hb, stsName.Name, spec)
 
 	templateMetadataAnnotations := cloneMap(ss.Metadata.Annotations, hb.Annotations)
 	filteredTemplateMetadataAnnotations := make(map[string]string)
@@ -572,12 +1365,29 @@ func (r *HBaseReconciler) statefulSet(hb *hbasev1.HBase,
 	}, rev
 }
 
-func getConfigMapName(hb *hbasev1.HBase) types.NamespacedName {
+// getConfigMapName returns the name of the config ConfigMap of the role with
+// the data, which is the hash of the data and digests of Secret sources unless
+// a revision is pinned. Names include the role, so upgrading from versions that
+// named the shared ConfigMap "config-<hash>" restarts all pods once.
+func getConfigMapName(hb *hbasev1.HBase, role string, data, secrets map[string]string) types.NamespacedName {
+	if rev := configRevision(hb, role); rev != "" {
+		return types.NamespacedName{
+			Name:      rev,
+			Namespace: hb.Namespace,
+		}
+	}
 	h := sha256.New()
-	DeepHashObject(h, hb.Spec.Config.Data)
+	obj := configHashData(hb, data)
+	if len(secrets) > 0 {
+		obj = struct {
+			Data    interface{}
+			Secrets map[string]string
+		}{obj, secrets}
+	}
+	DeepHashObject(h, obj)
 	checksum := fmt.Sprintf("%x", h.Sum(nil))[:8]
 	return types.NamespacedName{
-		Name:      "config-" + checksum,
+		Name:      "config-" + role + "-" + checksum,
 		Namespace: hb.Namespace,
 	}
 }
@@ -586,17 +1396,32 @@ var configMapLabels = map[string]string{
 	"config": "core",
 }
 
-func (r *HBaseReconciler) configMap(hb *hbasev1.HBase,
-	name types.NamespacedName) (*corev1.ConfigMap, error) {
+const (
+	// HBaseControllerCreatedKey is the annotation of config ConfigMaps with the time
+	// they were created at in RFC 3339 format
+	HBaseControllerCreatedKey = "hbase-controller-created"
+	// HBaseControllerGenerationKey is the annotation of config ConfigMaps with
+	// the generation of HBase they were created for
+	HBaseControllerGenerationKey = "hbase-controller-generation"
+)
+
+func (r *HBaseReconciler) configMap(hb *hbasev1.HBase, name types.NamespacedName,
+	role string, data map[string]string) (*corev1.ConfigMap, error) {
 	cm := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:        name.Name,
-			Namespace:   name.Namespace,
-			Labels:      cloneMap(configMapLabels, hb.Labels),
-			Annotations: cloneMap(hb.Annotations),
+			Name:      name.Name,
+			Namespace: name.Namespace,
+			Labels: cloneMap(configMapLabels, map[string]string{
+				HBaseControllerNameKey: role,
+			}, hb.Labels),
+			Annotations: cloneMap(map[string]string{
+				HBaseControllerCreatedKey:    time.Now().UTC().Format(time.RFC3339),
+				HBaseControllerGenerationKey: strconv.FormatInt(hb.Generation, 10),
+			}, hb.Annotations),
 		},
-		Immutable: ptr.To(true),
-		Data:      hb.Spec.Config.Data,
+		// ConfigMaps are updated in place only to reload configuration
+		Immutable: ptr.To(hb.Spec.Config.Reload == nil),
+		Data:      data,
 	}
 	if err := controllerutil.SetControllerReference(hb, cm, r.Scheme); err != nil {
 		return nil, err
@@ -15,10 +15,30 @@ limitations under the License.
 package controller
 
 import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/go-logr/logr"
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	"github.com/tsuna/gohbase/hrpc"
+	"github.com/tsuna/gohbase/pb"
+	"github.com/tsuna/gohbase/test/mock"
+	"go.uber.org/mock/gomock"
+	"google.golang.org/protobuf/proto"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
 func TestOrderPodList(t *testing.T) {
@@ -98,3 +118,767 @@ func TestOrderPodList(t *testing.T) {
 		}
 	}
 }
+
+// fakeCluster keeps track of regions per regionserver pod and
+// applies region moves to them.
+type fakeCluster struct {
+	mu sync.Mutex
+	// servers is a map of regionserver pod name to region names it carries
+	servers map[string][]string
+	// stuck are regions that fail to move
+	stuck map[string]bool
+	// startCodes are startcodes of regionserver pods, 1 if not set
+	startCodes map[string]uint64
+	// moved are encoded names of moved regions
+	moved []string
+	// metaInTransition reports hbase:meta in transition
+	metaInTransition bool
+	// balancer is the state of the balancer
+	balancer bool
+}
+
+func (c *fakeCluster) clusterStatus() (*pb.ClusterStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cs := &pb.ClusterStatus{}
+	for pod, regions := range c.servers {
+		var rls []*pb.RegionLoad
+		for _, rn := range regions {
+			rls = append(rls, &pb.RegionLoad{
+				RegionSpecifier: &pb.RegionSpecifier{
+					Type:  pb.RegionSpecifier_REGION_NAME.Enum(),
+					Value: []byte(rn),
+				},
+			})
+		}
+		cs.LiveServers = append(cs.LiveServers, &pb.LiveServerInfo{
+			Server: &pb.ServerName{
+				HostName:  proto.String(pod + ".hbase"),
+				Port:      proto.Uint32(16020),
+				StartCode: proto.Uint64(max(c.startCodes[pod], 1)),
+			},
+			ServerLoad: &pb.ServerLoad{RegionLoads: rls, InfoServerPort: proto.Uint32(16030)},
+		})
+	}
+	if c.metaInTransition {
+		cs.RegionsInTransition = append(cs.RegionsInTransition, &pb.RegionInTransition{
+			Spec: &pb.RegionSpecifier{
+				Type:  pb.RegionSpecifier_REGION_NAME.Enum(),
+				Value: []byte("hbase:meta,,1"),
+			},
+		})
+	}
+	return cs, nil
+}
+
+func (c *fakeCluster) setBalancer(sb *hrpc.SetBalancer) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev := c.balancer
+	c.balancer = sb.ToProto().(*pb.SetBalancerRunningRequest).GetOn()
+	return prev, nil
+}
+
+func (c *fakeCluster) moveRegion(mr *hrpc.MoveRegion) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	req := mr.ToProto().(*pb.MoveRegionRequest)
+	encoded := string(req.GetRegion().GetValue())
+	c.moved = append(c.moved, encoded)
+	if c.stuck[encoded] {
+		return nil
+	}
+	dest := strings.TrimSuffix(req.GetDestServerName().GetHostName(), ".hbase")
+	for pod, regions := range c.servers {
+		for i, rn := range regions {
+			if encodedName(rn) != encoded {
+				continue
+			}
+			if dest == "" {
+				// pick any other regionserver
+				for other := range c.servers {
+					if other != pod {
+						dest = other
+						break
+					}
+				}
+			}
+			c.servers[pod] = append(regions[:i:i], regions[i+1:]...)
+			c.servers[dest] = append(c.servers[dest], rn)
+			return nil
+		}
+	}
+	return fmt.Errorf("org.apache.hadoop.hbase.DoNotRetryIOException: %s is not OPEN", encoded)
+}
+
+func encodedName(rn string) string {
+	if strings.HasPrefix(rn, "hbase:meta") {
+		return metaEncodedRegionName
+	}
+	return rn[len(rn)-33 : len(rn)-1]
+}
+
+// regionName returns region name with encoded name in format that hbase uses
+func regionName(i int) string {
+	return fmt.Sprintf("table,%d,1.%032d.", i, i)
+}
+
+func makePods(names ...string) []*corev1.Pod {
+	var pods []*corev1.Pod
+	for _, name := range names {
+		pods = append(pods, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name}})
+	}
+	return pods
+}
+
+func newTestReconciler(t *testing.T, c *fakeCluster, hb *hbasev1.HBase) *HBaseReconciler {
+	sch := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(sch); err != nil {
+		t.Fatal(err)
+	}
+	if err := hbasev1.AddToScheme(sch); err != nil {
+		t.Fatal(err)
+	}
+	hb.Name, hb.Namespace = "hbase", "default"
+	cl := fake.NewClientBuilder().WithScheme(sch).WithObjects(hb).WithStatusSubresource(hb).Build()
+
+	ctrl := gomock.NewController(t)
+	ghAdmin := mock.NewMockAdminClient(ctrl)
+	ghAdmin.EXPECT().SetBalancer(gomock.Any()).AnyTimes().DoAndReturn(c.setBalancer)
+	ghAdmin.EXPECT().ClusterStatus().AnyTimes().DoAndReturn(c.clusterStatus)
+	ghAdmin.EXPECT().MoveRegion(gomock.Any()).AnyTimes().DoAndReturn(c.moveRegion)
+	return &HBaseReconciler{
+		Client:   cl,
+		Log:      logr.Discard(),
+		GhAdmin:  &sendRPCAdminClient{MockAdminClient: ghAdmin},
+		Recorder: record.NewFakeRecorder(100),
+	}
+}
+
+func TestPickRegionServerToDeleteMeta(t *testing.T) {
+	ctx := context.Background()
+	hb := &hbasev1.HBase{}
+	c := &fakeCluster{servers: map[string][]string{
+		"regionserver-0": {},
+		"regionserver-1": {regionName(1)},
+		"regionserver-2": {"hbase:meta,,1", regionName(2)},
+	}}
+	r := newTestReconciler(t, c, hb)
+
+	// regionserver carrying hbase:meta is picked last
+	ps, _, err := r.pickRegionServerToDelete(ctx, hb,
+		makePods("regionserver-2", "regionserver-1"), makePods("regionserver-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Name != "regionserver-1" {
+		t.Fatalf("expected regionserver-1 to be picked, got %v", sprintPodList(ps))
+	}
+	if len(c.moved) != 1 || c.moved[0] != fmt.Sprintf("%032d", 1) {
+		t.Fatalf("unexpected moves: %v", c.moved)
+	}
+
+	// hbase:meta is moved to up-to-date regionserver before its pod is deleted
+	c.moved = nil
+	td := makePods("regionserver-2")
+	utd := makePods("regionserver-1", "regionserver-0")
+	ps, _, err = r.pickRegionServerToDelete(ctx, hb, td, utd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 0 {
+		t.Fatalf("expected to wait for hbase:meta to move, got %v", sprintPodList(ps))
+	}
+	if len(c.moved) != 1 || c.moved[0] != metaEncodedRegionName || len(c.servers["regionserver-2"]) != 1 {
+		t.Fatalf("expected hbase:meta to be moved to up-to-date regionserver: %v", c.servers)
+	}
+
+	// once hbase:meta is online at its new location, the regionserver is drained
+	c.moved = nil
+	ps, _, err = r.pickRegionServerToDelete(ctx, hb, td, utd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Name != "regionserver-2" {
+		t.Fatalf("expected regionserver-2 to be picked, got %v", sprintPodList(ps))
+	}
+	if len(c.moved) != 1 || c.moved[0] != fmt.Sprintf("%032d", 2) {
+		t.Fatalf("unexpected moves: %v", c.moved)
+	}
+
+	// regionserver is not deleted while hbase:meta is in transition
+	c.servers = map[string][]string{
+		"regionserver-0": {regionName(0)},
+		"regionserver-1": {regionName(1)},
+		"regionserver-2": {regionName(2)},
+	}
+	c.metaInTransition = true
+	hb.Status.Blocked = nil
+	ps, _, err = r.pickRegionServerToDelete(ctx, hb, td, utd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 0 {
+		t.Fatalf("expected to wait for hbase:meta to be online, got %v", sprintPodList(ps))
+	}
+	if b := hb.Status.Blocked; b == nil || b.Step != hbasev1.StepRegionsInTransition || b.Object != "hbase:meta" {
+		t.Fatalf("expected rollout to be blocked on hbase:meta, got %v", b)
+	}
+
+	// the wait is bounded by the deadline of the step
+	hb.Status.Blocked.Since.Time = time.Now().Add(-time.Hour)
+	ps, _, err = r.pickRegionServerToDelete(ctx, hb, td, utd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || !meta.IsStatusConditionTrue(hb.Status.Conditions, hbasev1.ConditionStalled) {
+		t.Fatalf("expected stalled rollout to proceed, got %v, %v", sprintPodList(ps), hb.Status.Conditions)
+	}
+
+	// hbase:meta that isn't in transition is hosted elsewhere, such as on the master
+	c.metaInTransition = false
+	c.servers["regionserver-2"] = []string{regionName(3)}
+	ps, _, err = r.pickRegionServerToDelete(ctx, hb, td, utd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Name != "regionserver-2" {
+		t.Fatalf("expected regionserver-2 to be picked, got %v", sprintPodList(ps))
+	}
+}
+
+func TestPickRegionServerToDeleteMetaWithoutTarget(t *testing.T) {
+	ctx := context.Background()
+	hb := &hbasev1.HBase{}
+	c := &fakeCluster{servers: map[string][]string{
+		"regionserver-0": {"hbase:meta,,1", regionName(0)},
+	}}
+	r := newTestReconciler(t, c, hb)
+	td := makePods("regionserver-0")
+
+	// hbase:meta has nowhere to be moved in advance, so the regionserver
+	// is drained of other regions and deleted with hbase:meta on it
+	ps, _, err := r.pickRegionServerToDelete(ctx, hb, td, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Name != "regionserver-0" {
+		t.Fatalf("expected regionserver-0 to be picked, got %v", sprintPodList(ps))
+	}
+	if len(c.moved) != 1 || c.moved[0] == metaEncodedRegionName {
+		t.Fatalf("expected only regions other than hbase:meta to be moved: %v", c.moved)
+	}
+	var events []string
+	for len(r.Recorder.(*record.FakeRecorder).Events) > 0 {
+		events = append(events, <-r.Recorder.(*record.FakeRecorder).Events)
+	}
+	if len(events) != 1 || !strings.Contains(events[0], "MetaMoveSkipped") {
+		t.Fatalf("expected event about skipped move of hbase:meta: %v", events)
+	}
+}
+
+func TestPickRegionServerToDeleteVerifiesDrain(t *testing.T) {
+	ctx := context.Background()
+	hb := &hbasev1.HBase{}
+	c := &fakeCluster{
+		servers: map[string][]string{
+			"regionserver-0": {"hbase:meta,,1"},
+			"regionserver-1": {regionName(1), regionName(2)},
+		},
+		stuck: map[string]bool{fmt.Sprintf("%032d", 2): true},
+	}
+	r := newTestReconciler(t, c, hb)
+	td, utd := makePods("regionserver-1"), makePods("regionserver-0")
+
+	// regionserver is not deleted while it has regions
+	ps, done, err := r.pickRegionServerToDelete(ctx, hb, td, utd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 0 || done {
+		t.Fatalf("expected to wait for regionserver-1 to be drained, got %v", sprintPodList(ps))
+	}
+	if d := hb.Status.Drain; d == nil || len(d.RegionServers) != 1 || len(d.RegionServers[0].RegionsRemaining) != 1 {
+		t.Fatalf("expected remaining region in drain status: %+v", d)
+	}
+	if b := hb.Status.Blocked; b == nil || b.Step != hbasev1.StepDrain || b.Object != "[regionserver-1]" {
+		t.Fatalf("expected rollout to be blocked on drain: %+v", b)
+	}
+
+	// the stuck region is retried on the next reconcile
+	if _, _, err := r.pickRegionServerToDelete(ctx, hb, td, utd); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.moved) != 3 {
+		t.Fatalf("expected stuck region move to be retried: %v", c.moved)
+	}
+
+	// drain that exceeds its deadline is aborted by default
+	hb.Status.Drain.StartTime.Time = time.Now().Add(-time.Hour)
+	hb.Status.Blocked.Since = hb.Status.Drain.StartTime
+	ps, _, err = r.pickRegionServerToDelete(ctx, hb, td, utd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 0 || !meta.IsStatusConditionTrue(hb.Status.Conditions, hbasev1.ConditionStalled) {
+		t.Fatalf("expected rollout to stall, got %v, %v", sprintPodList(ps), hb.Status.Conditions)
+	}
+	if len(hb.Status.FailedRegionMoves) != 1 || hb.Status.FailedRegionMoves[0] != fmt.Sprintf("%032d", 2) {
+		t.Fatalf("expected failed region in status: %v", hb.Status.FailedRegionMoves)
+	}
+	// stuck regions are reported once the deadline is crossed
+	if _, _, err := r.pickRegionServerToDelete(ctx, hb, td, utd); err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	for len(r.Recorder.(*record.FakeRecorder).Events) > 0 {
+		events = append(events, <-r.Recorder.(*record.FakeRecorder).Events)
+	}
+	failed := slices.DeleteFunc(events, func(e string) bool { return !strings.Contains(e, "RegionMoveFailed") })
+	if len(failed) != 1 || !strings.Contains(failed[0], fmt.Sprintf("%032d", 2)) {
+		t.Fatalf("expected one event with the failed region: %v", events)
+	}
+
+	// or forced to delete the regionserver with regions left
+	hb.Spec.Drain.OnTimeout = hbasev1.ForceDrainTimeoutAction
+	if err := r.Update(ctx, hb); err != nil {
+		t.Fatal(err)
+	}
+	ps, _, err = r.pickRegionServerToDelete(ctx, hb, td, utd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Name != "regionserver-1" {
+		t.Fatalf("expected regionserver-1 to be picked, got %v", sprintPodList(ps))
+	}
+
+	// status is cleared once drain succeeds
+	delete(c.stuck, fmt.Sprintf("%032d", 2))
+	hb.Status.Drain = nil
+	ps, _, err = r.pickRegionServerToDelete(ctx, hb, td, utd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || len(hb.Status.FailedRegionMoves) != 0 || len(c.servers["regionserver-1"]) != 0 {
+		t.Fatalf("expected regionserver-1 to be drained: %v %v", hb.Status.FailedRegionMoves, c.servers)
+	}
+}
+
+func TestPickRegionServerToDeleteConcurrentMoves(t *testing.T) {
+	ctx := context.Background()
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{
+		Drain: hbasev1.DrainSpec{Concurrency: 4, MovesPerSecond: 1000},
+	}}
+	var regions []string
+	for i := 0; i < 20; i++ {
+		regions = append(regions, regionName(i))
+	}
+	c := &fakeCluster{servers: map[string][]string{
+		"regionserver-0": {"hbase:meta,,1"},
+		"regionserver-1": {},
+		"regionserver-2": regions,
+	}}
+	r := newTestReconciler(t, c, hb)
+
+	ps, _, err := r.pickRegionServerToDelete(ctx, hb,
+		makePods("regionserver-2"), makePods("regionserver-1", "regionserver-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Name != "regionserver-2" {
+		t.Fatalf("expected regionserver-2 to be picked, got %v", sprintPodList(ps))
+	}
+	if len(c.moved) != 20 || len(c.servers["regionserver-2"]) != 0 {
+		t.Fatalf("expected all regions to be moved once: %v", c.moved)
+	}
+	// targets are balanced taking hbase:meta-less counts into account
+	if len(c.servers["regionserver-0"]) != 11 || len(c.servers["regionserver-1"]) != 10 {
+		t.Fatalf("expected regions to be spread evenly: %v", c.servers)
+	}
+}
+
+func TestWeightedTargets(t *testing.T) {
+	var n int
+	rates := map[string]float64{}
+	region := func(sizeMB uint32, rate float64, locality float32) *pb.RegionLoad {
+		n++
+		rates[fmt.Sprintf("%032d", n)] = rate
+		return &pb.RegionLoad{
+			RegionSpecifier: &pb.RegionSpecifier{
+				Type:  pb.RegionSpecifier_REGION_NAME.Enum(),
+				Value: []byte(regionName(n)),
+			},
+			StorefileSize_MB: proto.Uint32(sizeMB),
+			// cumulative counters don't tell the load
+			ReadRequestsCount: proto.Uint64(uint64(1000000 - n)),
+			DataLocality:      proto.Float32(locality),
+		}
+	}
+
+	tests := []struct {
+		name    string
+		targets map[string][]*pb.RegionLoad
+		expect  string
+	}{
+		{
+			name: "smaller storefiles",
+			targets: map[string][]*pb.RegionLoad{
+				"a": {region(1000, 10, 1), region(1000, 10, 1)},
+				"b": {region(10, 10, 1), region(10, 10, 1)},
+			},
+			expect: "b",
+		},
+		{
+			name: "lower request rate",
+			targets: map[string][]*pb.RegionLoad{
+				"a": {region(100, 10, 1)},
+				"b": {region(100, 10000, 1)},
+			},
+			expect: "a",
+		},
+		{
+			name: "better locality",
+			targets: map[string][]*pb.RegionLoad{
+				"a": {region(100, 10, 0.2)},
+				"b": {region(100, 10, 1)},
+			},
+			expect: "b",
+		},
+		{
+			name: "fewer regions",
+			targets: map[string][]*pb.RegionLoad{
+				"a": {region(100, 10, 1), region(100, 10, 1)},
+				"b": {region(200, 20, 1)},
+			},
+			expect: "b",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			wt := newWeightedTargets(test.targets, rates)
+			if got := wt.next(region(100, 10, 1)); got != test.expect {
+				t.Errorf("expected %q, got %q", test.expect, got)
+			}
+		})
+	}
+
+	// moved regions are accounted for
+	wt := newWeightedTargets(map[string][]*pb.RegionLoad{"a": {}, "b": {}}, rates)
+	counts := map[string]int{}
+	for i := 0; i < 10; i++ {
+		counts[wt.next(region(100, 10, 1))]++
+	}
+	if counts["a"] != 5 || counts["b"] != 5 {
+		t.Errorf("expected regions to be spread evenly: %v", counts)
+	}
+}
+
+func TestRestoreRegions(t *testing.T) {
+	ctx := context.Background()
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{
+		RegionServerSpec: hbasev1.ServerSpec{Count: 2},
+		Drain:            hbasev1.DrainSpec{RestoreRegions: true},
+	}}
+	c := &fakeCluster{servers: map[string][]string{
+		"regionserver-0": {"hbase:meta,,1", regionName(0)},
+		"regionserver-1": {regionName(1), regionName(2)},
+	}}
+	r := newTestReconciler(t, c, hb)
+
+	ps, _, err := r.pickRegionServerToDelete(ctx, hb, makePods("regionserver-1"), makePods("regionserver-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Name != "regionserver-1" {
+		t.Fatalf("expected regionserver-1 to be picked, got %v", sprintPodList(ps))
+	}
+	if len(hb.Status.DrainedRegionServers) != 1 ||
+		hb.Status.DrainedRegionServers[0].ServerName != "regionserver-1.hbase,16020,1" ||
+		len(hb.Status.DrainedRegionServers[0].Regions) != 2 {
+		t.Fatalf("expected drained regionserver to be recorded: %v", hb.Status.DrainedRegionServers)
+	}
+
+	// wait for deleted pod to be recreated by the statefulset
+	delete(c.servers, "regionserver-1")
+	_, done, err := r.pickRegionServerToDelete(ctx, hb, nil, makePods("regionserver-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done || len(hb.Status.DrainedRegionServers) != 1 {
+		t.Fatalf("expected to wait for regionserver-1 to be recreated: %v", hb.Status.DrainedRegionServers)
+	}
+
+	// wait for restarted regionserver to register
+	_, done, err = r.pickRegionServerToDelete(ctx, hb, nil, makePods("regionserver-1", "regionserver-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done || len(hb.Status.DrainedRegionServers) != 1 {
+		t.Fatalf("expected to wait for regionserver-1 to register: %v", hb.Status.DrainedRegionServers)
+	}
+
+	// regions are moved back once it's registered
+	c.servers["regionserver-1"] = nil
+	c.startCodes = map[string]uint64{"regionserver-1": 2}
+	_, done, err = r.pickRegionServerToDelete(ctx, hb, nil, makePods("regionserver-1", "regionserver-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if done || len(hb.Status.DrainedRegionServers) != 0 {
+		t.Fatalf("expected to wait for regions to settle: %v", hb.Status.DrainedRegionServers)
+	}
+	if len(c.servers["regionserver-1"]) != 2 {
+		t.Fatalf("expected regions to be moved back: %v", c.servers)
+	}
+
+	_, done, err = r.pickRegionServerToDelete(ctx, hb, nil, makePods("regionserver-1", "regionserver-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !done {
+		t.Fatal("expected regionservers to be up to date")
+	}
+
+	// regions aren't moved back to pods that are gone due to scale down
+	hb.Spec.RegionServerSpec.Count = 1
+	hb.Status.DrainedRegionServers = []hbasev1.DrainedRegionServer{{
+		Pod:        "regionserver-1",
+		ServerName: "regionserver-1.hbase,16020,2",
+		Regions:    []string{fmt.Sprintf("%032d", 1)},
+	}}
+	_, done, err = r.pickRegionServerToDelete(ctx, hb, nil, makePods("regionserver-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !done || len(hb.Status.DrainedRegionServers) != 0 {
+		t.Fatalf("expected drained regionserver to be dropped: %v", hb.Status.DrainedRegionServers)
+	}
+}
+
+func TestPickRegionServerToDeleteResumesDrain(t *testing.T) {
+	ctx := context.Background()
+	hb := &hbasev1.HBase{}
+	c := &fakeCluster{servers: map[string][]string{
+		"regionserver-0": {"hbase:meta,,1"},
+		"regionserver-1": {regionName(1)},
+		"regionserver-2": {regionName(2)},
+	}}
+	r := newTestReconciler(t, c, hb)
+
+	// drain is recorded along with the balancer state before the rollout
+	ps, _, err := r.pickRegionServerToDelete(ctx, hb,
+		makePods("regionserver-2", "regionserver-1"), makePods("regionserver-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Name != "regionserver-2" {
+		t.Fatalf("expected regionserver-2 to be picked, got %v", sprintPodList(ps))
+	}
+	stored := &hbasev1.HBase{}
+	if err := r.Get(ctx, client.ObjectKeyFromObject(hb), stored); err != nil {
+		t.Fatal(err)
+	}
+	if d := stored.Status.Drain; d == nil || len(d.RegionServers) != 1 || d.RegionServers[0].Pod != "regionserver-2" ||
+		d.RegionServers[0].ServerName != "regionserver-2.hbase,16020,1" || len(d.RegionServers[0].RegionsRemaining) != 1 {
+		t.Fatalf("expected drain to be recorded before moving regions: %+v", stored.Status.Drain)
+	}
+
+	// drain in progress is resumed and the balancer state is kept
+	hb.Status.Drain = &hbasev1.DrainStatus{
+		RegionServers:   []hbasev1.DrainingRegionServer{{Pod: "regionserver-1"}},
+		BalancerEnabled: true,
+	}
+	ps, _, err = r.pickRegionServerToDelete(ctx, hb,
+		makePods("regionserver-2", "regionserver-1"), makePods("regionserver-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Name != "regionserver-1" {
+		t.Fatalf("expected drain of regionserver-1 to be resumed, got %v", sprintPodList(ps))
+	}
+	if d := hb.Status.Drain; d.RegionServers[0].Pod != "regionserver-1" || !d.BalancerEnabled ||
+		len(d.RegionServers[0].RegionsRemaining) != 0 {
+		t.Fatalf("unexpected drain status: %+v", d)
+	}
+
+	// drain record carries the balancer state over to the next regionserver
+	ps, _, err = r.pickRegionServerToDelete(ctx, hb,
+		makePods("regionserver-2"), makePods("regionserver-1", "regionserver-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Name != "regionserver-2" || !hb.Status.Drain.BalancerEnabled {
+		t.Fatalf("unexpected drain status: %+v", hb.Status.Drain)
+	}
+
+	// drain record is cleared once rollout is done
+	if _, _, err = r.pickRegionServerToDelete(ctx, hb, nil,
+		makePods("regionserver-2", "regionserver-1", "regionserver-0")); err != nil {
+		t.Fatal(err)
+	}
+	if hb.Status.Drain != nil {
+		t.Fatalf("expected drain status to be cleared: %+v", hb.Status.Drain)
+	}
+}
+
+func TestPickRegionServerToDeleteKeepsBalancerStateWhileWaiting(t *testing.T) {
+	ctx := context.Background()
+	hb := &hbasev1.HBase{}
+	c := &fakeCluster{
+		servers: map[string][]string{
+			"regionserver-0": {regionName(0)},
+			"regionserver-1": {regionName(1)},
+		},
+		metaInTransition: true,
+		balancer:         true,
+	}
+	r := newTestReconciler(t, c, hb)
+
+	// the balancer state is recorded even though nothing is drained
+	// while hbase:meta is in transition
+	for i := 0; i < 2; i++ {
+		ps, done, err := r.pickRegionServerToDelete(ctx, hb, makePods("regionserver-1"), makePods("regionserver-0"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done || len(ps) != 0 {
+			t.Fatalf("expected to wait for hbase:meta, got %v", sprintPodList(ps))
+		}
+		if c.balancer {
+			t.Fatal("expected balancer to be off")
+		}
+		stored := &hbasev1.HBase{}
+		if err := r.Get(ctx, client.ObjectKeyFromObject(hb), stored); err != nil {
+			t.Fatal(err)
+		}
+		if d := stored.Status.Drain; d == nil || !d.BalancerEnabled || len(d.RegionServers) != 0 {
+			t.Fatalf("expected balancer state to be recorded: %+v", d)
+		}
+	}
+
+	c.metaInTransition = false
+	c.servers["regionserver-0"] = append(c.servers["regionserver-0"], "hbase:meta,,1")
+	ps, _, err := r.pickRegionServerToDelete(ctx, hb, makePods("regionserver-1"), makePods("regionserver-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 1 || ps[0].Name != "regionserver-1" || !hb.Status.Drain.BalancerEnabled {
+		t.Fatalf("expected regionserver-1 to be picked, got %v, %+v", sprintPodList(ps), hb.Status.Drain)
+	}
+
+	// the balancer is back on once the rollout is done
+	if _, _, err := r.pickRegionServerToDelete(ctx, hb, nil, makePods("regionserver-1", "regionserver-0")); err != nil {
+		t.Fatal(err)
+	}
+	if !c.balancer || hb.Status.Drain != nil {
+		t.Fatalf("expected balancer to be restored, got %v, %+v", c.balancer, hb.Status.Drain)
+	}
+}
+
+func TestPickRegionServerToDeleteBatch(t *testing.T) {
+	ctx := context.Background()
+	maxUnavailable := intstr.FromString("50%")
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{
+		RegionServerSpec: hbasev1.ServerSpec{Count: 5, MaxUnavailable: &maxUnavailable},
+	}}
+	c := &fakeCluster{servers: map[string][]string{
+		"regionserver-0": {regionName(0)},
+		"regionserver-1": {regionName(1)},
+		"regionserver-2": {regionName(2)},
+		"regionserver-3": {"hbase:meta,,1", regionName(3)},
+		"regionserver-4": {regionName(4)},
+	}}
+	r := newTestReconciler(t, c, hb)
+
+	// 50% of 5 regionservers are drained into up-to-date ones and picked together,
+	// the one carrying hbase:meta goes last
+	ps, _, err := r.pickRegionServerToDelete(ctx, hb,
+		makePods("regionserver-4", "regionserver-3", "regionserver-2", "regionserver-1"),
+		makePods("regionserver-0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sprintPodList(ps); got != "[regionserver-4 regionserver-2]" {
+		t.Fatalf("expected batch of 2 regionservers to be picked, got %v", got)
+	}
+	if len(c.servers["regionserver-4"]) != 0 || len(c.servers["regionserver-2"]) != 0 ||
+		len(c.servers["regionserver-0"]) != 3 {
+		t.Fatalf("expected batch to be drained into up-to-date regionserver: %v", c.servers)
+	}
+
+	// without up-to-date regionservers, the batch is drained into the rest
+	hb.Status.Drain = nil
+	c.servers = map[string][]string{
+		"regionserver-0": {regionName(0)},
+		"regionserver-1": {regionName(1)},
+		"regionserver-2": {regionName(2)},
+		"regionserver-3": {"hbase:meta,,1", regionName(3)},
+		"regionserver-4": {regionName(4)},
+	}
+	ps, _, err = r.pickRegionServerToDelete(ctx, hb, makePods("regionserver-4",
+		"regionserver-3", "regionserver-2", "regionserver-1", "regionserver-0"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sprintPodList(ps); got != "[regionserver-4 regionserver-2]" {
+		t.Fatalf("expected batch of 2 regionservers to be picked, got %v", got)
+	}
+	if len(c.servers["regionserver-4"]) != 0 || len(c.servers["regionserver-2"]) != 0 {
+		t.Fatalf("expected regions to be moved out of the batch: %v", c.servers)
+	}
+
+	// one at a time is the default
+	hb.Spec.RegionServerSpec.MaxUnavailable = nil
+	if err := r.Update(ctx, hb); err != nil {
+		t.Fatal(err)
+	}
+	hb.Status.Drain = nil
+	ps, _, err = r.pickRegionServerToDelete(ctx, hb,
+		makePods("regionserver-4", "regionserver-2"), makePods("regionserver-3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sprintPodList(ps); got != "[regionserver-4]" {
+		t.Fatalf("expected a single regionserver to be picked, got %v", got)
+	}
+
+	// the batch is drained together and every regionserver of it is recorded
+	hb.Spec.RegionServerSpec.MaxUnavailable = &maxUnavailable
+	if err := r.Update(ctx, hb); err != nil {
+		t.Fatal(err)
+	}
+	hb.Status.Drain = nil
+	c.servers = map[string][]string{
+		"regionserver-0": {regionName(0)},
+		"regionserver-1": {regionName(1)},
+		"regionserver-2": {regionName(2)},
+		"regionserver-3": {"hbase:meta,,1", regionName(3)},
+		"regionserver-4": {regionName(4)},
+	}
+	c.stuck = map[string]bool{fmt.Sprintf("%032d", 4): true}
+	td := makePods("regionserver-4", "regionserver-2", "regionserver-1")
+	utd := makePods("regionserver-3", "regionserver-0")
+	ps, _, err = r.pickRegionServerToDelete(ctx, hb, td, utd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ps) != 0 || len(c.servers["regionserver-2"]) != 0 {
+		t.Fatalf("expected batch to wait for regionserver-4 after draining regionserver-2, got %v, %v",
+			sprintPodList(ps), c.servers)
+	}
+	if d := hb.Status.Drain; len(d.RegionServers) != 2 ||
+		d.RegionServers[0].Pod != "regionserver-4" || len(d.RegionServers[0].RegionsRemaining) != 1 ||
+		d.RegionServers[1].Pod != "regionserver-2" || len(d.RegionServers[1].RegionsRemaining) != 0 {
+		t.Fatalf("expected both regionservers of the batch to be recorded: %+v", d)
+	}
+
+	// the whole batch is resumed and deleted together
+	c.stuck = nil
+	ps, _, err = r.pickRegionServerToDelete(ctx, hb, makePods("regionserver-2", "regionserver-1", "regionserver-4"), utd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sprintPodList(ps); got != "[regionserver-4 regionserver-2]" {
+		t.Fatalf("expected batch to be resumed, got %v", got)
+	}
+}
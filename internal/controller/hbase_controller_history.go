@@ -0,0 +1,254 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	// HBaseControllerHistoryKey is the label of ControllerRevisions that keep
+	// the history of StatefulSet revisions, its value is the StatefulSet name
+	HBaseControllerHistoryKey = "hbase-controller-history"
+
+	// defaultRevisionHistoryLimit is the number of previous revisions kept by default
+	defaultRevisionHistoryLimit = 10
+)
+
+// revisionHistoryLimit returns the number of previous config ConfigMaps and
+// StatefulSet revisions to keep
+func revisionHistoryLimit(hb *hbasev1.HBase) int {
+	if hb.Spec.RevisionHistoryLimit != nil {
+		return int(*hb.Spec.RevisionHistoryLimit)
+	}
+	return defaultRevisionHistoryLimit
+}
+
+// controllerRevisionName returns the name of the ControllerRevision that keeps
+// the revision of the StatefulSet
+func controllerRevisionName(stsName, rev string) string {
+	if len(rev) > 10 {
+		rev = rev[:10]
+	}
+	return fmt.Sprintf("%s-%s", stsName, rev)
+}
+
+// listRevisions returns the revisions kept for the StatefulSet ordered from oldest
+// to newest. If stsName is empty, revisions of all StatefulSets are returned.
+func (r *HBaseReconciler) listRevisions(ctx context.Context, hb *hbasev1.HBase,
+	stsName string) ([]appsv1.ControllerRevision, error) {
+	opts := []client.ListOption{client.InNamespace(hb.Namespace)}
+	if stsName != "" {
+		opts = append(opts, client.MatchingLabels{HBaseControllerHistoryKey: stsName})
+	} else {
+		opts = append(opts, client.HasLabels{HBaseControllerHistoryKey})
+	}
+	l := &appsv1.ControllerRevisionList{}
+	if err := r.List(ctx, l, opts...); err != nil {
+		return nil, err
+	}
+	sort.Slice(l.Items, func(i, j int) bool {
+		return l.Items[i].Revision < l.Items[j].Revision
+	})
+	return l.Items, nil
+}
+
+// recordRevision keeps the StatefulSet of revision rev in history and removes
+// the oldest revisions over the limit once it's created. The new and the stable
+// revisions aren't removed, so the stable one counts towards the limit.
+func (r *HBaseReconciler) recordRevision(ctx context.Context, hb *hbasev1.HBase,
+	sts *appsv1.StatefulSet, rev string) error {
+	revs, err := r.listRevisions(ctx, hb, sts.Name)
+	if err != nil {
+		return err
+	}
+	name := controllerRevisionName(sts.Name, rev)
+	var next int64 = 1
+	for _, cr := range revs {
+		if cr.Name == name {
+			return nil
+		}
+		next = max(next, cr.Revision+1)
+	}
+
+	data, err := json.Marshal(sts)
+	if err != nil {
+		return err
+	}
+	cr := &appsv1.ControllerRevision{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   sts.Namespace,
+			Labels:      map[string]string{HBaseControllerHistoryKey: sts.Name},
+			Annotations: map[string]string{HBaseControllerRevisionKey: rev},
+		},
+		Data:     runtime.RawExtension{Raw: data},
+		Revision: next,
+	}
+	if err := controllerutil.SetControllerReference(hb, cr, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Create(ctx, cr); err != nil {
+		return err
+	}
+	r.Log.Info("recorded StatefulSet revision", "name", name, "revision", next)
+
+	revs = append(revs, *cr)
+	stable := controllerRevisionName(sts.Name, hb.Status.StableRevisions[sts.Name])
+	excess := len(revs) - revisionHistoryLimit(hb)
+	for i := 0; i < len(revs)-1 && excess > 0; i++ {
+		if revs[i].Name == stable {
+			continue
+		}
+		r.Log.Info("deleting old StatefulSet revision", "name", revs[i].Name)
+		if err := r.Delete(ctx, &revs[i]); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		excess--
+	}
+	return nil
+}
+
+// revisionStatefulSet returns the StatefulSet of revision rev from history
+func (r *HBaseReconciler) revisionStatefulSet(ctx context.Context, stsName types.NamespacedName,
+	rev string) (*appsv1.StatefulSet, error) {
+	cr := &appsv1.ControllerRevision{}
+	if err := r.Get(ctx, types.NamespacedName{
+		Name:      controllerRevisionName(stsName.Name, rev),
+		Namespace: stsName.Namespace,
+	}, cr); err != nil {
+		return nil, err
+	}
+	sts := &appsv1.StatefulSet{}
+	if err := json.Unmarshal(cr.Data.Raw, sts); err != nil {
+		return nil, fmt.Errorf("invalid revision %q: %w", cr.Name, err)
+	}
+	return sts, nil
+}
+
+// historyConfigMaps returns names of ConfigMaps used by revisions in history
+func (r *HBaseReconciler) historyConfigMaps(ctx context.Context, hb *hbasev1.HBase) (map[string]bool, error) {
+	revs, err := r.listRevisions(ctx, hb, "")
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, cr := range revs {
+		sts := &appsv1.StatefulSet{}
+		if err := json.Unmarshal(cr.Data.Raw, sts); err != nil {
+			return nil, fmt.Errorf("invalid revision %q: %w", cr.Name, err)
+		}
+		for _, v := range sts.Spec.Template.Spec.Volumes {
+			for _, name := range volumeConfigMaps(v) {
+				names[name] = true
+			}
+		}
+	}
+	return names, nil
+}
+
+// rolledBackStatefulSet returns the stable revision of the StatefulSet if
+// the rollout of the current generation was rolled back. It returns nil if
+// there is no rollback in effect.
+func (r *HBaseReconciler) rolledBackStatefulSet(ctx context.Context, hb *hbasev1.HBase,
+	stsName types.NamespacedName, ss hbasev1.ServerSpec) (*appsv1.StatefulSet, string, error) {
+	rb := hb.Status.Rollback
+	if rb == nil || rb.Generation != hb.Generation {
+		return nil, "", nil
+	}
+	rev, ok := hb.Status.StableRevisions[stsName.Name]
+	if !ok {
+		return nil, "", nil
+	}
+	sts, err := r.revisionStatefulSet(ctx, stsName, rev)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get stable revision %q of StatefulSet %q: %w",
+			rev, stsName.Name, err)
+	}
+	sts.ObjectMeta = metav1.ObjectMeta{
+		Name:        sts.Name,
+		Namespace:   sts.Namespace,
+		Annotations: sts.Annotations,
+		Labels:      sts.Labels,
+	}
+	sts.Spec.Replicas = ptr.To(ss.Count)
+	return sts, rev, nil
+}
+
+// rollbackIfFailed rolls the rollout back if the pod of the new revision of
+// the StatefulSet hasn't become ready within the progress deadline
+func (r *HBaseReconciler) rollbackIfFailed(hb *hbasev1.HBase, sts *appsv1.StatefulSet, p *corev1.Pod) {
+	if !hb.Spec.Rollout.RollbackOnFailure {
+		return
+	}
+	deadline := stepDeadline(hb, hbasev1.StepPodReady)
+	if time.Since(p.CreationTimestamp.Time) < deadline {
+		return
+	}
+	if rb := hb.Status.Rollback; rb != nil && rb.Generation == hb.Generation {
+		// already rolled back, the stable revision has to become ready
+		return
+	}
+	rev := sts.Annotations[HBaseControllerRevisionKey]
+	stable, ok := hb.Status.StableRevisions[sts.Name]
+	if !ok || stable == rev {
+		r.Log.Info("no stable revision to roll back to", "StatefulSet", sts.Name)
+		return
+	}
+
+	reason := fmt.Sprintf("pod %s didn't become ready within %v", p.Name, deadline)
+	r.Log.Info("rolling back failed rollout", "StatefulSet", sts.Name,
+		"revision", rev, "stable", stable, "reason", reason)
+	hb.Status.Rollback = &hbasev1.RollbackStatus{
+		Generation:     hb.Generation,
+		StatefulSet:    sts.Name,
+		FailedRevision: rev,
+		Reason:         reason,
+		Time:           metav1.Now(),
+	}
+	meta.SetStatusCondition(&hb.Status.Conditions, metav1.Condition{
+		Type:               hbasev1.ConditionRolloutFailed,
+		Status:             metav1.ConditionTrue,
+		ObservedGeneration: hb.Generation,
+		Reason:             "RolledBack",
+		Message:            fmt.Sprintf("revision %s of %s: %s", rev, sts.Name, reason),
+	})
+	r.Recorder.Eventf(hb, corev1.EventTypeWarning, "RolledBack",
+		"Rolled back StatefulSet %s from revision %s: %s", sts.Name, rev, reason)
+}
+
+// clearRollback forgets the rollback once the spec changes
+func clearRollback(hb *hbasev1.HBase) {
+	if hb.Status.Rollback != nil && hb.Status.Rollback.Generation != hb.Generation {
+		hb.Status.Rollback = nil
+		meta.RemoveStatusCondition(&hb.Status.Conditions, hbasev1.ConditionRolloutFailed)
+	}
+}
@@ -0,0 +1,300 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func newHistoryTestReconciler(t *testing.T, hb *hbasev1.HBase) *HBaseReconciler {
+	sch := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(sch); err != nil {
+		t.Fatal(err)
+	}
+	if err := hbasev1.AddToScheme(sch); err != nil {
+		t.Fatal(err)
+	}
+	hb.Name, hb.Namespace, hb.UID = "hbase", "default", "uid"
+	cl := fake.NewClientBuilder().WithScheme(sch).WithObjects(hb).WithStatusSubresource(hb).Build()
+	return &HBaseReconciler{
+		Client:   cl,
+		Scheme:   sch,
+		Log:      logr.Discard(),
+		Recorder: record.NewFakeRecorder(100),
+	}
+}
+
+// rsConfigMapName returns the name of the RegionServer config ConfigMap with the data of hb
+func rsConfigMapName(hb *hbasev1.HBase) types.NamespacedName {
+	return getConfigMapName(hb, "regionserver", hb.Spec.Config.Data, nil)
+}
+
+func TestRollbackOnFailure(t *testing.T) {
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{
+		RegionServerSpec: hbasev1.ServerSpec{Count: 1, PodSpec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "server", Image: "hbase:1"}},
+		}},
+		Rollout: hbasev1.RolloutSpec{RollbackOnFailure: true},
+	}}
+	r := newHistoryTestReconciler(t, hb)
+	stsName := types.NamespacedName{Name: "regionserver", Namespace: hb.Namespace}
+
+	sts, _, err := r.ensureStatefulSet(hb, stsName, rsConfigMapName(hb), hb.Spec.RegionServerSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stable := sts.Annotations[HBaseControllerRevisionKey]
+	hb.Status.StableRevisions = map[string]string{stsName.Name: stable}
+
+	// roll out a broken image
+	hb.Generation = 2
+	hb.Spec.RegionServerSpec.PodSpec.Containers[0].Image = "hbase:broken"
+	sts, updated, err := r.ensureStatefulSet(hb, stsName, rsConfigMapName(hb), hb.Spec.RegionServerSpec)
+	if err != nil || !updated {
+		t.Fatalf("expected StatefulSet to be updated, got %v, %v", updated, err)
+	}
+	failed := sts.Annotations[HBaseControllerRevisionKey]
+
+	// the pod hasn't become ready in time
+	p := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:              "regionserver-0",
+		CreationTimestamp: metav1.NewTime(time.Now().Add(-time.Hour)),
+	}}
+	r.rollbackIfFailed(hb, sts, p)
+	if hb.Status.Rollback == nil || hb.Status.Rollback.FailedRevision != failed {
+		t.Fatalf("expected rollback of revision %s, got %v", failed, hb.Status.Rollback)
+	}
+	if !meta.IsStatusConditionTrue(hb.Status.Conditions, hbasev1.ConditionRolloutFailed) {
+		t.Errorf("expected rollout failed condition, got %v", hb.Status.Conditions)
+	}
+
+	sts, updated, err = r.ensureStatefulSet(hb, stsName, rsConfigMapName(hb), hb.Spec.RegionServerSpec)
+	if err != nil || !updated {
+		t.Fatalf("expected StatefulSet to be rolled back, got %v, %v", updated, err)
+	}
+	if rev := sts.Annotations[HBaseControllerRevisionKey]; rev != stable {
+		t.Errorf("expected stable revision %s, got %s", stable, rev)
+	}
+	if image := sts.Spec.Template.Spec.Containers[0].Image; image != "hbase:1" {
+		t.Errorf("expected image of stable revision, got %s", image)
+	}
+
+	// the rollback is forgotten once the spec changes
+	hb.Generation = 3
+	clearRollback(hb)
+	if hb.Status.Rollback != nil || meta.FindStatusCondition(hb.Status.Conditions, hbasev1.ConditionRolloutFailed) != nil {
+		t.Errorf("expected rollback to be cleared, got %v", hb.Status.Rollback)
+	}
+}
+
+func TestRollbackOnFailureOfPendingPod(t *testing.T) {
+	ctx := context.Background()
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{
+		RegionServerSpec: hbasev1.ServerSpec{Count: 2, PodSpec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "server", Image: "hbase:1"}},
+		}},
+		Rollout: hbasev1.RolloutSpec{RollbackOnFailure: true},
+	}}
+	r := newHistoryTestReconciler(t, hb)
+	stsName := types.NamespacedName{Name: "regionserver", Namespace: hb.Namespace}
+
+	sts, _, err := r.ensureStatefulSet(hb, stsName, rsConfigMapName(hb), hb.Spec.RegionServerSpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hb.Status.StableRevisions = map[string]string{stsName.Name: sts.Annotations[HBaseControllerRevisionKey]}
+	hb.Generation = 2
+	hb.Spec.RegionServerSpec.PodSpec.Containers[0].Image = "hbase:unschedulable"
+	if sts, _, err = r.ensureStatefulSet(hb, stsName, rsConfigMapName(hb), hb.Spec.RegionServerSpec); err != nil {
+		t.Fatal(err)
+	}
+	sts.Status.UpdateRevision = "new"
+
+	// the pod of the new revision never got scheduled, so it has no container statuses
+	pods := []*corev1.Pod{{
+		ObjectMeta: metav1.ObjectMeta{Name: "regionserver-0", Labels: map[string]string{
+			appsv1.StatefulSetRevisionLabel: "old",
+		}},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning, Conditions: []corev1.PodCondition{
+			{Type: corev1.PodReady, Status: corev1.ConditionTrue},
+		}},
+	}, {
+		ObjectMeta: metav1.ObjectMeta{Name: "regionserver-1", Labels: map[string]string{
+			appsv1.StatefulSetRevisionLabel: "new",
+		}},
+		Status: corev1.PodStatus{Phase: corev1.PodPending, Conditions: []corev1.PodCondition{
+			{Type: corev1.PodScheduled, Status: corev1.ConditionFalse, Reason: corev1.PodReasonUnschedulable},
+		}},
+	}}
+	for _, p := range pods {
+		p.Namespace = hb.Namespace
+		p.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+		p.Labels[HBaseControllerNameKey] = sts.Spec.Template.Labels[HBaseControllerNameKey]
+		if err := r.Create(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if ok, err := r.ensureStatefulSetPods(ctx, hb, sts, pickWithoutDrain); err != nil || ok {
+		t.Fatalf("expected to wait for the pending pod: %v", err)
+	}
+	if b := hb.Status.Blocked; b == nil || b.Step != hbasev1.StepPodReady || b.Object != "regionserver-1" {
+		t.Errorf("expected rollout to be blocked on the pending pod, got %v", b)
+	}
+	if hb.Status.Rollback == nil || hb.Status.Rollback.FailedRevision != sts.Annotations[HBaseControllerRevisionKey] {
+		t.Errorf("expected rollback of the revision that never got scheduled, got %v", hb.Status.Rollback)
+	}
+	p := &corev1.Pod{}
+	if err := r.Get(ctx, types.NamespacedName{Name: "regionserver-0", Namespace: hb.Namespace}, p); err != nil {
+		t.Errorf("expected the healthy pod of the old revision to be kept: %v", err)
+	}
+}
+
+func TestRevisionHistoryLimit(t *testing.T) {
+	ctx := context.Background()
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{
+		RegionServerSpec: hbasev1.ServerSpec{Count: 1, PodSpec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "server", Image: "hbase:0"}},
+		}},
+	}}
+	r := newHistoryTestReconciler(t, hb)
+	stsName := types.NamespacedName{Name: "regionserver", Namespace: hb.Namespace}
+
+	var first, current string
+	for i := 0; i < defaultRevisionHistoryLimit+5; i++ {
+		hb.Spec.RegionServerSpec.PodSpec.Containers[0].Image = fmt.Sprintf("hbase:%d", i)
+		sts, rev := r.statefulSet(hb, stsName, rsConfigMapName(hb), hb.Spec.RegionServerSpec)
+		if i == 0 {
+			first = rev
+			hb.Status.StableRevisions = map[string]string{stsName.Name: rev}
+		}
+		if err := r.recordRevision(ctx, hb, sts, rev); err != nil {
+			t.Fatal(err)
+		}
+		current = rev
+	}
+
+	revs, err := r.listRevisions(ctx, hb, stsName.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the stable revision counts towards the limit along with the current one
+	if len(revs) != defaultRevisionHistoryLimit {
+		t.Errorf("expected %d revisions, got %d", defaultRevisionHistoryLimit, len(revs))
+	}
+	if revs[0].Name != controllerRevisionName(stsName.Name, first) {
+		t.Errorf("expected stable revision to be kept, got %s", revs[0].Name)
+	}
+	if last := revs[len(revs)-1].Annotations[HBaseControllerRevisionKey]; last != current {
+		t.Errorf("expected current revision to be kept, got %s", last)
+	}
+	if revs[1].Revision != 7 {
+		t.Errorf("expected the oldest revisions to be removed, got revision %d", revs[1].Revision)
+	}
+	if _, err := r.revisionStatefulSet(ctx, stsName, first); err != nil {
+		t.Errorf("expected stable revision in history: %v", err)
+	}
+}
+
+func TestDeleteUnusedConfigMaps(t *testing.T) {
+	ctx := context.Background()
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{RevisionHistoryLimit: ptr.To(int32(1))}}
+	r := newHistoryTestReconciler(t, hb)
+
+	for i := 0; i < 4; i++ {
+		hb.Generation = int64(i + 1)
+		hb.Spec.Config.Data = map[string]string{"hbase-site.xml": fmt.Sprint(i)}
+		cm, err := r.configMap(hb, rsConfigMapName(hb), "regionserver", hb.Spec.Config.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cm.Annotations[HBaseControllerCreatedKey] = time.Date(2026, 1, i+1, 0, 0, 0, 0, time.UTC).Format(time.RFC3339)
+		if err := r.Create(ctx, cm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current := rsConfigMapName(hb)
+	if err := r.deleteUnusedConfigMaps(ctx, hb, current); err != nil {
+		t.Fatal(err)
+	}
+
+	l := &corev1.ConfigMapList{}
+	if err := r.List(ctx, l); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, cm := range l.Items {
+		names = append(names, cm.Name)
+		if cm.Annotations[HBaseControllerGenerationKey] == "" {
+			t.Errorf("expected generation annotation on %s", cm.Name)
+		}
+	}
+	hb.Spec.Config.Data = map[string]string{"hbase-site.xml": "2"}
+	previous := rsConfigMapName(hb)
+	if len(names) != 2 || !slices.Contains(names, current.Name) || !slices.Contains(names, previous.Name) {
+		t.Errorf("expected current %s and previous %s ConfigMaps to be kept, got %v",
+			current.Name, previous.Name, names)
+	}
+
+	// point the spec at the previous revision
+	hb.Spec.Config.Revision = previous.Name
+	if name := rsConfigMapName(hb); name != previous {
+		t.Errorf("expected ConfigMap %s, got %s", previous, name)
+	}
+	hb.Spec.Config.Revision = "config-deadbeef"
+	if _, err := r.ensureConfigMap(hb, rsConfigMapName(hb), "regionserver", hb.Spec.Config.Data); err == nil {
+		t.Error("expected error for missing revision")
+	}
+
+	// the revision of a role overrides the shared one
+	hb.Spec.RegionServerSpec.Config = &hbasev1.ServerConfig{Revision: previous.Name}
+	if name := rsConfigMapName(hb); name != previous {
+		t.Errorf("expected ConfigMap %s, got %s", previous, name)
+	}
+	if rev := configRevision(hb, masterRole); rev != "config-deadbeef" {
+		t.Errorf("expected master revision config-deadbeef, got %q", rev)
+	}
+
+	// a shared revision is rejected if both roles use it with different configs
+	hb.Spec.RegionServerSpec.Config = nil
+	master := map[string]string{"hbase-site.xml": "master"}
+	if err := validateConfigRevision(hb, master, hb.Spec.Config.Data); err == nil {
+		t.Error("expected error for shared revision of different configs")
+	}
+	if err := validateConfigRevision(hb, hb.Spec.Config.Data, hb.Spec.Config.Data); err != nil {
+		t.Errorf("unexpected error for shared revision of same configs: %v", err)
+	}
+	hb.Spec.MasterSpec.Config = &hbasev1.ServerConfig{Revision: previous.Name}
+	if err := validateConfigRevision(hb, master, hb.Spec.Config.Data); err != nil {
+		t.Errorf("unexpected error for per-role revision: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tsuna/gohbase/pb"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// minRequestSampleInterval is how long apart samples of request counters have
+// to be for request rates to be computed from them
+const minRequestSampleInterval = 10 * time.Second
+
+// requestRates computes request rates of regions out of samples of their request
+// counters. Counters in the cluster status accumulate since regions were opened,
+// so they tell how long regions have been open rather than how loaded they are.
+type requestRates struct {
+	mu      sync.Mutex
+	samples map[types.NamespacedName]*requestSample
+}
+
+type requestSample struct {
+	time time.Time
+	// counts are request counters per encoded region name
+	counts map[string]uint64
+	// rates are requests per second per encoded region name since the previous sample
+	rates map[string]float64
+}
+
+// update samples request counters of regions of the cluster and returns requests
+// per second per encoded region name. Regions that weren't in the previous sample,
+// or were reopened since, have no rate.
+func (rr *requestRates) update(key types.NamespacedName, rrs map[string][]*pb.RegionLoad,
+	now time.Time) map[string]float64 {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	prev := rr.samples[key]
+	if prev != nil && now.Sub(prev.time) < minRequestSampleInterval {
+		return prev.rates
+	}
+	s := &requestSample{time: now, counts: map[string]uint64{}, rates: map[string]float64{}}
+	for _, regions := range rrs {
+		for _, rl := range regions {
+			name := string(encodedRegionName(rl))
+			count := rl.GetReadRequestsCount() + rl.GetWriteRequestsCount()
+			s.counts[name] = count
+			if prev == nil {
+				continue
+			}
+			if c, ok := prev.counts[name]; ok && count >= c {
+				s.rates[name] = float64(count-c) / now.Sub(prev.time).Seconds()
+			}
+		}
+	}
+	if rr.samples == nil {
+		rr.samples = map[types.NamespacedName]*requestSample{}
+	}
+	rr.samples[key] = s
+	return s.rates
+}
+
+// forget drops samples of the cluster
+func (rr *requestRates) forget(key types.NamespacedName) {
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	delete(rr.samples, key)
+}
@@ -0,0 +1,73 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tsuna/gohbase/pb"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestRequestRates(t *testing.T) {
+	region := func(i int, requests uint64) *pb.RegionLoad {
+		return &pb.RegionLoad{
+			RegionSpecifier: &pb.RegionSpecifier{
+				Type:  pb.RegionSpecifier_REGION_NAME.Enum(),
+				Value: []byte(regionName(i)),
+			},
+			ReadRequestsCount:  proto.Uint64(requests),
+			WriteRequestsCount: proto.Uint64(requests),
+		}
+	}
+	key := types.NamespacedName{Namespace: "default", Name: "hbase"}
+	now := time.Now()
+	var rr requestRates
+
+	// the first sample has no rates
+	rates := rr.update(key, map[string][]*pb.RegionLoad{
+		"rs-0": {region(0, 1000000), region(1, 10)},
+	}, now)
+	if len(rates) != 0 {
+		t.Fatalf("expected no rates, got %v", rates)
+	}
+
+	// samples that are too close keep the previous rates
+	rates = rr.update(key, map[string][]*pb.RegionLoad{
+		"rs-0": {region(0, 1000000), region(1, 20)},
+	}, now.Add(time.Second))
+	if len(rates) != 0 {
+		t.Fatalf("expected no rates, got %v", rates)
+	}
+
+	// rates are computed from the difference of counters, new
+	// and reopened regions have no rate
+	rates = rr.update(key, map[string][]*pb.RegionLoad{
+		"rs-0": {region(0, 1000100)},
+		"rs-1": {region(1, 5), region(2, 100)},
+	}, now.Add(20*time.Second))
+	expected := map[string]float64{fmt.Sprintf("%032d", 0): 10}
+	if fmt.Sprint(rates) != fmt.Sprint(expected) {
+		t.Fatalf("expected rates %v, got %v", expected, rates)
+	}
+
+	rr.forget(key)
+	if len(rr.samples) != 0 {
+		t.Fatalf("expected samples to be forgotten: %v", rr.samples)
+	}
+}
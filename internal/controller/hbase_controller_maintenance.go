@@ -0,0 +1,95 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// HBaseControllerMaintenanceOverrideKey is the annotation of HBase that allows
+// to restart pods outside of maintenance windows when set to "true"
+const HBaseControllerMaintenanceOverrideKey = "hbase-controller-maintenance-override"
+
+// maintenanceState returns whether pods are allowed to be restarted at time t
+// and the time it changes next
+func maintenanceState(hb *hbasev1.HBase, t time.Time) (bool, time.Time, error) {
+	if len(hb.Spec.MaintenanceWindows) == 0 {
+		return true, time.Time{}, nil
+	}
+	in, next, err := inWindows(hb.Spec.MaintenanceWindows, t)
+	if err != nil {
+		return false, time.Time{}, fmt.Errorf("invalid maintenance windows: %w", err)
+	}
+	return in, next, nil
+}
+
+// inMaintenanceWindow wraps pick so that pods are picked to be deleted only within
+// maintenance windows. Outside of windows, pick isn't called, so that the balancer
+// stays off and drain records are kept until the rollout resumes.
+func (r *HBaseReconciler) inMaintenanceWindow(pick pickPodToDeleteFunc) pickPodToDeleteFunc {
+	return func(ctx context.Context, hb *hbasev1.HBase,
+		td, utd []*corev1.Pod) ([]*corev1.Pod, bool, error) {
+		in, next, err := maintenanceState(hb, time.Now())
+		if err != nil {
+			return nil, false, err
+		}
+		if len(hb.Spec.MaintenanceWindows) == 0 {
+			hb.Status.Maintenance = nil
+		} else {
+			hb.Status.Maintenance = &hbasev1.MaintenanceStatus{InWindow: in}
+			if !next.IsZero() {
+				hb.Status.Maintenance.NextTransitionTime = &metav1.Time{Time: next}
+			}
+		}
+		if in || len(td) == 0 || hb.Annotations[HBaseControllerMaintenanceOverrideKey] == "true" {
+			return pick(ctx, hb, td, utd)
+		}
+
+		r.Log.Info("outside of maintenance window, pod restarts are pending",
+			"pods", sprintPodList(td), "next", next)
+		hb.Status.Maintenance.ChangesPending = true
+		return nil, false, nil
+	}
+}
+
+// maintenanceResult returns the result of reconcile that waits for pods. If pod
+// restarts are pending, it reconciles again once the next maintenance window starts,
+// or earlier if the balancer or the normalizer is switched before that.
+func maintenanceResult(hb *hbasev1.HBase) ctrl.Result {
+	m := hb.Status.Maintenance
+	if m == nil || !m.ChangesPending {
+		return ctrl.Result{RequeueAfter: 15 * time.Second}
+	}
+	hb.Status.ReconcileProgress = hbasev1.HBaseProgressWaitingMaintenance
+	// no window within a week, check again later in case the windows change
+	after := time.Hour
+	if m.NextTransitionTime != nil {
+		after = time.Until(m.NextTransitionTime.Time)
+	}
+	// switch balancer or normalizer at the edge of their windows meanwhile
+	if next := nextSwitchTransition(hb, time.Now()); !next.IsZero() {
+		after = min(after, time.Until(next))
+	}
+	// the edge may have just passed or the clock may be skewed, and
+	// RequeueAfter that isn't positive doesn't requeue at all
+	return ctrl.Result{RequeueAfter: max(after, time.Second)}
+}
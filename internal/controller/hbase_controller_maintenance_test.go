@@ -0,0 +1,157 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestInMaintenanceWindow(t *testing.T) {
+	var picked [][]*corev1.Pod
+	pick := func(_ context.Context, _ *hbasev1.HBase, td, _ []*corev1.Pod) ([]*corev1.Pod, bool, error) {
+		picked = append(picked, td)
+		if len(td) == 0 {
+			return nil, true, nil
+		}
+		return td[:1], false, nil
+	}
+	r := &HBaseReconciler{Log: logr.Discard()}
+	td := makePods("regionserver-0", "regionserver-1")
+
+	// February 31st never comes
+	never := hbasev1.TimeWindow{Schedule: "0 0 31 2 *", Duration: &metav1.Duration{Duration: time.Hour}}
+	always := hbasev1.TimeWindow{Start: "00:00", End: "00:00"}
+
+	tests := []struct {
+		name     string
+		windows  []hbasev1.TimeWindow
+		override string
+		expectTd int
+		expectOk bool
+		pending  bool
+		paused   bool
+	}{
+		{name: "no windows", expectTd: 2, expectOk: true},
+		{name: "within window", windows: []hbasev1.TimeWindow{always}, expectTd: 2, expectOk: true},
+		{name: "outside of window", windows: []hbasev1.TimeWindow{never}, pending: true, paused: true},
+		{name: "override", windows: []hbasev1.TimeWindow{never}, override: "true", expectTd: 2, expectOk: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			picked = nil
+			hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{MaintenanceWindows: test.windows}}
+			if test.override != "" {
+				hb.Annotations = map[string]string{HBaseControllerMaintenanceOverrideKey: test.override}
+			}
+			ps, _, err := r.inMaintenanceWindow(pick)(context.Background(), hb, td, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(ps) != 0) != test.expectOk {
+				t.Errorf("expected pod to be picked %v, got %v", test.expectOk, sprintPodList(ps))
+			}
+			if test.paused {
+				// pick isn't called, so that it doesn't restore the balancer or drop drain records
+				if len(picked) != 0 {
+					t.Errorf("expected no pick while paused, got %v", picked)
+				}
+			} else if len(picked) != 1 || len(picked[0]) != test.expectTd {
+				t.Errorf("expected pick with %d pods, got %v", test.expectTd, picked)
+			}
+			pending := hb.Status.Maintenance != nil && hb.Status.Maintenance.ChangesPending
+			if pending != test.pending {
+				t.Errorf("expected changes pending %v, got %v", test.pending, pending)
+			}
+			if len(test.windows) == 0 && hb.Status.Maintenance != nil {
+				t.Errorf("expected no maintenance status, got %v", hb.Status.Maintenance)
+			}
+		})
+	}
+}
+
+func TestEnsureStatefulSetPodsOutsideMaintenanceWindow(t *testing.T) {
+	ctx := context.Background()
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{MaintenanceWindows: []hbasev1.TimeWindow{
+		// February 31st never comes
+		{Schedule: "0 0 31 2 *", Duration: &metav1.Duration{Duration: time.Hour}},
+	}}}
+	r := newHistoryTestReconciler(t, hb)
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: "regionserver", Namespace: hb.Namespace},
+		Spec: appsv1.StatefulSetSpec{Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{HBaseControllerNameKey: "regionserver"},
+		}}},
+		Status: appsv1.StatefulSetStatus{UpdateRevision: "new"},
+	}
+	for i, ready := range []corev1.ConditionStatus{corev1.ConditionTrue, corev1.ConditionFalse} {
+		p := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      fmt.Sprintf("regionserver-%d", i),
+				Namespace: hb.Namespace,
+				Labels: map[string]string{
+					HBaseControllerNameKey:          "regionserver",
+					appsv1.StatefulSetRevisionLabel: "old",
+				},
+			},
+			Status: corev1.PodStatus{Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: ready}}},
+		}
+		if err := r.Create(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pick := r.inMaintenanceWindow(pickWithoutDrain)
+
+	// the pod of the old revision that isn't ready is replaced outside of windows
+	if ok, err := r.ensureStatefulSetPods(ctx, hb, sts, pick); err != nil || ok {
+		t.Fatalf("expected pod to be deleted: %v", err)
+	}
+	p := &corev1.Pod{}
+	if err := r.Get(ctx, types.NamespacedName{Name: "regionserver-1", Namespace: hb.Namespace}, p); !errors.IsNotFound(err) {
+		t.Errorf("expected pod that isn't ready to be deleted: %v", err)
+	}
+
+	// the ready one waits for the window
+	if ok, err := r.ensureStatefulSetPods(ctx, hb, sts, pick); err != nil || ok {
+		t.Fatalf("expected pods to wait: %v", err)
+	}
+	if err := r.Get(ctx, types.NamespacedName{Name: "regionserver-0", Namespace: hb.Namespace}, p); err != nil {
+		t.Errorf("expected ready pod to be kept: %v", err)
+	}
+	if m := hb.Status.Maintenance; m == nil || !m.ChangesPending {
+		t.Errorf("expected changes to be pending: %v", m)
+	}
+}
+
+func TestMaintenanceResultRequeuesAfterPassedTransition(t *testing.T) {
+	// the window has just started, but pods haven't been picked yet
+	hb := &hbasev1.HBase{Status: hbasev1.HBaseStatus{Maintenance: &hbasev1.MaintenanceStatus{
+		ChangesPending:     true,
+		NextTransitionTime: &metav1.Time{Time: time.Now().Add(-time.Second)},
+	}}}
+	if res := maintenanceResult(hb); res.RequeueAfter <= 0 {
+		t.Errorf("expected to reconcile again, got %v", res)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	hbaseEnvFile       = "hbase-env.sh"
+	defaultHeapPercent = 50
+	// memoryHeadroomPercent of the memory limit is left to the JVM outside of
+	// the heap and direct memory, such as metaspace, thread stacks and GC,
+	// so that the container isn't killed for running out of memory
+	memoryHeadroomPercent = 10
+)
+
+// serverContainer returns the server container of the pod spec
+func serverContainer(ps corev1.PodSpec, name string) (*corev1.Container, error) {
+	for i := range ps.Containers {
+		if name == "" || ps.Containers[i].Name == name {
+			return &ps.Containers[i], nil
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("pod spec has no containers")
+	}
+	return nil, fmt.Errorf("container %q is not found", name)
+}
+
+// memoryConfigData returns the config data with JVM memory settings derived
+// from the memory limit of the server container. Settings are appended to
+// hbase-env.sh, so that they override ones set earlier in the file.
+func memoryConfigData(ss hbasev1.ServerSpec, data map[string]string) (map[string]string, error) {
+	m := ss.Memory
+	if m == nil {
+		return data, nil
+	}
+	c, err := serverContainer(ss.PodSpec, m.Container)
+	if err != nil {
+		return nil, fmt.Errorf("invalid memory sizing: %w", err)
+	}
+	limit, ok := c.Resources.Limits[corev1.ResourceMemory]
+	if !ok || limit.IsZero() {
+		return nil, fmt.Errorf("invalid memory sizing: container %q has no memory limit", c.Name)
+	}
+	heapPercent := int64(ptr.Deref(m.HeapPercent, defaultHeapPercent))
+	offHeapPercent, bucketCachePercent := int64(m.OffHeapPercent), int64(m.BucketCachePercent)
+	if heapPercent+offHeapPercent > 100-memoryHeadroomPercent {
+		return nil, fmt.Errorf("invalid memory sizing: heap and off-heap are %d%% of the memory limit, "+
+			"%d%% at most leaves headroom for the rest of the JVM", heapPercent+offHeapPercent,
+			100-memoryHeadroomPercent)
+	}
+	// direct memory is also used for RPC and HDFS buffers, so the bucket
+	// cache can't take all of it
+	if bucketCachePercent > 0 && bucketCachePercent >= offHeapPercent {
+		return nil, fmt.Errorf("invalid memory sizing: bucket cache of %d%% leaves no headroom in off-heap of %d%%",
+			bucketCachePercent, offHeapPercent)
+	}
+
+	// sizes are in MiB
+	mib := limit.Value() >> 20
+	env := data[hbaseEnvFile]
+	if env != "" && !strings.HasSuffix(env, "\n") {
+		env += "\n"
+	}
+	env += fmt.Sprintf("# sized from memory limit %s of container %s\n", limit.String(), c.Name)
+	env += fmt.Sprintf("export HBASE_HEAPSIZE=%dm\n", mib*heapPercent/100)
+	if offHeapPercent > 0 {
+		env += fmt.Sprintf("export HBASE_OFFHEAPSIZE=%dm\n", mib*offHeapPercent/100)
+	}
+	data = cloneMap(map[string]string{hbaseEnvFile: env}, data)
+	if bucketCachePercent == 0 {
+		return data, nil
+	}
+	return setSiteProperties(data, hbaseSiteFile, map[string]string{
+		"hbase.bucketcache.ioengine": "offheap",
+		"hbase.bucketcache.size":     fmt.Sprint(mib * bucketCachePercent / 100),
+	})
+}
@@ -0,0 +1,108 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/utils/ptr"
+)
+
+func TestMemoryConfigData(t *testing.T) {
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{
+		Config: hbasev1.ConfigMap{Data: map[string]string{
+			hbaseSiteFile: siteXML("hbase.rootdir", "hdfs://nn"),
+			hbaseEnvFile:  "export HBASE_HEAPSIZE=1G",
+		}},
+		RegionServerSpec: hbasev1.ServerSpec{PodSpec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "sidecar"},
+			{Name: "server", Resources: corev1.ResourceRequirements{Limits: corev1.ResourceList{
+				corev1.ResourceMemory: resource.MustParse("8Gi"),
+			}}},
+		}}},
+	}}
+	r := &HBaseReconciler{}
+	ss := hb.Spec.RegionServerSpec
+
+	// without memory sizing, data is kept
+	data, err := r.roleConfigData(hb, "regionserver", hb.Spec.Config.Data, ss, hbasev1.ConfigProperties{})
+	if err != nil || data[hbaseEnvFile] != "export HBASE_HEAPSIZE=1G" {
+		t.Fatalf("expected data to be kept: %v, %v", data, err)
+	}
+	name := getConfigMapName(hb, "regionserver", data, nil)
+
+	ss.Memory = &hbasev1.MemorySpec{Container: "server", HeapPercent: ptr.To(int32(40)),
+		OffHeapPercent: 40, BucketCachePercent: 30}
+	data, err = r.roleConfigData(hb, "regionserver", hb.Spec.Config.Data, ss, hbasev1.ConfigProperties{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `export HBASE_HEAPSIZE=1G
+# sized from memory limit 8Gi of container server
+export HBASE_HEAPSIZE=3276m
+export HBASE_OFFHEAPSIZE=3276m
+`
+	if data[hbaseEnvFile] != expected {
+		t.Errorf("unexpected %s:\n%s", hbaseEnvFile, data[hbaseEnvFile])
+	}
+	props, err := parseSiteXML(data[hbaseSiteFile])
+	if err != nil || props["hbase.bucketcache.size"] != "2457" || props["hbase.bucketcache.ioengine"] != "offheap" ||
+		props["hbase.rootdir"] != "hdfs://nn" {
+		t.Errorf("unexpected %s: %v, %v", hbaseSiteFile, props, err)
+	}
+	if hb.Spec.Config.Data[hbaseEnvFile] != "export HBASE_HEAPSIZE=1G" {
+		t.Error("expected spec to be kept")
+	}
+	sized := getConfigMapName(hb, "regionserver", data, nil)
+	if sized == name {
+		t.Error("expected memory sizing to change the ConfigMap name")
+	}
+
+	// heap and off-heap can take the limit except the JVM headroom
+	full := ss
+	full.Memory = &hbasev1.MemorySpec{Container: "server", HeapPercent: ptr.To(int32(50)), OffHeapPercent: 40}
+	if _, err := r.roleConfigData(hb, "regionserver", hb.Spec.Config.Data, full, hbasev1.ConfigProperties{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// a change of the limit changes the ConfigMap
+	ss.PodSpec = *ss.PodSpec.DeepCopy()
+	ss.PodSpec.Containers[1].Resources.Limits[corev1.ResourceMemory] = resource.MustParse("16Gi")
+	data, err = r.roleConfigData(hb, "regionserver", hb.Spec.Config.Data, ss, hbasev1.ConfigProperties{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getConfigMapName(hb, "regionserver", data, nil) == sized {
+		t.Error("expected memory limit to change the ConfigMap name")
+	}
+
+	for _, m := range []*hbasev1.MemorySpec{
+		{},                   // the first container has no limit
+		{Container: "other"}, // unknown container
+		{Container: "server", HeapPercent: ptr.To(int32(80)), OffHeapPercent: 30},
+		{Container: "server", HeapPercent: ptr.To(int32(60)), OffHeapPercent: 40}, // no JVM headroom
+		{Container: "server", HeapPercent: ptr.To(int32(95))},                     // no JVM headroom
+		{Container: "server", OffHeapPercent: 10, BucketCachePercent: 20},
+		{Container: "server", OffHeapPercent: 20, BucketCachePercent: 20}, // no direct memory headroom
+	} {
+		ss.Memory = m
+		if _, err := r.roleConfigData(hb, "regionserver", hb.Spec.Config.Data, ss, hbasev1.ConfigProperties{}); err == nil {
+			t.Errorf("expected error for memory sizing %+v", m)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	"github.com/tsuna/gohbase/hrpc"
+	"github.com/tsuna/gohbase/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+// setNormalizerRunning is the master RPC to switch the region normalizer.
+// gohbase doesn't provide it, so it's sent with SendRPC of the admin client.
+type setNormalizerRunning struct {
+	ctx      context.Context
+	region   hrpc.RegionInfo
+	resultch chan hrpc.RPCResult
+	req      *pb.SetNormalizerRunningRequest
+}
+
+func newSetNormalizerRunning(ctx context.Context, enabled bool) *setNormalizerRunning {
+	return &setNormalizerRunning{
+		ctx:      ctx,
+		resultch: make(chan hrpc.RPCResult, 1),
+		req:      &pb.SetNormalizerRunningRequest{On: proto.Bool(enabled)},
+	}
+}
+
+func (c *setNormalizerRunning) Table() []byte                    { return nil }
+func (c *setNormalizerRunning) Name() string                     { return "SetNormalizerRunning" }
+func (c *setNormalizerRunning) Key() []byte                      { return nil }
+func (c *setNormalizerRunning) Region() hrpc.RegionInfo          { return c.region }
+func (c *setNormalizerRunning) SetRegion(region hrpc.RegionInfo) { c.region = region }
+func (c *setNormalizerRunning) ToProto() proto.Message           { return c.req }
+func (c *setNormalizerRunning) NewResponse() proto.Message       { return &pb.SetNormalizerRunningResponse{} }
+func (c *setNormalizerRunning) ResultChan() chan hrpc.RPCResult  { return c.resultch }
+func (c *setNormalizerRunning) Description() string              { return c.Name() }
+func (c *setNormalizerRunning) Context() context.Context         { return c.ctx }
+
+// ensureNormalizer sets the region normalizer according to the normalizer policy.
+// Without the policy, the normalizer is left as is.
+func (r *HBaseReconciler) ensureNormalizer(ctx context.Context, hb *hbasev1.HBase) error {
+	enabled, ok, next, err := desiredSwitchState(hb.Spec.Normalizer, time.Now())
+	if err != nil {
+		return fmt.Errorf("invalid normalizer policy: %w", err)
+	}
+	if !ok {
+		hb.Status.Normalizer = nil
+		return nil
+	}
+	msg, err := r.GhAdmin.SendRPC(newSetNormalizerRunning(ctx, enabled))
+	if err != nil {
+		return err
+	}
+	res, ok := msg.(*pb.SetNormalizerRunningResponse)
+	if !ok {
+		return fmt.Errorf("unexpected response type %T", msg)
+	}
+	if res.GetPrevNormalizerValue() != enabled {
+		r.Log.Info("switched normalizer", "enabled", enabled)
+	}
+	hb.Status.Normalizer = switchStatus(enabled, next)
+	return nil
+}
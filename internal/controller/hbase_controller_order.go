@@ -0,0 +1,90 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"slices"
+	"strconv"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	"github.com/tsuna/gohbase/pb"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// HBaseControllerRestartPriorityKey is the annotation of RegionServer pods that
+// orders their restarts with the Priority restart order, higher restarts first
+const HBaseControllerRestartPriorityKey = "hbase-controller-restart-priority"
+
+// restartPriority returns the restart priority of the pod, invalid priorities are 0
+func restartPriority(p *corev1.Pod) int64 {
+	v, err := strconv.ParseInt(p.Annotations[HBaseControllerRestartPriorityKey], 10, 64)
+	if err != nil {
+		return 0
+	}
+	return v
+}
+
+// orderRegionServers returns RegionServers to restart in the restart order given
+// request rates per encoded region name. Ties keep the ordinal order.
+func orderRegionServers(hb *hbasev1.HBase, td []*corev1.Pod,
+	rrs map[string][]*pb.RegionLoad, rates map[string]float64) []*corev1.Pod {
+	var key func(p *corev1.Pod) float64
+	switch hb.Spec.Rollout.Order {
+	case hbasev1.FewestRegionsRestartOrder:
+		key = func(p *corev1.Pod) float64 {
+			return float64(len(podRegions(p, rrs)))
+		}
+	case hbasev1.LowestLoadRestartOrder:
+		key = func(p *corev1.Pod) float64 {
+			var rate float64
+			for _, rl := range podRegions(p, rrs) {
+				rate += rates[string(encodedRegionName(rl))]
+			}
+			return rate
+		}
+	case hbasev1.PriorityRestartOrder:
+		key = func(p *corev1.Pod) float64 {
+			return -float64(restartPriority(p))
+		}
+	default:
+		return td
+	}
+
+	keys := make(map[*corev1.Pod]float64, len(td))
+	for _, p := range td {
+		keys[p] = key(p)
+	}
+	ordered := slices.Clone(td)
+	slices.SortStableFunc(ordered, func(a, b *corev1.Pod) int {
+		switch {
+		case keys[a] < keys[b]:
+			return -1
+		case keys[a] > keys[b]:
+			return 1
+		}
+		return 0
+	})
+	return ordered
+}
+
+// podRegions returns regions of the RegionServer of the pod
+func podRegions(p *corev1.Pod, rrs map[string][]*pb.RegionLoad) []*pb.RegionLoad {
+	for rs, regions := range rrs {
+		if isPodServer(p, rs) {
+			return regions
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"testing"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	"github.com/tsuna/gohbase/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestOrderRegionServers(t *testing.T) {
+	var n int
+	rates := map[string]float64{}
+	load := func(requestRates ...float64) []*pb.RegionLoad {
+		var rls []*pb.RegionLoad
+		for _, r := range requestRates {
+			n++
+			rates[fmt.Sprintf("%032d", n)] = r
+			rls = append(rls, &pb.RegionLoad{
+				RegionSpecifier: &pb.RegionSpecifier{
+					Type:  pb.RegionSpecifier_REGION_NAME.Enum(),
+					Value: []byte(regionName(n)),
+				},
+				// cumulative counters don't tell the load
+				ReadRequestsCount: proto.Uint64(uint64(1000000 / n)),
+			})
+		}
+		return rls
+	}
+	rrs := map[string][]*pb.RegionLoad{
+		"regionserver-0.hbase,16020,1": load(1, 1, 1),
+		"regionserver-1.hbase,16020,1": load(100),
+		"regionserver-2.hbase,16020,1": load(10, 10),
+		"regionserver-3.hbase,16020,1": load(1),
+	}
+
+	for _, tc := range []struct {
+		order    hbasev1.RestartOrder
+		expected string
+	}{
+		{"", "[regionserver-3 regionserver-2 regionserver-1 regionserver-0]"},
+		{hbasev1.OrdinalRestartOrder, "[regionserver-3 regionserver-2 regionserver-1 regionserver-0]"},
+		{hbasev1.FewestRegionsRestartOrder, "[regionserver-3 regionserver-1 regionserver-2 regionserver-0]"},
+		{hbasev1.LowestLoadRestartOrder, "[regionserver-3 regionserver-0 regionserver-2 regionserver-1]"},
+		{hbasev1.PriorityRestartOrder, "[regionserver-1 regionserver-3 regionserver-0 regionserver-2]"},
+	} {
+		t.Run(string(tc.order), func(t *testing.T) {
+			td := makePods("regionserver-3", "regionserver-2", "regionserver-1", "regionserver-0")
+			td[1].Annotations = map[string]string{HBaseControllerRestartPriorityKey: "-1"}
+			td[2].Annotations = map[string]string{HBaseControllerRestartPriorityKey: "10"}
+			td[3].Annotations = map[string]string{HBaseControllerRestartPriorityKey: "invalid"}
+			hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{Rollout: hbasev1.RolloutSpec{Order: tc.order}}}
+			if got := sprintPodList(orderRegionServers(hb, td, rrs, rates)); got != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultProgressDeadline is how long a step of the rollout can take by default
+const defaultProgressDeadline = 10 * time.Minute
+
+// stepDeadline returns how long the step of the rollout can take
+func stepDeadline(hb *hbasev1.HBase, step hbasev1.RolloutStep) time.Duration {
+	var s int32
+	switch step {
+	case hbasev1.StepRegionsInTransition:
+		s = hb.Spec.Rollout.StepDeadlines.RegionsInTransitionSeconds
+	case hbasev1.StepPodReady:
+		s = hb.Spec.Rollout.StepDeadlines.PodReadySeconds
+	case hbasev1.StepDrain:
+		s = hb.Spec.Rollout.StepDeadlines.DrainSeconds
+	}
+	if s == 0 {
+		s = hb.Spec.Rollout.ProgressDeadlineSeconds
+	}
+	if s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return defaultProgressDeadline
+}
+
+// blocked records that the rollout waits on the step for the object. Once the
+// step exceeds its deadline, HBase is marked stalled.
+func (r *HBaseReconciler) blocked(hb *hbasev1.HBase, step hbasev1.RolloutStep, object, reason string) {
+	r.blockedSince(hb, step, object, reason, metav1.Now())
+}
+
+// blockedSince is blocked for a step that started waiting at since, such as a drain
+// that started before it had to be waited on
+func (r *HBaseReconciler) blockedSince(hb *hbasev1.HBase, step hbasev1.RolloutStep, object, reason string,
+	since metav1.Time) {
+	b := hb.Status.Blocked
+	if b == nil || b.Step != step || b.Object != object {
+		b = &hbasev1.BlockedStatus{Step: step, Object: object, Since: since}
+		hb.Status.Blocked = b
+	}
+	b.Reason = reason
+
+	deadline := stepDeadline(hb, step)
+	if b.Stalled || time.Since(b.Since.Time) < deadline {
+		return
+	}
+	b.Stalled = true
+	msg := fmt.Sprintf("%s has been blocked for more than %v: %s", step, deadline, reason)
+	r.Log.Info("rollout is stalled", "step", step, "object", object, "reason", reason)
+	meta.SetStatusCondition(&hb.Status.Conditions, metav1.Condition{
+		Type:    hbasev1.ConditionStalled,
+		Status:  metav1.ConditionTrue,
+		Reason:  string(step) + "DeadlineExceeded",
+		Message: msg,
+	})
+	r.Recorder.Event(hb, corev1.EventTypeWarning, "RolloutStalled", msg)
+	hbaseRolloutStalledMetric.WithLabelValues(hb.Namespace, hb.Name, string(step)).Inc()
+}
+
+// progressed records that the rollout is not blocked anymore
+func (r *HBaseReconciler) progressed(hb *hbasev1.HBase) {
+	hb.Status.Blocked = nil
+	if meta.IsStatusConditionTrue(hb.Status.Conditions, hbasev1.ConditionStalled) {
+		meta.SetStatusCondition(&hb.Status.Conditions, metav1.Condition{
+			Type:   hbasev1.ConditionStalled,
+			Status: metav1.ConditionFalse,
+			Reason: "Progressing",
+		})
+	}
+}
+
+// unblocked records that the step of the rollout completed, for example once all
+// pods are ready, without waiting for the next pod to be deleted. If objects are
+// given, the step has to be blocked on one of them.
+func (r *HBaseReconciler) unblocked(hb *hbasev1.HBase, step hbasev1.RolloutStep, objects ...string) {
+	b := hb.Status.Blocked
+	if b == nil || b.Step != step || (len(objects) > 0 && !slices.Contains(objects, b.Object)) {
+		return
+	}
+	r.progressed(hb)
+}
+
+// waitingOnPolicy returns true if the rollout waits because of maintenance
+// windows or canary policies rather than HBase
+func waitingOnPolicy(hb *hbasev1.HBase) bool {
+	if m := hb.Status.Maintenance; m != nil && m.ChangesPending {
+		return true
+	}
+	c := hb.Status.Canary
+	return c != nil && c.SoakStartTime != nil && !c.Passed
+}
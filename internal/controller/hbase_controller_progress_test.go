@@ -0,0 +1,97 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestBlocked(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	r := &HBaseReconciler{Log: logr.Discard(), Recorder: recorder}
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{Rollout: hbasev1.RolloutSpec{
+		ProgressDeadlineSeconds: 60,
+		StepDeadlines:           hbasev1.StepDeadlines{PodReadySeconds: 600},
+	}}}
+	hb.Name, hb.Namespace = "blocked", "default"
+	stalled := func() float64 {
+		return testutil.ToFloat64(hbaseRolloutStalledMetric.WithLabelValues(
+			hb.Namespace, hb.Name, string(hbasev1.StepRegionsInTransition)))
+	}
+
+	r.blocked(hb, hbasev1.StepRegionsInTransition, "", "1 regions are in transition")
+	since := hb.Status.Blocked.Since
+	r.blocked(hb, hbasev1.StepRegionsInTransition, "", "2 regions are in transition")
+	if hb.Status.Blocked.Since != since || hb.Status.Blocked.Reason != "2 regions are in transition" {
+		t.Errorf("expected the same step to keep waiting since %v, got %v", since, hb.Status.Blocked)
+	}
+	if meta.FindStatusCondition(hb.Status.Conditions, hbasev1.ConditionStalled) != nil {
+		t.Error("expected no stalled condition before deadline")
+	}
+
+	// past the default deadline
+	hb.Status.Blocked.Since.Time = time.Now().Add(-2 * time.Minute)
+	r.blocked(hb, hbasev1.StepRegionsInTransition, "", "2 regions are in transition")
+	r.blocked(hb, hbasev1.StepRegionsInTransition, "", "2 regions are in transition")
+	if !meta.IsStatusConditionTrue(hb.Status.Conditions, hbasev1.ConditionStalled) {
+		t.Errorf("expected stalled condition, got %v", hb.Status.Conditions)
+	}
+	if v := stalled(); v != 1 {
+		t.Errorf("expected stall to be counted once, got %v", v)
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("expected one event, got %d", len(recorder.Events))
+	}
+
+	// the step override applies to another step
+	r.blocked(hb, hbasev1.StepPodReady, "regionserver-0", "pod is not ready")
+	hb.Status.Blocked.Since.Time = time.Now().Add(-2 * time.Minute)
+	r.blocked(hb, hbasev1.StepPodReady, "regionserver-0", "pod is not ready")
+	if hb.Status.Blocked.Stalled {
+		t.Error("expected pod readiness not to be stalled before its deadline")
+	}
+
+	// completion of another step or object keeps the rollout blocked
+	r.unblocked(hb, hbasev1.StepDrain)
+	r.unblocked(hb, hbasev1.StepPodReady, "regionserver-1")
+	if hb.Status.Blocked == nil {
+		t.Error("expected rollout to stay blocked")
+	}
+
+	// stall is cleared once the step completes
+	r.blocked(hb, hbasev1.StepDrain, "regionserver-0", "RegionServer has 1 regions left")
+	hb.Status.Blocked.Since.Time = time.Now().Add(-2 * time.Minute)
+	r.blocked(hb, hbasev1.StepDrain, "regionserver-0", "RegionServer has 1 regions left")
+	if !meta.IsStatusConditionTrue(hb.Status.Conditions, hbasev1.ConditionStalled) {
+		t.Fatalf("expected stalled condition, got %v", hb.Status.Conditions)
+	}
+	r.unblocked(hb, hbasev1.StepDrain, "regionserver-0")
+	if hb.Status.Blocked != nil || meta.IsStatusConditionTrue(hb.Status.Conditions, hbasev1.ConditionStalled) {
+		t.Errorf("expected completed step to clear the stall, got %v, %v", hb.Status.Blocked, hb.Status.Conditions)
+	}
+
+	r.blocked(hb, hbasev1.StepPodReady, "regionserver-0", "pod is not ready")
+	r.progressed(hb)
+	if hb.Status.Blocked != nil || meta.IsStatusConditionTrue(hb.Status.Conditions, hbasev1.ConditionStalled) {
+		t.Errorf("expected rollout to progress, got %v, %v", hb.Status.Blocked, hb.Status.Conditions)
+	}
+}
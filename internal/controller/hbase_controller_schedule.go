@@ -0,0 +1,164 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+)
+
+var weekdays = map[hbasev1.Weekday]time.Weekday{
+	"Sun": time.Sunday,
+	"Mon": time.Monday,
+	"Tue": time.Tuesday,
+	"Wed": time.Wednesday,
+	"Thu": time.Thursday,
+	"Fri": time.Friday,
+	"Sat": time.Saturday,
+}
+
+// interval is a period of time [start, end)
+type interval struct {
+	start, end time.Time
+}
+
+// windowIntervals returns occurrences of the window that overlap with [from, to)
+func windowIntervals(w hbasev1.TimeWindow, from, to time.Time) ([]interval, error) {
+	loc := time.UTC
+	if w.TimeZone != "" {
+		var err error
+		if loc, err = time.LoadLocation(w.TimeZone); err != nil {
+			return nil, fmt.Errorf("invalid time zone %q: %w", w.TimeZone, err)
+		}
+	}
+	if w.Schedule != "" {
+		return scheduleIntervals(w, loc, from, to)
+	}
+	start, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid window start %q: %w", w.Start, err)
+	}
+	end, err := time.Parse("15:04", w.End)
+	if err != nil {
+		return nil, fmt.Errorf("invalid window end %q: %w", w.End, err)
+	}
+	days := map[time.Weekday]bool{}
+	for _, d := range w.Days {
+		wd, ok := weekdays[d]
+		if !ok {
+			return nil, fmt.Errorf("invalid day of week %q", d)
+		}
+		days[wd] = true
+	}
+
+	var result []interval
+	// start a day early to account for windows that span midnight
+	from, to = from.In(loc), to.In(loc)
+	for d := time.Date(from.Year(), from.Month(), from.Day()-1, 0, 0, 0, 0, loc); d.Before(to); d = d.AddDate(0, 0, 1) {
+		if len(days) > 0 && !days[d.Weekday()] {
+			continue
+		}
+		i := interval{
+			start: time.Date(d.Year(), d.Month(), d.Day(), start.Hour(), start.Minute(), 0, 0, loc),
+			end:   time.Date(d.Year(), d.Month(), d.Day(), end.Hour(), end.Minute(), 0, 0, loc),
+		}
+		if !i.end.After(i.start) {
+			i.end = i.end.AddDate(0, 0, 1)
+		}
+		if i.end.After(from) && i.start.Before(to) {
+			result = append(result, i)
+		}
+	}
+	return result, nil
+}
+
+// maxScheduleOccurrences limits how many occurrences of a cron schedule are looked
+// at, so that a schedule like "* * * * *" doesn't take forever.
+const maxScheduleOccurrences = 10000
+
+// scheduleIntervals returns occurrences of the window specified as a cron schedule
+// of its start in location loc that overlap with [from, to)
+func scheduleIntervals(w hbasev1.TimeWindow, loc *time.Location, from, to time.Time) ([]interval, error) {
+	sched, err := cron.ParseStandard(w.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("invalid window schedule %q: %w", w.Schedule, err)
+	}
+	if w.Duration == nil || w.Duration.Duration <= 0 {
+		return nil, fmt.Errorf("window schedule %q requires positive duration", w.Schedule)
+	}
+	d := w.Duration.Duration
+
+	var result []interval
+	// start a duration early to account for the window already in progress,
+	// Next is exclusive so back off by a second more.
+	t := from.Add(-d - time.Second).In(loc)
+	for i := 0; i < maxScheduleOccurrences; i++ {
+		t = sched.Next(t)
+		if t.IsZero() || !t.Before(to) {
+			break
+		}
+		if iv := (interval{start: t, end: t.Add(d)}); iv.end.After(from) {
+			result = append(result, iv)
+		}
+	}
+	return result, nil
+}
+
+// windowsHorizon is how far ahead windows are looked at to find the next transition
+const windowsHorizon = 8 * 24 * time.Hour
+
+// inWindows returns whether time t is within any of the windows and the time the
+// state changes next. The returned time is zero if it doesn't change within a week.
+func inWindows(windows []hbasev1.TimeWindow, t time.Time) (bool, time.Time, error) {
+	var intervals []interval
+	for _, w := range windows {
+		is, err := windowIntervals(w, t, t.Add(windowsHorizon))
+		if err != nil {
+			return false, time.Time{}, err
+		}
+		intervals = append(intervals, is...)
+	}
+	if len(intervals) == 0 {
+		return false, time.Time{}, nil
+	}
+
+	// merge overlapping intervals
+	sort.Slice(intervals, func(i, j int) bool {
+		return intervals[i].start.Before(intervals[j].start)
+	})
+	merged := []interval{intervals[0]}
+	for _, i := range intervals[1:] {
+		last := &merged[len(merged)-1]
+		if i.start.After(last.end) {
+			merged = append(merged, i)
+		} else if i.end.After(last.end) {
+			last.end = i.end
+		}
+	}
+
+	for _, i := range merged {
+		if t.Before(i.start) {
+			return false, i.start, nil
+		}
+		if t.Before(i.end) {
+			return true, i.end, nil
+		}
+	}
+	return false, time.Time{}, nil
+}
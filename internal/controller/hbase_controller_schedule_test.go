@@ -0,0 +1,131 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestInWindows(t *testing.T) {
+	parse := func(s string) time.Time {
+		v, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	nightly := hbasev1.TimeWindow{Start: "22:00", End: "06:00"}
+	weekend := hbasev1.TimeWindow{Days: []hbasev1.Weekday{"Sat", "Sun"}, Start: "00:00", End: "00:00"}
+	pacific := hbasev1.TimeWindow{Start: "01:00", End: "02:00", TimeZone: "America/Los_Angeles"}
+	weekdayNights := hbasev1.TimeWindow{
+		Schedule: "0 22 * * 1-5",
+		Duration: &metav1.Duration{Duration: 8 * time.Hour},
+		TimeZone: "Europe/Berlin",
+	}
+
+	tests := []struct {
+		name    string
+		windows []hbasev1.TimeWindow
+		t       string
+		active  bool
+		next    string
+	}{
+		{
+			name: "no windows",
+			t:    "2026-10-14T12:00:00Z",
+		},
+		{
+			name:    "before nightly window",
+			windows: []hbasev1.TimeWindow{nightly},
+			t:       "2026-10-14T12:00:00Z",
+			next:    "2026-10-14T22:00:00Z",
+		},
+		{
+			name:    "within nightly window after midnight",
+			windows: []hbasev1.TimeWindow{nightly},
+			t:       "2026-10-14T03:00:00Z",
+			active:  true,
+			next:    "2026-10-14T06:00:00Z",
+		},
+		{
+			name:    "overlapping windows are merged",
+			windows: []hbasev1.TimeWindow{nightly, weekend},
+			// Friday night
+			t:      "2026-10-16T23:00:00Z",
+			active: true,
+			next:   "2026-10-19T06:00:00Z",
+		},
+		{
+			name:    "weekend window on weekday",
+			windows: []hbasev1.TimeWindow{weekend},
+			// Wednesday
+			t:    "2026-10-14T12:00:00Z",
+			next: "2026-10-17T00:00:00Z",
+		},
+		{
+			name:    "time zone",
+			windows: []hbasev1.TimeWindow{pacific},
+			t:       "2026-10-14T08:30:00Z",
+			active:  true,
+			next:    "2026-10-14T09:00:00Z",
+		},
+		{
+			name:    "within cron window",
+			windows: []hbasev1.TimeWindow{weekdayNights},
+			// Wednesday 01:00 in Berlin
+			t:      "2026-10-13T23:00:00Z",
+			active: true,
+			next:   "2026-10-14T04:00:00Z",
+		},
+		{
+			name:    "cron window on weekend",
+			windows: []hbasev1.TimeWindow{weekdayNights},
+			// Saturday
+			t:    "2026-10-17T12:00:00Z",
+			next: "2026-10-19T20:00:00Z",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			active, next, err := inWindows(test.windows, parse(test.t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if active != test.active {
+				t.Errorf("expected active %v, got %v", test.active, active)
+			}
+			if test.next == "" {
+				if !next.IsZero() {
+					t.Errorf("expected no next transition, got %v", next)
+				}
+			} else if !next.Equal(parse(test.next)) {
+				t.Errorf("expected next transition at %v, got %v", test.next, next)
+			}
+		})
+	}
+
+	if _, _, err := inWindows([]hbasev1.TimeWindow{{Start: "01:00", End: "02:00", TimeZone: "Mars/Olympus"}},
+		time.Now()); err == nil {
+		t.Error("expected error for invalid time zone")
+	}
+	if _, _, err := inWindows([]hbasev1.TimeWindow{{Schedule: "0 22 * * *"}}, time.Now()); err == nil {
+		t.Error("expected error for schedule without duration")
+	}
+}
@@ -0,0 +1,249 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+)
+
+const (
+	masterRole       = "hbasemaster"
+	regionServerRole = "regionserver"
+
+	krb5ConfFile       = "krb5.conf"
+	krb5ConfMountPath  = "/etc/krb5.conf"
+	keytabVolumeName   = "keytab"
+	keytabFile         = "hbase.keytab"
+	keytabMountPath    = "/etc/security/keytabs"
+	kerberosAuthMethod = "kerberos"
+	jaasConfFile       = "jaas.conf"
+	jaasConfMountPath  = "/etc/security/jaas.conf"
+	hbaseOptsEnv       = "HBASE_OPTS"
+	podNameEnv         = "HBASE_POD_NAME"
+
+	// kerberosHostProperty is the system property with the hostname of the
+	// server that replaces _HOST of principals in the JAAS config
+	kerberosHostProperty = "hbase.kerberos.host"
+
+	// keytabDigestKey is the key of the digest of the keytab among digests of
+	// Secrets that name config ConfigMaps
+	keytabDigestKey = "kerberos-keytab"
+)
+
+// kerberos returns the Kerberos spec of HBase or nil if it's not enabled
+func kerberos(hb *hbasev1.HBase) *hbasev1.KerberosSpec {
+	if hb.Spec.Security == nil {
+		return nil
+	}
+	return hb.Spec.Security.Kerberos
+}
+
+// kerberosPrincipal returns the principal of the role
+func kerberosPrincipal(k *hbasev1.KerberosSpec, role string) hbasev1.KerberosPrincipal {
+	if role == masterRole {
+		return k.Master
+	}
+	return k.RegionServer
+}
+
+// unsupportedRPCReason returns why the operator can't call RPCs of servers, or
+// empty string if it can. Its client supports neither SASL nor TLS, and its
+// unauthenticated user isn't authorized to call admin RPCs of servers that
+// require Kerberos even if they fall back to simple authentication.
+func unsupportedRPCReason(hb *hbasev1.HBase) string {
+	if kerberos(hb) != nil {
+		return "Kerberos authentication"
+	}
+	if t := tlsSpec(hb); t != nil && !t.AllowPlaintext {
+		return "TLS without plaintext"
+	}
+	return ""
+}
+
+// validateSecurity rejects security settings the operator can't manage servers
+// with. Servers it can't call RPCs of are only restarted without draining if
+// that's opted in, and features that require RPCs are rejected for them.
+func validateSecurity(hb *hbasev1.HBase) error {
+	reason := unsupportedRPCReason(hb)
+	if reason == "" {
+		return nil
+	}
+	if !hb.Spec.Security.RestartWithoutDrain {
+		return fmt.Errorf("the operator can't call RPCs of servers with %s to drain them, "+
+			"set restartWithoutDrain to restart them without draining", reason)
+	}
+	for _, f := range []struct {
+		name string
+		set  bool
+	}{
+		{"canary", hb.Spec.Canary != nil},
+		{"balancer", hb.Spec.Balancer != nil},
+		{"normalizer", hb.Spec.Normalizer != nil},
+		{"config reload", hb.Spec.Config.Reload != nil},
+	} {
+		if f.set {
+			return fmt.Errorf("%s requires RPCs the operator can't call with %s", f.name, reason)
+		}
+	}
+	return nil
+}
+
+// pickWithoutDrain picks pods to delete one at a time without calling RPCs of
+// servers, for servers the operator can't call RPCs of
+func pickWithoutDrain(_ context.Context, _ *hbasev1.HBase,
+	td, _ []*corev1.Pod) ([]*corev1.Pod, bool, error) {
+	if len(td) == 0 {
+		return nil, true, nil
+	}
+	return td[:1], false, nil
+}
+
+// jaasConfig returns the JAAS config that logs ZooKeeper clients of servers in
+// with the keytab as the principal. JAAS doesn't replace _HOST, so it's
+// replaced with the hostname that servers are given as a system property.
+func jaasConfig(principal string) string {
+	return fmt.Sprintf(`Client {
+  com.sun.security.auth.module.Krb5LoginModule required
+  useKeyTab=true
+  storeKey=true
+  useTicketCache=false
+  keyTab="%s"
+  principal="%s";
+};
+`, path.Join(keytabMountPath, keytabFile),
+		strings.ReplaceAll(principal, "_HOST", "${"+kerberosHostProperty+"}"))
+}
+
+// kerberosConfigData returns the config data of the role with properties of
+// Kerberos set and the JAAS config of the role added. Servers log in to
+// ZooKeeper with the principal of their role.
+func kerberosConfigData(hb *hbasev1.HBase, role string, data map[string]string) (map[string]string, error) {
+	k := kerberos(hb)
+	if k == nil {
+		return data, nil
+	}
+	data = cloneMap(map[string]string{jaasConfFile: jaasConfig(kerberosPrincipal(k, role).Principal)}, data)
+	keytab := path.Join(keytabMountPath, keytabFile)
+	props := map[string]string{
+		"hbase.security.authentication":             kerberosAuthMethod,
+		"hbase.security.authorization":              "true",
+		"hbase.master.kerberos.principal":           k.Master.Principal,
+		"hbase.master.keytab.file":                  keytab,
+		"hbase.regionserver.kerberos.principal":     k.RegionServer.Principal,
+		"hbase.regionserver.keytab.file":            keytab,
+		"hbase.zookeeper.client.kerberos.principal": kerberosPrincipal(k, role).Principal,
+		"hbase.zookeeper.client.keytab.file":        keytab,
+	}
+	if k.AllowSimpleAuthFallback {
+		props["hbase.ipc.server.fallback-to-simple-auth-allowed"] = "true"
+	}
+	data, err := setSiteProperties(data, hbaseSiteFile, props)
+	if err != nil {
+		return nil, err
+	}
+	return setSiteProperties(data, coreSiteFile, map[string]string{
+		"hadoop.security.authentication": kerberosAuthMethod,
+	})
+}
+
+// kerberosPodSpec mounts the keytab of the role, and krb5.conf and the JAAS
+// config of the config volume in containers of the pod spec. The JAAS config
+// and the hostname of the pod are passed to servers in HBASE_OPTS. Mounts of
+// the same paths in the pod spec are kept, and HBASE_OPTS of the pod spec is
+// appended to unless it's set from a source.
+func (r *HBaseReconciler) kerberosPodSpec(hb *hbasev1.HBase, role string, spec *corev1.PodSpec) {
+	k := kerberos(hb)
+	if k == nil {
+		return
+	}
+	opts := fmt.Sprintf("-Djava.security.auth.login.config=%s -D%s=$(%s).%s",
+		jaasConfMountPath, kerberosHostProperty, podNameEnv, r.serviceDomain(hb))
+	podName := corev1.EnvVar{
+		Name: podNameEnv,
+		ValueFrom: &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+		},
+	}
+	keytab := kerberosPrincipal(k, role).Keytab
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: keytabVolumeName,
+		VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{
+			SecretName: keytab.Name,
+			Items:      []corev1.KeyToPath{{Key: keytab.Key, Path: keytabFile}},
+			Optional:   keytab.Optional,
+		}},
+	})
+	mounts := []corev1.VolumeMount{
+		{Name: keytabVolumeName, MountPath: keytabMountPath, ReadOnly: true},
+		{Name: configVolumeName, MountPath: krb5ConfMountPath, SubPath: krb5ConfFile, ReadOnly: true},
+		{Name: configVolumeName, MountPath: jaasConfMountPath, SubPath: jaasConfFile, ReadOnly: true},
+	}
+	for i := range spec.Containers {
+		c := &spec.Containers[i]
+		for _, m := range mounts {
+			if !slices.ContainsFunc(c.VolumeMounts, func(vm corev1.VolumeMount) bool {
+				return vm.MountPath == m.MountPath
+			}) {
+				c.VolumeMounts = append(c.VolumeMounts, m)
+			}
+		}
+		// the pod name is referenced by HBASE_OPTS, so it's defined first
+		if !slices.ContainsFunc(c.Env, func(e corev1.EnvVar) bool { return e.Name == podNameEnv }) {
+			c.Env = append([]corev1.EnvVar{podName}, c.Env...)
+		}
+		if i := slices.IndexFunc(c.Env, func(e corev1.EnvVar) bool { return e.Name == hbaseOptsEnv }); i < 0 {
+			c.Env = append(c.Env, corev1.EnvVar{Name: hbaseOptsEnv, Value: opts})
+		} else if c.Env[i].ValueFrom == nil {
+			c.Env[i].Value = strings.TrimSpace(c.Env[i].Value + " " + opts)
+		}
+	}
+}
+
+// keytabDigests returns digests of Secrets with the digest of the keytab of
+// the role added, so that a rotated keytab restarts servers of the role
+func (r *HBaseReconciler) keytabDigests(ctx context.Context, hb *hbasev1.HBase, role string,
+	secrets map[string]string) (map[string]string, error) {
+	k := kerberos(hb)
+	if k == nil {
+		return secrets, nil
+	}
+	ref := kerberosPrincipal(k, role).Keytab
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: hb.Namespace}, secret); err != nil {
+		if errors.IsNotFound(err) && ptr.Deref(ref.Optional, false) {
+			return secrets, nil
+		}
+		return nil, fmt.Errorf("failed to get keytab Secret %q of %s: %w", ref.Name, role, err)
+	}
+	v, ok := secret.Data[ref.Key]
+	if !ok {
+		if ptr.Deref(ref.Optional, false) {
+			return secrets, nil
+		}
+		return nil, fmt.Errorf("key %q is not found in keytab Secret %q of %s", ref.Key, ref.Name, role)
+	}
+	return cloneMap(map[string]string{keytabDigestKey: fmt.Sprintf("%x", sha256.Sum256(v))}, secrets), nil
+}
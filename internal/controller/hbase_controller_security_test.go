@@ -0,0 +1,208 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestKerberos(t *testing.T) {
+	ctx := context.Background()
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{
+		Config: hbasev1.ConfigMap{Data: map[string]string{
+			hbaseSiteFile: siteXML("hbase.rootdir", "hdfs://nn"),
+		}},
+		RegionServerSpec: hbasev1.ServerSpec{PodSpec: corev1.PodSpec{Containers: []corev1.Container{
+			{Name: "server"},
+			{Name: "sidecar", VolumeMounts: []corev1.VolumeMount{{Name: "own", MountPath: krb5ConfMountPath}}},
+		}}},
+		Security: &hbasev1.SecuritySpec{Kerberos: &hbasev1.KerberosSpec{
+			Krb5Config: corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "krb5"},
+				Key:                  "krb5.conf",
+			},
+			Master: hbasev1.KerberosPrincipal{
+				Principal: "hbase/_HOST@EXAMPLE.COM",
+				Keytab: corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "master-keytab"},
+					Key:                  "keytab",
+				},
+			},
+			RegionServer: hbasev1.KerberosPrincipal{
+				Principal: "rs/_HOST@EXAMPLE.COM",
+				Keytab: corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "rs-keytab"},
+					Key:                  "keytab",
+				},
+			},
+			AllowSimpleAuthFallback: true,
+		}},
+	}}
+	r := newHistoryTestReconciler(t, hb)
+	r.ClusterDomain = "cluster.local"
+	if err := r.Create(ctx, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "krb5", Namespace: hb.Namespace},
+		Data:       map[string]string{"krb5.conf": "[libdefaults]\n default_realm = EXAMPLE.COM\n"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	shared, _, err := r.sharedConfigData(ctx, hb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared[krb5ConfFile] != "[libdefaults]\n default_realm = EXAMPLE.COM\n" {
+		t.Errorf("expected krb5.conf to be sourced: %v", shared)
+	}
+	master, err := r.roleConfigData(hb, masterRole, shared, hb.Spec.MasterSpec, hbasev1.ConfigProperties{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := r.roleConfigData(hb, "regionserver", shared, hb.Spec.RegionServerSpec, hbasev1.ConfigProperties{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	props, err := parseSiteXML(rs[hbaseSiteFile])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{
+		"hbase.rootdir":                                    "hdfs://nn",
+		"hbase.security.authentication":                    "kerberos",
+		"hbase.master.kerberos.principal":                  "hbase/_HOST@EXAMPLE.COM",
+		"hbase.regionserver.kerberos.principal":            "rs/_HOST@EXAMPLE.COM",
+		"hbase.regionserver.keytab.file":                   "/etc/security/keytabs/hbase.keytab",
+		"hbase.zookeeper.client.kerberos.principal":        "rs/_HOST@EXAMPLE.COM",
+		"hbase.ipc.server.fallback-to-simple-auth-allowed": "true",
+	} {
+		if props[k] != v {
+			t.Errorf("expected %s=%q, got %q", k, v, props[k])
+		}
+	}
+	if props, err := parseSiteXML(master[hbaseSiteFile]); err != nil ||
+		props["hbase.zookeeper.client.kerberos.principal"] != "hbase/_HOST@EXAMPLE.COM" {
+		t.Errorf("expected masters to log in to ZooKeeper as master: %v, %v", props, err)
+	}
+	if props, err := parseSiteXML(rs[coreSiteFile]); err != nil || props["hadoop.security.authentication"] != "kerberos" {
+		t.Errorf("unexpected %s: %v, %v", coreSiteFile, props, err)
+	}
+
+	rsName := types.NamespacedName{Name: "regionserver", Namespace: hb.Namespace}
+	sts, _ := r.statefulSet(hb, rsName, getConfigMapName(hb, rsName.Name, rs, nil), hb.Spec.RegionServerSpec)
+	spec := sts.Spec.Template.Spec
+	i := slices.IndexFunc(spec.Volumes, func(v corev1.Volume) bool { return v.Name == keytabVolumeName })
+	if i < 0 || spec.Volumes[i].Secret == nil || spec.Volumes[i].Secret.SecretName != "rs-keytab" {
+		t.Fatalf("expected keytab volume of RegionServers: %v", spec.Volumes)
+	}
+	server, sidecar := spec.Containers[0].VolumeMounts, spec.Containers[1].VolumeMounts
+	if len(server) != 3 || server[1].SubPath != krb5ConfFile || server[1].Name != configVolumeName ||
+		server[2].SubPath != jaasConfFile || server[2].MountPath != jaasConfMountPath {
+		t.Errorf("unexpected mounts of server: %v", server)
+	}
+	if len(sidecar) != 3 || sidecar[0].Name != "own" || sidecar[1].MountPath != keytabMountPath {
+		t.Errorf("expected own mount of krb5.conf to be kept: %v", sidecar)
+	}
+	env := spec.Containers[0].Env
+	if len(env) == 0 || env[0].Name != podNameEnv || env[0].ValueFrom == nil {
+		t.Errorf("expected pod name to be defined first: %v", env)
+	}
+	opts := "-Djava.security.auth.login.config=/etc/security/jaas.conf " +
+		"-Dhbase.kerberos.host=$(HBASE_POD_NAME).hbase.default.svc.cluster.local"
+	if i := slices.IndexFunc(env, func(e corev1.EnvVar) bool { return e.Name == hbaseOptsEnv }); i < 0 || env[i].Value != opts {
+		t.Errorf("expected JAAS config in %s: %v", hbaseOptsEnv, env)
+	}
+	jaas := rs[jaasConfFile]
+	for _, v := range []string{
+		`keyTab="/etc/security/keytabs/hbase.keytab"`,
+		`principal="rs/${hbase.kerberos.host}@EXAMPLE.COM"`,
+	} {
+		if !strings.Contains(jaas, v) {
+			t.Errorf("expected %s in JAAS config: %s", v, jaas)
+		}
+	}
+	if !strings.Contains(master[jaasConfFile], `principal="hbase/${hbase.kerberos.host}@EXAMPLE.COM"`) {
+		t.Errorf("expected masters to log in as master: %s", master[jaasConfFile])
+	}
+	if len(hb.Spec.RegionServerSpec.PodSpec.Containers[0].VolumeMounts) != 0 {
+		t.Error("expected spec to be kept")
+	}
+
+	requests := r.hbasesForConfigMap(ctx, &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{
+		Name: "krb5", Namespace: hb.Namespace,
+	}})
+	if len(requests) != 1 {
+		t.Errorf("expected change of krb5.conf to reconcile HBase: %v", requests)
+	}
+
+	// the operator can't call RPCs of Kerberized servers, restarts are opted in
+	if err := validateSecurity(hb); err == nil {
+		t.Error("expected error for kerberos without restarts without drain")
+	}
+	hb.Spec.Security.RestartWithoutDrain = true
+	if err := validateSecurity(hb); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	hb.Spec.Canary = &hbasev1.CanarySpec{}
+	if err := validateSecurity(hb); err == nil {
+		t.Error("expected error for canary that requires RPCs")
+	}
+	hb.Spec.Canary = nil
+	td := []*corev1.Pod{{ObjectMeta: metav1.ObjectMeta{Name: "regionserver-1"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "regionserver-0"}}}
+	if ps, done, err := pickWithoutDrain(ctx, hb, td, nil); err != nil || done || len(ps) != 1 || ps[0] != td[0] {
+		t.Errorf("expected one pod to be restarted at a time: %v, %v, %v", ps, done, err)
+	}
+	if _, done, err := pickWithoutDrain(ctx, hb, nil, td); err != nil || !done {
+		t.Errorf("expected pods to be up to date: %v", err)
+	}
+
+	// a rotated keytab changes the config ConfigMap name of its role
+	if _, _, err := r.roleSecretDigests(ctx, hb, regionServerRole, nil); err == nil {
+		t.Error("expected error for missing keytab")
+	}
+	keytab := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "rs-keytab", Namespace: hb.Namespace},
+		Data:       map[string][]byte{"keytab": []byte("v1")},
+	}
+	if err := r.Create(ctx, keytab); err != nil {
+		t.Fatal(err)
+	}
+	digests, _, err := r.roleSecretDigests(ctx, hb, regionServerRole, nil)
+	if err != nil || digests[keytabDigestKey] == "" {
+		t.Fatalf("expected digest of keytab: %v, %v", digests, err)
+	}
+	keytab.Data["keytab"] = []byte("v2")
+	if err := r.Update(ctx, keytab); err != nil {
+		t.Fatal(err)
+	}
+	rotated, _, err := r.roleSecretDigests(ctx, hb, regionServerRole, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getConfigMapName(hb, regionServerRole, rs, rotated) == getConfigMapName(hb, regionServerRole, rs, digests) {
+		t.Error("expected rotated keytab to change the ConfigMap name")
+	}
+	if requests := r.hbasesForSecret(ctx, keytab); len(requests) != 1 {
+		t.Errorf("expected change of keytab to reconcile HBase: %v", requests)
+	}
+}
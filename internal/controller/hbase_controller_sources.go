@@ -0,0 +1,208 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"slices"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// sourceFile returns the name of the file of the config source
+func sourceFile(s hbasev1.ConfigSource) string {
+	if s.File != "" {
+		return s.File
+	}
+	if s.ConfigMapKeyRef != nil {
+		return s.ConfigMapKeyRef.Key
+	}
+	if s.SecretKeyRef != nil {
+		return s.SecretKeyRef.Key
+	}
+	return ""
+}
+
+// configSources returns sources of files of the config including krb5.conf
+// of Kerberos
+func configSources(hb *hbasev1.HBase) []hbasev1.ConfigSource {
+	k := kerberos(hb)
+	if k == nil {
+		return hb.Spec.Config.Sources
+	}
+	return append(slices.Clone(hb.Spec.Config.Sources), hbasev1.ConfigSource{
+		File:            krb5ConfFile,
+		ConfigMapKeyRef: &k.Krb5Config,
+	})
+}
+
+// sharedConfigData returns the shared config data with files of ConfigMap sources,
+// and digests of files of Secret sources by file name. Contents of Secrets
+// aren't copied into config ConfigMaps, but they have to change their hash.
+func (r *HBaseReconciler) sharedConfigData(ctx context.Context,
+	hb *hbasev1.HBase) (map[string]string, map[string]string, error) {
+	sources := configSources(hb)
+	if len(sources) == 0 {
+		return hb.Spec.Config.Data, nil, nil
+	}
+	files := map[string]string{}
+	secrets := map[string]string{}
+	for _, s := range sources {
+		switch {
+		case s.ConfigMapKeyRef != nil:
+			ref := s.ConfigMapKeyRef
+			cm := &corev1.ConfigMap{}
+			if err := r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: hb.Namespace}, cm); err != nil {
+				if errors.IsNotFound(err) && ptr.Deref(ref.Optional, false) {
+					continue
+				}
+				return nil, nil, fmt.Errorf("failed to get ConfigMap %q of config source: %w", ref.Name, err)
+			}
+			v, ok := cm.Data[ref.Key]
+			if !ok {
+				if ptr.Deref(ref.Optional, false) {
+					continue
+				}
+				return nil, nil, fmt.Errorf("key %q is not found in ConfigMap %q of config source", ref.Key, ref.Name)
+			}
+			files[sourceFile(s)] = v
+		case s.SecretKeyRef != nil:
+			ref := s.SecretKeyRef
+			secret := &corev1.Secret{}
+			if err := r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: hb.Namespace}, secret); err != nil {
+				if errors.IsNotFound(err) && ptr.Deref(ref.Optional, false) {
+					continue
+				}
+				return nil, nil, fmt.Errorf("failed to get Secret %q of config source: %w", ref.Name, err)
+			}
+			v, ok := secret.Data[ref.Key]
+			if !ok {
+				if ptr.Deref(ref.Optional, false) {
+					continue
+				}
+				return nil, nil, fmt.Errorf("key %q is not found in Secret %q of config source", ref.Key, ref.Name)
+			}
+			secrets[sourceFile(s)] = fmt.Sprintf("%x", sha256.Sum256(v))
+		default:
+			return nil, nil, fmt.Errorf("config source of file %q references neither ConfigMap nor Secret",
+				sourceFile(s))
+		}
+	}
+	return cloneMap(hb.Spec.Config.Data, files), secrets, nil
+}
+
+// configVolume returns the config volume with the config ConfigMap. Files of
+// Secret sources are projected into the volume along with the ConfigMap.
+func configVolume(hb *hbasev1.HBase, cmName types.NamespacedName) corev1.Volume {
+	v := configMapVolume(cmName)
+	var secrets []corev1.VolumeProjection
+	for _, s := range configSources(hb) {
+		if ref := s.SecretKeyRef; ref != nil {
+			secrets = append(secrets, corev1.VolumeProjection{Secret: &corev1.SecretProjection{
+				LocalObjectReference: ref.LocalObjectReference,
+				Items:                []corev1.KeyToPath{{Key: ref.Key, Path: sourceFile(s)}},
+				Optional:             ref.Optional,
+			}})
+		}
+	}
+	if len(secrets) == 0 {
+		return v
+	}
+	return corev1.Volume{
+		Name: v.Name,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				DefaultMode: v.ConfigMap.DefaultMode,
+				Sources: append([]corev1.VolumeProjection{{
+					ConfigMap: &corev1.ConfigMapProjection{LocalObjectReference: v.ConfigMap.LocalObjectReference},
+				}}, secrets...),
+			},
+		},
+	}
+}
+
+// volumeConfigMaps returns names of ConfigMaps the volume consists of
+func volumeConfigMaps(v corev1.Volume) []string {
+	if v.ConfigMap != nil {
+		return []string{v.ConfigMap.Name}
+	}
+	var names []string
+	if v.Projected != nil {
+		for _, s := range v.Projected.Sources {
+			if s.ConfigMap != nil {
+				names = append(names, s.ConfigMap.Name)
+			}
+		}
+	}
+	return names
+}
+
+// roleSecretNames returns names of Secrets with keytabs and certificates of roles
+func roleSecretNames(hb *hbasev1.HBase) []string {
+	var names []string
+	if k := kerberos(hb); k != nil {
+		names = append(names, k.Master.Keytab.Name, k.RegionServer.Keytab.Name)
+	}
+	if tlsSpec(hb) != nil {
+		names = append(names, tlsSecretName(hb, masterRole), tlsSecretName(hb, regionServerRole))
+	}
+	return names
+}
+
+// hbasesForConfigMap returns requests to reconcile HBases that source config
+// from the ConfigMap
+func (r *HBaseReconciler) hbasesForConfigMap(ctx context.Context, obj client.Object) []reconcile.Request {
+	return r.hbasesForSource(ctx, obj, false)
+}
+
+// hbasesForSecret returns requests to reconcile HBases that source config
+// from the Secret, or use it as a keytab or TLS certificate
+func (r *HBaseReconciler) hbasesForSecret(ctx context.Context, obj client.Object) []reconcile.Request {
+	return r.hbasesForSource(ctx, obj, true)
+}
+
+// hbasesForSource returns requests to reconcile HBases that reference the
+// ConfigMap or Secret. Only metadata of obj is watched, so its type is given.
+func (r *HBaseReconciler) hbasesForSource(ctx context.Context, obj client.Object,
+	isSecret bool) []reconcile.Request {
+	l := &hbasev1.HBaseList{}
+	if err := r.List(ctx, l, client.InNamespace(obj.GetNamespace())); err != nil {
+		r.Log.Error(err, "failed to list HBases of config source", "name", obj.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, hb := range l.Items {
+		if isSecret && slices.Contains(roleSecretNames(&hb), obj.GetName()) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&hb)})
+			continue
+		}
+		for _, s := range configSources(&hb) {
+			if (!isSecret && s.ConfigMapKeyRef != nil && s.ConfigMapKeyRef.Name == obj.GetName()) ||
+				(isSecret && s.SecretKeyRef != nil && s.SecretKeyRef.Name == obj.GetName()) {
+				requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&hb)})
+				break
+			}
+		}
+	}
+	return requests
+}
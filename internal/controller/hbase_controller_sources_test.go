@@ -0,0 +1,129 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+)
+
+func TestConfigSources(t *testing.T) {
+	ctx := context.Background()
+	hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{Config: hbasev1.ConfigMap{
+		Data: map[string]string{"hbase-env.sh": "inline"},
+		Sources: []hbasev1.ConfigSource{{
+			ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "hadoop"},
+				Key:                  "hdfs-site.xml",
+			},
+		}, {
+			File: "hbase-env.sh",
+			ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "hadoop"},
+				Key:                  "env",
+			},
+		}, {
+			File: "jaas.conf",
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "jaas"},
+				Key:                  "conf",
+			},
+		}, {
+			ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "missing"},
+				Key:                  "optional",
+				Optional:             ptr.To(true),
+			},
+		}},
+	}}}
+	r := newHistoryTestReconciler(t, hb)
+	if err := r.Create(ctx, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "hadoop", Namespace: hb.Namespace},
+		Data:       map[string]string{"hdfs-site.xml": "hdfs", "env": "external"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Create(ctx, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "jaas", Namespace: hb.Namespace},
+		Data:       map[string][]byte{"conf": []byte("secret")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, secrets, err := r.sharedConfigData(ctx, hb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 2 || data["hdfs-site.xml"] != "hdfs" || data["hbase-env.sh"] != "inline" {
+		t.Errorf("expected files of ConfigMaps to be merged under data: %v", data)
+	}
+	if _, ok := secrets["jaas.conf"]; !ok || len(secrets) != 1 || secrets["jaas.conf"] == "secret" {
+		t.Errorf("expected digest of the Secret file: %v", secrets)
+	}
+	name := getConfigMapName(hb, "regionserver", data, secrets)
+
+	// change of a Secret changes the ConfigMap name
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{Name: "jaas", Namespace: hb.Namespace}, secret); err != nil {
+		t.Fatal(err)
+	}
+	secret.Data["conf"] = []byte("rotated")
+	if err := r.Update(ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+	data, secrets, err = r.sharedConfigData(ctx, hb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getConfigMapName(hb, "regionserver", data, secrets) == name {
+		t.Error("expected new ConfigMap name after Secret changed")
+	}
+
+	// Secret files are projected along with the ConfigMap
+	v := configVolume(hb, name)
+	if v.Projected == nil || len(v.Projected.Sources) != 2 ||
+		v.Projected.Sources[1].Secret.Items[0].Path != "jaas.conf" {
+		t.Fatalf("unexpected config volume: %+v", v)
+	}
+	if names := volumeConfigMaps(v); !slices.Equal(names, []string{name.Name}) {
+		t.Errorf("expected ConfigMap %s in volume, got %v", name.Name, names)
+	}
+
+	// HBase is reconciled once its sources change
+	if reqs := r.hbasesForSecret(ctx, secret); len(reqs) != 1 || reqs[0].Name != hb.Name {
+		t.Errorf("expected HBase to be reconciled, got %v", reqs)
+	}
+	other := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "jaas", Namespace: hb.Namespace}}
+	if reqs := r.hbasesForConfigMap(ctx, other); len(reqs) != 0 {
+		t.Errorf("expected no HBase to be reconciled, got %v", reqs)
+	}
+
+	hb.Spec.Config.Sources = append(hb.Spec.Config.Sources, hbasev1.ConfigSource{
+		ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "missing"},
+			Key:                  "required",
+		},
+	})
+	if _, _, err := r.sharedConfigData(ctx, hb); err == nil {
+		t.Error("expected error for missing ConfigMap")
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+)
+
+// configTemplateVars are variables available to config templates
+type configTemplateVars struct {
+	Name            string
+	Namespace       string
+	ZooKeeperQuorum string
+	ZooKeeperRoot   string
+	ServiceDomain   string
+	ClusterDomain   string
+}
+
+// serviceDomain returns the domain of the headless service of HBase, pods are
+// addressed by their hostname in it. It's relative to the search domains of
+// pods if the cluster domain isn't set.
+func (r *HBaseReconciler) serviceDomain(hb *hbasev1.HBase) string {
+	domain := fmt.Sprintf("%s.%s.svc", headlessServiceName, hb.Namespace)
+	if r.ClusterDomain != "" {
+		domain += "." + r.ClusterDomain
+	}
+	return domain
+}
+
+func (r *HBaseReconciler) configTemplateVars(hb *hbasev1.HBase) configTemplateVars {
+	return configTemplateVars{
+		Name:            hb.Name,
+		Namespace:       hb.Namespace,
+		ZooKeeperQuorum: r.ZkQuorum,
+		ZooKeeperRoot:   r.ZkRoot,
+		ServiceDomain:   r.serviceDomain(hb),
+		ClusterDomain:   r.ClusterDomain,
+	}
+}
+
+// renderConfigTemplates returns files of the config rendered as Go templates.
+// Unknown variables are errors, so that typos don't end up in the config.
+func renderConfigTemplates(data map[string]string, vars configTemplateVars) (map[string]string, error) {
+	rendered := make(map[string]string, len(data))
+	for file, text := range data {
+		t, err := template.New(file).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template of %s: %w", file, err)
+		}
+		var b strings.Builder
+		if err := t.Execute(&b, vars); err != nil {
+			return nil, fmt.Errorf("failed to render template of %s: %w", file, err)
+		}
+		rendered[file] = b.String()
+	}
+	return rendered, nil
+}
+
+// roleConfigData returns files of the config ConfigMap of a role including
+// memory and security settings. If enabled, templates of inline files are
+// rendered before site XML files are merged with properties, since merging
+// escapes characters of templates. Files of sources are copied as they are.
+func (r *HBaseReconciler) roleConfigData(hb *hbasev1.HBase, role string, shared map[string]string,
+	ss hbasev1.ServerSpec, overrides hbasev1.ConfigProperties) (map[string]string, error) {
+	if !hb.Spec.Config.Template {
+		return generatedConfigData(hb, role, shared, ss, overrides)
+	}
+	vars := r.configTemplateVars(hb)
+	// Data replaces files of sources, so files of Data are inline
+	inline := map[string]string{}
+	for file := range hb.Spec.Config.Data {
+		if text, ok := shared[file]; ok {
+			inline[file] = text
+		}
+	}
+	rendered, err := renderConfigTemplates(inline, vars)
+	if err != nil {
+		return nil, err
+	}
+	shared = cloneMap(rendered, shared)
+	if ss.Config != nil && len(ss.Config.Data) > 0 {
+		sc := *ss.Config
+		if sc.Data, err = renderConfigTemplates(sc.Data, vars); err != nil {
+			return nil, err
+		}
+		ss.Config = &sc
+	}
+	return generatedConfigData(hb, role, shared, ss, overrides)
+}
+
+// generatedConfigData returns files of the config ConfigMap of a role with
+// settings generated by the operator applied over the merged config
+func generatedConfigData(hb *hbasev1.HBase, role string, shared map[string]string,
+	ss hbasev1.ServerSpec, overrides hbasev1.ConfigProperties) (map[string]string, error) {
+	data, err := configData(hb, shared, ss, overrides)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = memoryConfigData(ss, data); err != nil {
+		return nil, err
+	}
+	if data, err = kerberosConfigData(hb, role, data); err != nil {
+		return nil, err
+	}
+	return tlsConfigData(hb, data)
+}
@@ -117,8 +117,8 @@ var _ = Describe("HBase controller", func() {
 				return k8sClient.Get(ctx, hbaseLookupKey, createdService)
 			}, timeout, interval).Should(Succeed())
 
-			var createdConfigMap *corev1.ConfigMap
-			By("By checking HBase deployed one config map")
+			createdConfigMaps := map[string]*corev1.ConfigMap{}
+			By("By checking HBase deployed a config map per role")
 			Eventually(func() (int, error) {
 				configMapList := &corev1.ConfigMapList{}
 				listOpts := []client.ListOption{
@@ -128,13 +128,16 @@ var _ = Describe("HBase controller", func() {
 				if err := k8sClient.List(ctx, configMapList, listOpts...); err != nil {
 					return 0, err
 				}
-				l := len(configMapList.Items)
-				if l != 1 {
-					return l, nil
+				for i := range configMapList.Items {
+					cm := &configMapList.Items[i]
+					createdConfigMaps[cm.Labels[HBaseControllerNameKey]] = cm
 				}
-				createdConfigMap = &(configMapList.Items[0])
-				return l, nil
-			}, timeout, interval).Should(Equal(1))
+				return len(configMapList.Items), nil
+			}, timeout, interval).Should(Equal(2))
+			Ω(createdConfigMaps).Should(HaveKey("hbasemaster"))
+			Ω(createdConfigMaps).Should(HaveKey("regionserver"))
+			Ω(createdConfigMaps["hbasemaster"].Name).Should(HavePrefix("config-hbasemaster-"))
+			Ω(createdConfigMaps["regionserver"].Name).Should(HavePrefix("config-regionserver-"))
 
 			By("By checking HBase deployed master statefulset")
 
@@ -161,7 +164,7 @@ var _ = Describe("HBase controller", func() {
 					ConfigMap: &corev1.ConfigMapVolumeSource{
 						DefaultMode: ptr.To(int32(420)),
 						LocalObjectReference: corev1.LocalObjectReference{
-							Name: createdConfigMap.Name,
+							Name: createdConfigMaps["hbasemaster"].Name,
 						},
 					},
 				},
@@ -188,7 +191,7 @@ var _ = Describe("HBase controller", func() {
 					ConfigMap: &corev1.ConfigMapVolumeSource{
 						DefaultMode: ptr.To(int32(420)),
 						LocalObjectReference: corev1.LocalObjectReference{
-							Name: createdConfigMap.Name,
+							Name: createdConfigMaps["regionserver"].Name,
 						},
 					},
 				},
@@ -226,7 +229,7 @@ var _ = Describe("HBase controller", func() {
 			}
 
 			var oldConfigMaps []corev1.ConfigMap
-			getExistingCm := func() {
+			getExistingCm := func(expected int) {
 				Eventually(func() (int, error) {
 					configMapList := &corev1.ConfigMapList{}
 					listOpts := []client.ListOption{
@@ -236,18 +239,14 @@ var _ = Describe("HBase controller", func() {
 					if err := k8sClient.List(ctx, configMapList, listOpts...); err != nil {
 						return 0, err
 					}
-					l := len(configMapList.Items)
-					if l != 1 {
-						return l, nil
-					}
 					oldConfigMaps = configMapList.Items
-					return l, nil
-				}, timeout, interval).Should(Equal(1))
+					return len(oldConfigMaps), nil
+				}, timeout, interval).Should(Equal(expected))
 			}
 
 			// --------------------------- TEST 1 ---------------------------
 			// Setup new test vars
-			getExistingCm()
+			getExistingCm(2)
 			updatedMasterSts := &appsv1.StatefulSet{}
 			updatedRsSts := &appsv1.StatefulSet{}
 			oldMasterAnnotation, oldRsAnnotation := getExistingStsAnnotations()
@@ -337,7 +336,8 @@ var _ = Describe("HBase controller", func() {
 
 			// --------------------------- TEST 2 ---------------------------
 			// Clear test vars
-			getExistingCm()
+			// ConfigMaps of both roles of the previous revision are kept in history to roll back to
+			getExistingCm(4)
 			updatedMasterSts = &appsv1.StatefulSet{}
 			updatedRsSts = &appsv1.StatefulSet{}
 			oldMasterAnnotation, oldRsAnnotation = getExistingStsAnnotations()
@@ -425,7 +425,8 @@ var _ = Describe("HBase controller", func() {
 
 			// --------------------------- TEST 3 ---------------------------
 			// Clear test vars
-			getExistingCm()
+			// replica counts don't change the revision, so no ConfigMap was added
+			getExistingCm(4)
 			updatedMasterSts = &appsv1.StatefulSet{}
 			updatedRsSts = &appsv1.StatefulSet{}
 			oldMasterAnnotation, oldRsAnnotation = getExistingStsAnnotations()
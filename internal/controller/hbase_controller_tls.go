@@ -0,0 +1,284 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+const (
+	tlsVolumeName            = "tls"
+	tlsMountPath             = "/etc/hbase/tls"
+	tlsCertificateVolumeName = "tls-certificate"
+	tlsCertificateMountPath  = "/etc/hbase/tls-certificate"
+	tlsPasswordEnv           = "HBASE_TLS_PASSWORD"
+	keystoreFile             = "keystore.p12"
+	truststoreFile           = "truststore.p12"
+	keystoreType             = "PKCS12"
+	keystoreContainerName    = "keystore"
+
+	// tlsDigestKey is the key of the digest of the certificate among digests of
+	// Secrets that name config ConfigMaps
+	tlsDigestKey = "tls-certificate"
+)
+
+// certificateKeys are keys of a Secret with a certificate in cert-manager format
+var certificateKeys = []string{corev1.TLSCertKey, corev1.TLSPrivateKeyKey, "ca.crt"}
+
+var certificateGVK = schema.GroupVersionKind{Group: "cert-manager.io", Version: "v1", Kind: "Certificate"}
+
+// keystoreScript converts the certificate into keystores
+var keystoreScript = fmt.Sprintf(`set -e
+openssl pkcs12 -export -name server -in %[1]s/tls.crt -inkey %[1]s/tls.key \
+  -out %[2]s/%[3]s -passout env:%[4]s
+rm -f %[2]s/%[5]s
+keytool -importcert -noprompt -alias ca -file %[1]s/ca.crt \
+  -keystore %[2]s/%[5]s -storetype %[6]s -storepass:env %[4]s
+`, tlsCertificateMountPath, tlsMountPath, keystoreFile, tlsPasswordEnv, truststoreFile, keystoreType)
+
+// tlsSpec returns the TLS spec of HBase or nil if it's not enabled
+func tlsSpec(hb *hbasev1.HBase) *hbasev1.TLSSpec {
+	if hb.Spec.Security == nil {
+		return nil
+	}
+	return hb.Spec.Security.TLS
+}
+
+// tlsCertificate returns the certificate of the role
+func tlsCertificate(t *hbasev1.TLSSpec, role string) hbasev1.TLSCertificate {
+	if role == masterRole {
+		return t.Master
+	}
+	return t.RegionServer
+}
+
+// tlsSecretName returns the name of the Secret with the certificate of the role
+func tlsSecretName(hb *hbasev1.HBase, role string) string {
+	c := tlsCertificate(tlsSpec(hb), role)
+	if c.SecretName == "" && c.Issuer != nil {
+		return fmt.Sprintf("%s-%s-tls", hb.Name, role)
+	}
+	return c.SecretName
+}
+
+// tlsConfigData returns the config data with properties of TLS of RPC and
+// info servers set. Passwords are read by servers from the environment.
+func tlsConfigData(hb *hbasev1.HBase, data map[string]string) (map[string]string, error) {
+	t := tlsSpec(hb)
+	if t == nil {
+		return data, nil
+	}
+	keystore, truststore := path.Join(tlsMountPath, keystoreFile), path.Join(tlsMountPath, truststoreFile)
+	password := "${env." + tlsPasswordEnv + "}"
+	return setSiteProperties(data, hbaseSiteFile, map[string]string{
+		"hbase.server.netty.tls.enabled":          "true",
+		"hbase.client.netty.tls.enabled":          "true",
+		"hbase.server.netty.tls.supportplaintext": strconv.FormatBool(t.AllowPlaintext),
+		"hbase.rpc.tls.keystore.location":         keystore,
+		"hbase.rpc.tls.keystore.type":             keystoreType,
+		"hbase.rpc.tls.keystore.password":         password,
+		"hbase.rpc.tls.truststore.location":       truststore,
+		"hbase.rpc.tls.truststore.type":           keystoreType,
+		"hbase.rpc.tls.truststore.password":       password,
+		"hbase.ssl.enabled":                       "true",
+		"ssl.server.keystore.location":            keystore,
+		"ssl.server.keystore.type":                keystoreType,
+		"ssl.server.keystore.password":            password,
+		"ssl.server.keystore.keypassword":         password,
+		"ssl.server.truststore.location":          truststore,
+		"ssl.server.truststore.type":              keystoreType,
+		"ssl.server.truststore.password":          password,
+	})
+}
+
+// tlsPodSpec adds the init container that generates keystores from the
+// certificate of the role, and mounts keystores in containers of the pod spec.
+// Mounts of the same paths and variables of the same names are kept.
+func tlsPodSpec(hb *hbasev1.HBase, role string, spec *corev1.PodSpec) {
+	t := tlsSpec(hb)
+	if t == nil {
+		return
+	}
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name:         tlsVolumeName,
+		VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+	}, corev1.Volume{
+		Name: tlsCertificateVolumeName,
+		VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{
+			SecretName: tlsSecretName(hb, role),
+		}},
+	})
+	env := corev1.EnvVar{
+		Name:      tlsPasswordEnv,
+		ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &t.KeystorePassword},
+	}
+	mount := corev1.VolumeMount{Name: tlsVolumeName, MountPath: tlsMountPath, ReadOnly: true}
+
+	image := t.Image
+	if image == "" && len(spec.Containers) > 0 {
+		image = spec.Containers[0].Image
+	}
+	spec.InitContainers = append(spec.InitContainers, corev1.Container{
+		Name:    keystoreContainerName,
+		Image:   image,
+		Command: []string{"/bin/sh", "-c", keystoreScript},
+		Env:     []corev1.EnvVar{env},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: tlsVolumeName, MountPath: tlsMountPath},
+			{Name: tlsCertificateVolumeName, MountPath: tlsCertificateMountPath, ReadOnly: true},
+		},
+	})
+	for i := range spec.Containers {
+		c := &spec.Containers[i]
+		if !slices.ContainsFunc(c.VolumeMounts, func(vm corev1.VolumeMount) bool {
+			return vm.MountPath == mount.MountPath
+		}) {
+			c.VolumeMounts = append(c.VolumeMounts, mount)
+		}
+		if !slices.ContainsFunc(c.Env, func(e corev1.EnvVar) bool { return e.Name == env.Name }) {
+			c.Env = append(c.Env, env)
+		}
+	}
+}
+
+// roleSecretDigests returns digests of Secrets that name the config ConfigMap
+// of the role, which are digests of Secret sources, the keytab and the
+// certificate of the role. A change of the keytab or certificate restarts
+// servers of the role with a rollout. It returns false if the certificate
+// requested from the issuer isn't issued yet.
+func (r *HBaseReconciler) roleSecretDigests(ctx context.Context, hb *hbasev1.HBase, role string,
+	secrets map[string]string) (map[string]string, bool, error) {
+	secrets, err := r.keytabDigests(ctx, hb, role, secrets)
+	if err != nil {
+		return nil, false, err
+	}
+	t := tlsSpec(hb)
+	if t == nil {
+		return secrets, true, nil
+	}
+	c := tlsCertificate(t, role)
+	if c.Issuer != nil {
+		if err := r.ensureCertificate(ctx, hb, role, c); err != nil {
+			return nil, false, fmt.Errorf("failed to ensure certificate of %s: %w", role, err)
+		}
+	}
+	name := tlsSecretName(hb, role)
+	if name == "" {
+		return nil, false, fmt.Errorf("certificate of %s has neither Secret nor issuer", role)
+	}
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: hb.Namespace}, secret); err != nil {
+		if errors.IsNotFound(err) && c.Issuer != nil {
+			r.certificatePending(hb, role, name)
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("failed to get TLS Secret %q of %s: %w", name, role, err)
+	}
+	h := sha256.New()
+	for _, k := range certificateKeys {
+		v, ok := secret.Data[k]
+		if !ok {
+			return nil, false, fmt.Errorf("key %q is not found in TLS Secret %q of %s", k, name, role)
+		}
+		fmt.Fprintf(h, "%s:%d:", k, len(v))
+		h.Write(v)
+	}
+	return cloneMap(map[string]string{tlsDigestKey: fmt.Sprintf("%x", h.Sum(nil))}, secrets), true, nil
+}
+
+// certificatePending marks HBase as waiting for the issuer to issue the
+// certificate of the role into the Secret
+func (r *HBaseReconciler) certificatePending(hb *hbasev1.HBase, role, secretName string) {
+	r.Log.Info("waiting for certificate to be issued", "role", role, "Secret", secretName)
+	meta.SetStatusCondition(&hb.Status.Conditions, metav1.Condition{
+		Type:    hbasev1.ConditionCertificatePending,
+		Status:  metav1.ConditionTrue,
+		Reason:  "NotIssued",
+		Message: fmt.Sprintf("certificate of %s isn't issued into Secret %s yet", role, secretName),
+	})
+}
+
+// clearCertificatePending forgets the pending certificate once certificates
+// of all roles are issued
+func clearCertificatePending(hb *hbasev1.HBase) {
+	meta.RemoveStatusCondition(&hb.Status.Conditions, hbasev1.ConditionCertificatePending)
+}
+
+// ensureCertificate creates the cert-manager Certificate of pods of the role
+// if it doesn't exist
+func (r *HBaseReconciler) ensureCertificate(ctx context.Context, hb *hbasev1.HBase, role string,
+	c hbasev1.TLSCertificate) error {
+	name := tlsSecretName(hb, role)
+	cert := &unstructured.Unstructured{}
+	cert.SetGroupVersionKind(certificateGVK)
+	if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: hb.Namespace}, cert); err == nil {
+		return nil
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+
+	kind, group := c.Issuer.Kind, c.Issuer.Group
+	if kind == "" {
+		kind = "Issuer"
+	}
+	if group == "" {
+		group = certificateGVK.Group
+	}
+	// pods are addressed by their hostname in the headless service
+	domain := fmt.Sprintf("%s.%s", headlessServiceName, hb.Namespace)
+	dnsNames := []interface{}{"*." + headlessServiceName, "*." + domain, "*." + domain + ".svc"}
+	if r.ClusterDomain != "" {
+		dnsNames = append(dnsNames, "*."+domain+".svc."+r.ClusterDomain)
+	}
+	cert = &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"secretName": name,
+			"issuerRef": map[string]interface{}{
+				"name":  c.Issuer.Name,
+				"kind":  kind,
+				"group": group,
+			},
+			"dnsNames": dnsNames,
+			"usages":   []interface{}{"server auth", "client auth"},
+		},
+	}}
+	cert.SetGroupVersionKind(certificateGVK)
+	cert.SetName(name)
+	cert.SetNamespace(hb.Namespace)
+	cert.SetLabels(cloneMap(hb.Labels))
+	if err := controllerutil.SetControllerReference(hb, cert, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Create(ctx, cert); err != nil {
+		return err
+	}
+	r.Log.Info("created certificate", "name", name, "role", role)
+	return nil
+}
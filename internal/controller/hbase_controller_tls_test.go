@@ -0,0 +1,184 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/go-logr/logr"
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestTLS(t *testing.T) {
+	ctx := context.Background()
+	hb := &hbasev1.HBase{
+		ObjectMeta: metav1.ObjectMeta{Name: "hbase", Namespace: "default", UID: "uid"},
+		Spec: hbasev1.HBaseSpec{
+			Config: hbasev1.ConfigMap{Data: map[string]string{
+				hbaseSiteFile: siteXML("hbase.rootdir", "hdfs://nn"),
+			}},
+			RegionServerSpec: hbasev1.ServerSpec{PodSpec: corev1.PodSpec{Containers: []corev1.Container{
+				{Name: "server", Image: "hbase:2.6"},
+			}}},
+			Security: &hbasev1.SecuritySpec{TLS: &hbasev1.TLSSpec{
+				Master: hbasev1.TLSCertificate{SecretName: "master-tls"},
+				RegionServer: hbasev1.TLSCertificate{
+					Issuer: &hbasev1.IssuerReference{Name: "ca", Kind: "ClusterIssuer"},
+				},
+				KeystorePassword: corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "tls-password"},
+					Key:                  "password",
+				},
+			}},
+		},
+	}
+	sch := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(sch); err != nil {
+		t.Fatal(err)
+	}
+	if err := hbasev1.AddToScheme(sch); err != nil {
+		t.Fatal(err)
+	}
+	sch.AddKnownTypeWithName(certificateGVK, &unstructured.Unstructured{})
+	certData := map[string][]byte{"tls.crt": []byte("crt"), "tls.key": []byte("key"), "ca.crt": []byte("ca")}
+	r := &HBaseReconciler{
+		Client: fake.NewClientBuilder().WithScheme(sch).WithObjects(hb, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "master-tls", Namespace: hb.Namespace},
+			Data:       certData,
+		}).Build(),
+		Scheme:        sch,
+		Log:           logr.Discard(),
+		ClusterDomain: "cluster.local",
+	}
+
+	master, issued, err := r.roleSecretDigests(ctx, hb, masterRole, map[string]string{"jaas.conf": "digest"})
+	if err != nil || !issued {
+		t.Fatal(issued, err)
+	}
+	if master["jaas.conf"] != "digest" || master[tlsDigestKey] == "" {
+		t.Errorf("expected digest of certificate along with digests of sources: %v", master)
+	}
+
+	// the certificate of RegionServers is requested from cert-manager
+	if _, issued, err := r.roleSecretDigests(ctx, hb, regionServerRole, nil); err != nil || issued {
+		t.Fatalf("expected to wait until the certificate is issued: %v", err)
+	}
+	if !meta.IsStatusConditionTrue(hb.Status.Conditions, hbasev1.ConditionCertificatePending) {
+		t.Errorf("expected pending certificate condition: %v", hb.Status.Conditions)
+	}
+	cert := &unstructured.Unstructured{}
+	cert.SetGroupVersionKind(certificateGVK)
+	if err := r.Get(ctx, types.NamespacedName{Name: "hbase-regionserver-tls", Namespace: hb.Namespace},
+		cert); err != nil {
+		t.Fatal(err)
+	}
+	dnsNames, _, _ := unstructured.NestedStringSlice(cert.Object, "spec", "dnsNames")
+	kind, _, _ := unstructured.NestedString(cert.Object, "spec", "issuerRef", "kind")
+	if !slices.Contains(dnsNames, "*.hbase.default.svc.cluster.local") || kind != "ClusterIssuer" ||
+		len(cert.GetOwnerReferences()) != 1 {
+		t.Errorf("unexpected certificate: %v", cert.Object)
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "hbase-regionserver-tls", Namespace: hb.Namespace},
+		Data:       certData,
+	}
+	if err := r.Create(ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+	rs, issued, err := r.roleSecretDigests(ctx, hb, regionServerRole, nil)
+	if err != nil || !issued {
+		t.Fatal(issued, err)
+	}
+
+	// rotation of the certificate changes the config ConfigMap, which restarts servers
+	data, err := r.roleConfigData(hb, regionServerRole, hb.Spec.Config.Data, hb.Spec.RegionServerSpec,
+		hbasev1.ConfigProperties{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := getConfigMapName(hb, regionServerRole, data, rs)
+	secret.Data = map[string][]byte{"tls.crt": []byte("rotated"), "tls.key": []byte("key"), "ca.crt": []byte("ca")}
+	if err := r.Update(ctx, secret); err != nil {
+		t.Fatal(err)
+	}
+	if rs, _, err = r.roleSecretDigests(ctx, hb, regionServerRole, nil); err != nil {
+		t.Fatal(err)
+	}
+	if getConfigMapName(hb, regionServerRole, data, rs) == name {
+		t.Error("expected rotation of certificate to change the ConfigMap name")
+	}
+	if requests := r.hbasesForSecret(ctx, secret); len(requests) != 1 {
+		t.Errorf("expected rotation of certificate to reconcile HBase: %v", requests)
+	}
+
+	props, err := parseSiteXML(data[hbaseSiteFile])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{
+		"hbase.rootdir":                           "hdfs://nn",
+		"hbase.server.netty.tls.enabled":          "true",
+		"hbase.server.netty.tls.supportplaintext": "false",
+		"hbase.rpc.tls.keystore.location":         "/etc/hbase/tls/keystore.p12",
+		"hbase.rpc.tls.keystore.password":         "${env.HBASE_TLS_PASSWORD}",
+		"hbase.ssl.enabled":                       "true",
+		"ssl.server.truststore.location":          "/etc/hbase/tls/truststore.p12",
+	} {
+		if props[k] != v {
+			t.Errorf("expected %s=%q, got %q", k, v, props[k])
+		}
+	}
+
+	rsName := types.NamespacedName{Name: regionServerRole, Namespace: hb.Namespace}
+	sts, _ := r.statefulSet(hb, rsName, name, hb.Spec.RegionServerSpec)
+	spec := sts.Spec.Template.Spec
+	if len(spec.InitContainers) != 1 || spec.InitContainers[0].Image != "hbase:2.6" ||
+		spec.InitContainers[0].Env[0].ValueFrom.SecretKeyRef.Name != "tls-password" {
+		t.Errorf("unexpected init containers: %v", spec.InitContainers)
+	}
+	i := slices.IndexFunc(spec.Volumes, func(v corev1.Volume) bool { return v.Name == tlsCertificateVolumeName })
+	if i < 0 || spec.Volumes[i].Secret.SecretName != "hbase-regionserver-tls" {
+		t.Errorf("expected certificate volume of RegionServers: %v", spec.Volumes)
+	}
+	server := spec.Containers[0]
+	if len(server.VolumeMounts) != 1 || server.VolumeMounts[0].MountPath != tlsMountPath ||
+		len(server.Env) != 1 || server.Env[0].Name != tlsPasswordEnv {
+		t.Errorf("unexpected server container: %v", server)
+	}
+
+	// the operator can't drain servers that only accept TLS, restarts are opted in
+	if err := validateSecurity(hb); err == nil {
+		t.Error("expected error for TLS without plaintext")
+	}
+	hb.Spec.Security.RestartWithoutDrain = true
+	if err := validateSecurity(hb); err != nil || unsupportedRPCReason(hb) == "" {
+		t.Errorf("expected servers to be restarted without RPCs: %v", err)
+	}
+	hb.Spec.Security.RestartWithoutDrain = false
+	hb.Spec.Security.TLS.AllowPlaintext = true
+	if err := validateSecurity(hb); err != nil || unsupportedRPCReason(hb) != "" {
+		t.Errorf("expected RPCs in plaintext: %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"sort"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	"github.com/tsuna/gohbase/pb"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// podDomains returns failure domains of pods keyed by pod name. The domain is
+// the value of the label key of the node the pod runs on, it's empty if the pod
+// isn't scheduled or the node doesn't have the label.
+func (r *HBaseReconciler) podDomains(ctx context.Context, key string,
+	pods ...[]*corev1.Pod) (map[string]string, error) {
+	domains := map[string]string{}
+	nodes := map[string]string{}
+	for _, ps := range pods {
+		for _, p := range ps {
+			node := p.Spec.NodeName
+			d, ok := nodes[node]
+			if !ok && node != "" {
+				n := &corev1.Node{}
+				if err := r.Get(ctx, types.NamespacedName{Name: node}, n); err != nil && !errors.IsNotFound(err) {
+					return nil, err
+				}
+				d = n.Labels[key]
+				nodes[node] = d
+			}
+			domains[p.Name] = d
+		}
+	}
+	return domains, nil
+}
+
+// currentDomain returns the failure domain to restart RegionServers in. It's
+// the domain of the drain in progress, otherwise domains that are partially
+// restarted go first and the domain of hbase:meta goes last.
+func currentDomain(hb *hbasev1.HBase, td, utd []*corev1.Pod, metaServer string,
+	domains map[string]string) string {
+	if d := hb.Status.Drain; d != nil {
+		for _, rs := range d.RegionServers {
+			if p := findPod(td, rs.Pod); p != nil {
+				return domains[p.Name]
+			}
+		}
+	}
+
+	restarted := map[string]bool{}
+	for _, p := range utd {
+		restarted[domains[p.Name]] = true
+	}
+	var metaDomain string
+	seen := map[string]bool{}
+	var ds []string
+	for _, p := range td {
+		d := domains[p.Name]
+		if isPodServer(p, metaServer) {
+			metaDomain = d
+		}
+		if !seen[d] {
+			seen[d] = true
+			ds = append(ds, d)
+		}
+	}
+	sort.Slice(ds, func(i, j int) bool {
+		if restarted[ds[i]] != restarted[ds[j]] {
+			return restarted[ds[i]]
+		}
+		if (ds[i] == metaDomain) != (ds[j] == metaDomain) {
+			return ds[j] == metaDomain
+		}
+		return ds[i] < ds[j]
+	})
+	return ds[0]
+}
+
+// podsInDomain returns pods in the failure domain
+func podsInDomain(pods []*corev1.Pod, domain string, domains map[string]string) []*corev1.Pod {
+	var result []*corev1.Pod
+	for _, p := range pods {
+		if domains[p.Name] == domain {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// podOfServer returns the pod of the RegionServer
+func podOfServer(pods []*corev1.Pod, sn string) *corev1.Pod {
+	for _, p := range pods {
+		if isPodServer(p, sn) {
+			return p
+		}
+	}
+	return nil
+}
+
+// drainTargets returns RegionServers to move regions of the batch to. These
+// are up-to-date RegionServers, preferably in other failure domains than the batch.
+// With topology, RegionServers outside of failure domains of the batch are
+// preferred over up-to-date ones inside of them, so that regions leave the
+// domain being restarted. Without topology, if there are no up-to-date
+// RegionServers, a batch of several RegionServers is drained to RegionServers
+// outside of it, so that regions don't move between RegionServers of the batch.
+func drainTargets(hb *hbasev1.HBase, rrs map[string][]*pb.RegionLoad, rates map[string]float64,
+	batch, td, utd []*corev1.Pod, domains map[string]string) targetSelector {
+	batchDomains := map[string]bool{}
+	if domains != nil {
+		for _, p := range batch {
+			batchDomains[domains[p.Name]] = true
+		}
+	}
+	upToDate := map[string][]*pb.RegionLoad{}
+	otherDomains := map[string][]*pb.RegionLoad{}
+	rest := map[string][]*pb.RegionLoad{}
+	for rs, regions := range rrs {
+		if p := podOfServer(utd, rs); p != nil {
+			upToDate[rs] = regions
+			if !batchDomains[domains[p.Name]] {
+				otherDomains[rs] = regions
+			}
+		} else if p := podOfServer(td, rs); p != nil &&
+			podOfServer(batch, rs) == nil && !batchDomains[domains[p.Name]] {
+			rest[rs] = regions
+		}
+	}
+
+	targets := upToDate
+	switch {
+	case domains != nil && len(otherDomains) > 0:
+		targets = otherDomains
+	case domains != nil && len(rest) > 0:
+		targets = rest
+	case len(targets) == 0 && len(batch) > 1:
+		targets = rest
+	}
+	return newTargetSelector(hb.Spec.Drain.TargetSelection, targets, rates)
+}
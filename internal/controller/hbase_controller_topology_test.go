@@ -0,0 +1,164 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	hbasev1 "github.com/timoha/hbase-k8s-operator/api/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// makeZonedPods returns pods scheduled on nodes in zones, which are created
+// with the client of the reconciler
+func makeZonedPods(t *testing.T, r *HBaseReconciler, zones map[string]string, names ...string) []*corev1.Pod {
+	pods := makePods(names...)
+	for _, p := range pods {
+		p.Spec.NodeName = "node-" + p.Name
+		node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{
+			Name:   p.Spec.NodeName,
+			Labels: map[string]string{"topology.kubernetes.io/zone": zones[p.Name]},
+		}}
+		if err := r.Create(context.Background(), node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return pods
+}
+
+func TestPickRegionServerToDeleteTopology(t *testing.T) {
+	ctx := context.Background()
+	zones := map[string]string{
+		"regionserver-0": "a",
+		"regionserver-1": "a",
+		"regionserver-2": "b",
+		"regionserver-3": "b",
+		"regionserver-4": "c",
+	}
+	newCluster := func() *fakeCluster {
+		return &fakeCluster{servers: map[string][]string{
+			"regionserver-0": {regionName(0)},
+			"regionserver-1": {regionName(1)},
+			"regionserver-2": {regionName(2)},
+			"regionserver-3": {regionName(3)},
+			"regionserver-4": {"hbase:meta,,1", regionName(4)},
+		}}
+	}
+
+	t.Run("one domain at a time", func(t *testing.T) {
+		c := newCluster()
+		hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{Rollout: hbasev1.RolloutSpec{
+			Topology: &hbasev1.TopologySpec{Key: "topology.kubernetes.io/zone"},
+		}}}
+		r := newTestReconciler(t, c, hb)
+		pods := makeZonedPods(t, r, zones,
+			"regionserver-4", "regionserver-3", "regionserver-2", "regionserver-1", "regionserver-0")
+
+		// the partially restarted domain goes first and its regions move to other
+		// domains rather than to up-to-date regionserver-0 of the same domain
+		ps, _, err := r.pickRegionServerToDelete(ctx, hb, pods[:4], pods[4:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ps) != 1 || ps[0].Name != "regionserver-1" {
+			t.Fatalf("expected regionserver-1 to be picked, got %v", sprintPodList(ps))
+		}
+		if len(c.servers["regionserver-1"]) != 0 || len(c.servers["regionserver-0"]) != 1 {
+			t.Errorf("expected regions to move out of domain a, got %v", c.servers)
+		}
+
+		// the domain without hbase:meta goes before the one with it
+		ps, _, err = r.pickRegionServerToDelete(ctx, hb, pods[:3], pods[3:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ps) != 1 || ps[0].Name != "regionserver-3" {
+			t.Fatalf("expected regionserver-3 to be picked, got %v", sprintPodList(ps))
+		}
+	})
+
+	t.Run("one pod without up-to-date regionservers", func(t *testing.T) {
+		c := newCluster()
+		hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{Rollout: hbasev1.RolloutSpec{
+			Topology: &hbasev1.TopologySpec{Key: "topology.kubernetes.io/zone"},
+		}}}
+		r := newTestReconciler(t, c, hb)
+		pods := makeZonedPods(t, r, zones,
+			"regionserver-4", "regionserver-3", "regionserver-2", "regionserver-1", "regionserver-0")
+
+		// regions move to regionservers of other domains, not to the one left in domain a
+		ps, _, err := r.pickRegionServerToDelete(ctx, hb, pods, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ps) != 1 || ps[0].Name != "regionserver-1" {
+			t.Fatalf("expected regionserver-1 to be picked, got %v", sprintPodList(ps))
+		}
+		if len(c.servers["regionserver-1"]) != 0 || len(c.servers["regionserver-0"]) != 1 {
+			t.Errorf("expected regions to move out of domain a, got %v", c.servers)
+		}
+	})
+
+	t.Run("parallel restart", func(t *testing.T) {
+		c := newCluster()
+		hb := &hbasev1.HBase{Spec: hbasev1.HBaseSpec{Rollout: hbasev1.RolloutSpec{
+			Topology: &hbasev1.TopologySpec{Key: "topology.kubernetes.io/zone", ParallelRestart: true},
+		}}}
+		r := newTestReconciler(t, c, hb)
+		pods := makeZonedPods(t, r, zones,
+			"regionserver-4", "regionserver-3", "regionserver-2", "regionserver-1", "regionserver-0")
+
+		ps, _, err := r.pickRegionServerToDelete(ctx, hb, pods, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sprintPodList(ps); got != "[regionserver-1 regionserver-0]" {
+			t.Fatalf("expected all regionservers of domain a to be picked, got %v", got)
+		}
+		if len(c.servers["regionserver-0"]) != 0 || len(c.servers["regionserver-1"]) != 0 {
+			t.Errorf("expected regions to move out of domain a, got %v", c.servers)
+		}
+	})
+
+	t.Run("parallel restart within limits", func(t *testing.T) {
+		one := intstr.FromInt32(1)
+		for _, spec := range []hbasev1.HBaseSpec{
+			{Canary: &hbasev1.CanarySpec{Count: 1, SoakDuration: metav1.Duration{Duration: time.Hour}}},
+			{RegionServerSpec: hbasev1.ServerSpec{Count: 5, MaxUnavailable: &one}},
+		} {
+			c := newCluster()
+			hb := &hbasev1.HBase{Spec: spec}
+			hb.Spec.Rollout.Topology = &hbasev1.TopologySpec{Key: "topology.kubernetes.io/zone", ParallelRestart: true}
+			r := newTestReconciler(t, c, hb)
+			pods := makeZonedPods(t, r, zones,
+				"regionserver-4", "regionserver-3", "regionserver-2", "regionserver-1", "regionserver-0")
+
+			ps, _, err := r.pickRegionServerToDelete(ctx, hb, pods, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sprintPodList(ps); got != "[regionserver-1]" {
+				t.Fatalf("expected a single regionserver of domain a to be picked, got %v", got)
+			}
+			if len(c.servers["regionserver-1"]) != 0 || len(c.moved) != 1 {
+				t.Errorf("expected only regions of regionserver-1 to move, got %v", c.servers)
+			}
+		}
+	})
+}
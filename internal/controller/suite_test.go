@@ -103,10 +103,11 @@ var _ = BeforeSuite(func() {
 	Expect(err).ToNot(HaveOccurred())
 
 	err = (&HBaseReconciler{
-		Client:  k8sManager.GetClient(),
-		Log:     ctrl.Log.WithName("controllers").WithName("HBase"),
-		Scheme:  k8sManager.GetScheme(),
-		GhAdmin: ghAdmin,
+		Client:   k8sManager.GetClient(),
+		Log:      ctrl.Log.WithName("controllers").WithName("HBase"),
+		Scheme:   k8sManager.GetScheme(),
+		Recorder: k8sManager.GetEventRecorderFor("hbase-controller"),
+		GhAdmin:  &sendRPCAdminClient{MockAdminClient: ghAdmin},
 	}).SetupWithManager(k8sManager)
 	Expect(err).ToNot(HaveOccurred())
 